@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states, also the values of the smee_circuit_breaker_state gauge
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker fast-fails forwards to a downstream that keeps failing.
+// After threshold consecutive failures it opens for cooldown, then lets a
+// single probe through (half-open): a successful probe closes it again and a
+// failed one reopens it for another cooldown.
+type circuitBreaker struct {
+	target    string
+	threshold int
+	cooldown  time.Duration
+	// Overridable clock for tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(target string, threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{
+		target:    target,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+	b.setState(circuitClosed)
+	return b
+}
+
+// allow reports whether a forward may proceed. Every allowed forward must be
+// followed by a call to record, or to release if it never reached the downstream.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		// Only one probe at a time while half-open
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record reports the outcome of an allowed forward
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.failures = 0
+		b.probing = false
+		b.setState(circuitClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.probing = false
+		b.openedAt = b.now()
+		b.setState(circuitOpen)
+	}
+}
+
+// release ends an allowed forward that never reached the downstream, e.g.
+// because its body could not be read, without counting it either way. A
+// half-open breaker lets the next forward through as its probe instead.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	circuitBreakerState.WithLabelValues(b.target).Set(float64(state))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Circuit Breaker", func() {
+	var (
+		breaker *circuitBreaker
+		now     time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+		breaker = newCircuitBreaker("downstream:8080", 3, 30*time.Second)
+		breaker.now = func() time.Time { return now }
+	})
+
+	state := func() float64 {
+		return testutil.ToFloat64(circuitBreakerState.WithLabelValues("downstream:8080"))
+	}
+
+	It("should open after consecutive failures and fast-fail during the cooldown", func() {
+		for i := 0; i < 3; i++ {
+			Expect(breaker.allow()).To(BeTrue())
+			breaker.record(false)
+		}
+
+		Expect(breaker.allow()).To(BeFalse())
+		Expect(state()).To(Equal(float64(circuitOpen)))
+	})
+
+	It("should not open when failures are interleaved with successes", func() {
+		for i := 0; i < 5; i++ {
+			breaker.record(false)
+			breaker.record(false)
+			breaker.record(true)
+		}
+
+		Expect(breaker.allow()).To(BeTrue())
+		Expect(state()).To(Equal(float64(circuitClosed)))
+	})
+
+	It("should let a single probe through once the cooldown elapses", func() {
+		for i := 0; i < 3; i++ {
+			breaker.record(false)
+		}
+		now = now.Add(31 * time.Second)
+
+		Expect(breaker.allow()).To(BeTrue())
+		Expect(state()).To(Equal(float64(circuitHalfOpen)))
+		Expect(breaker.allow()).To(BeFalse())
+
+		breaker.record(true)
+		Expect(state()).To(Equal(float64(circuitClosed)))
+		Expect(breaker.allow()).To(BeTrue())
+	})
+
+	It("should reopen when the probe fails", func() {
+		for i := 0; i < 3; i++ {
+			breaker.record(false)
+		}
+		now = now.Add(31 * time.Second)
+
+		Expect(breaker.allow()).To(BeTrue())
+		breaker.record(false)
+
+		Expect(state()).To(Equal(float64(circuitOpen)))
+		Expect(breaker.allow()).To(BeFalse())
+	})
+
+	It("should let another probe through when one is released unrecorded", func() {
+		for i := 0; i < 3; i++ {
+			breaker.record(false)
+		}
+		now = now.Add(31 * time.Second)
+
+		Expect(breaker.allow()).To(BeTrue())
+		breaker.release()
+
+		Expect(state()).To(Equal(float64(circuitHalfOpen)))
+		Expect(breaker.allow()).To(BeTrue())
+	})
+
+	Describe("in forwardHandler", func() {
+		var (
+			downstream *httptest.Server
+			hits       atomic.Int32
+		)
+
+		BeforeEach(func() {
+			hits.Store(0)
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			circuitBreakerThreshold = 3
+			circuitBreakerCooldown = 30 * time.Second
+			replica, err := newDownstreamReplica(downstream.URL)
+			Expect(err).NotTo(HaveOccurred())
+			replica.breaker = breaker
+			proxyReplicas = []*downstreamReplica{replica}
+			proxyOnce = sync.Once{}
+			proxyOnce.Do(func() {})
+			proxyError = nil
+		})
+
+		AfterEach(func() {
+			circuitBreakerThreshold = 0
+			circuitBreakerCooldown = 0
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			downstream.Close()
+		})
+
+		It("should stop calling a failing downstream once the circuit opens", func() {
+			codes := []int{}
+			for i := 0; i < 5; i++ {
+				recorder := httptest.NewRecorder()
+				forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
+				codes = append(codes, recorder.Code)
+			}
+
+			Expect(codes).To(Equal([]int{503, 503, 503, 503, 503}))
+			Expect(hits.Load()).To(Equal(int32(3)))
+		})
+
+		It("should keep forwarding to healthy replicas while one replica's circuit is open", func() {
+			var healthyHits atomic.Int32
+			healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				healthyHits.Add(1)
+			}))
+			defer healthy.Close()
+			dead, err := newDownstreamReplica(downstream.URL)
+			Expect(err).NotTo(HaveOccurred())
+			live, err := newDownstreamReplica(healthy.URL)
+			Expect(err).NotTo(HaveOccurred())
+			proxyReplicas = []*downstreamReplica{dead, live}
+
+			for i := 0; i < 10; i++ {
+				forwardHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", bytes.NewBufferString(`{}`)))
+			}
+
+			// Successes on the healthy replica don't reset the dead one's failures
+			Expect(hits.Load()).To(Equal(int32(3)))
+			Expect(healthyHits.Load()).To(Equal(int32(7)))
+			Expect(testutil.ToFloat64(circuitBreakerState.WithLabelValues(dead.target))).To(Equal(float64(circuitOpen)))
+			Expect(testutil.ToFloat64(circuitBreakerState.WithLabelValues(live.target))).To(Equal(float64(circuitClosed)))
+		})
+
+		It("should not stay open when the half-open probe is rejected before forwarding", func() {
+			bufferForwardBodies = true
+			maxRequestBodyBytes = 16
+			defer func() {
+				bufferForwardBodies = false
+				maxRequestBodyBytes = 25 * 1024 * 1024
+			}()
+			for i := 0; i < 3; i++ {
+				breaker.record(false)
+			}
+			now = now.Add(31 * time.Second)
+
+			// Unknown length, so the limit only trips while buffering
+			oversized := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(strings.Repeat("a", 32))))
+			recorder := httptest.NewRecorder()
+			forwardHandler(recorder, oversized)
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(hits.Load()).To(BeZero())
+
+			recorder = httptest.NewRecorder()
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{}`)))
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(hits.Load()).To(Equal(int32(1)))
+		})
+	})
+})
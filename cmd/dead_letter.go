@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Header telling the dead-letter endpoint why an event couldn't be forwarded
+const deadLetterReasonHeader = "X-Smee-Dead-Letter-Reason"
+
+// forwardErrorKey carries a *error in a forward's context, set by
+// proxyErrorHandler so the failure can be reported to the dead-letter endpoint
+type forwardErrorKey struct{}
+
+// deadLetterReason describes why a completed forward should be dead-lettered,
+// or returns "" when it was delivered (or rejected in a way retrying
+// elsewhere wouldn't change). Like deliverQueuedEvent, every 5xx plus 408 and
+// 429 count as failures worth retrying.
+func deadLetterReason(status int, err error) string {
+	switch {
+	case err != nil:
+		return fmt.Sprintf("proxy error: %v", err)
+	case status == 0 || status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests:
+		return fmt.Sprintf("downstream returned status %d", status)
+	}
+	return ""
+}
+
+// deadLetter keeps a forward that failed for good in the dead-letter store
+// and hands it to the dead-letter endpoint in the background, logging the body
+// if neither takes it so the event can still be recovered by hand
+func deadLetter(r *http.Request, reason string) {
+	// A failed replay is still in the store, kept there for the next one
+	if isDeadLetterReplay(r) {
+		return
+	}
+	if r.GetBody == nil {
+		log.Printf("ERROR: Cannot dead-letter event (%s): body was not buffered", reason)
+		return
+	}
+	rc, err := r.GetBody()
+	if err != nil {
+		log.Printf("ERROR: Cannot dead-letter event (%s): %v", reason, err)
+		return
+	}
+	body, _ := io.ReadAll(rc)
+	rc.Close()
+	header := r.Header.Clone()
+
+	if deadLetters != nil {
+		err := deadLetters.store(storedDeadLetter{
+			Time:   time.Now(),
+			Reason: reason,
+			Method: r.Method,
+			URI:    r.URL.RequestURI(),
+			Header: header,
+			Body:   body,
+		})
+		switch {
+		case err == nil:
+			log.Printf("Stored dead-lettered event in %s (%s)", deadLetters.dir, reason)
+		case deadLetterURL == "":
+			log.Printf("ERROR: Failed to store dead-lettered event (%v), dropping event (%s): %s", err, reason, body)
+			return
+		default:
+			log.Printf("ERROR: Failed to store dead-lettered event (%s): %v", reason, err)
+		}
+	}
+	// Captured now: the goroutine may outlive a reconfiguration
+	target, client := deadLetterURL, deadLetterClient
+	if target == "" {
+		return
+	}
+
+	go func() {
+		// The forward's own deadline may be what failed it
+		ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+		defer cancel()
+		if err := sendDeadLetter(ctx, client, target, header, body, reason); err != nil {
+			log.Printf("ERROR: Dead-letter delivery failed (%v), dropping event (%s): %s", err, reason, body)
+			return
+		}
+		deadLettered.Inc()
+		log.Printf("Dead-lettered event to %s (%s)", redactURL(target), reason)
+	}()
+}
+
+// sendDeadLetter POSTs an event's body and original headers to the
+// dead-letter endpoint at target
+func sendDeadLetter(ctx context.Context, client *http.Client, target string, header http.Header, body []byte, reason string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set(deadLetterReasonHeader, reason)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	drainBounded(resp.Body, healthCheckMaxResponseBytes)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("dead-letter endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
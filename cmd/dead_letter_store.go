@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+const deadLetterFileSuffix = ".json"
+
+var errDeadLetterStoreFull = errors.New("dead-letter store is full")
+
+// deadLetterReplayKey marks a forward replayed from the dead-letter store, so
+// a repeated failure keeps the stored file instead of storing a second copy
+// or posting it to the dead-letter endpoint
+type deadLetterReplayKey struct{}
+
+// storedDeadLetter is a failed forward persisted in the dead-letter store
+type storedDeadLetter struct {
+	Time   time.Time   `json:"time"`
+	Reason string      `json:"reason"`
+	Method string      `json:"method"`
+	URI    string      `json:"uri"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// deadLetterStore keeps failed forwards as one file each in dir until they
+// are replayed, holding at most maxBytes of files
+type deadLetterStore struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	// Held for the whole of a replay so two can't deliver the same events
+	replaying sync.Mutex
+
+	jobMu sync.Mutex
+	// The running or last /admin/replay job
+	job deadLetterReplayStatus
+}
+
+// openDeadLetterStore opens (or creates) the store in dir, counting the
+// events left by a previous run against maxBytes
+func openDeadLetterStore(dir string, maxBytes int64) (*deadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory: %v", err)
+	}
+	s := &deadLetterStore{dir: dir, maxBytes: maxBytes}
+	names, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			s.bytes += info.Size()
+		}
+	}
+	return s, nil
+}
+
+// list returns the stored event file names, oldest first
+func (s *deadLetterStore) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), deadLetterFileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// store persists an event, writing it under a temporary name first so a
+// replay never reads a partial file
+func (s *deadLetterStore) store(event storedDeadLetter) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bytes+int64(len(data)) > s.maxBytes {
+		return errDeadLetterStoreFull
+	}
+	tmp, err := os.CreateTemp(s.dir, ".dead-letter-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Zero-padded nanoseconds keep the names in arrival order
+	name := fmt.Sprintf("%020d-%s%s", event.Time.UnixNano(), uuid.New().String(), deadLetterFileSuffix)
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	s.bytes += int64(len(data))
+	return nil
+}
+
+// remove deletes a stored event once it has been delivered
+func (s *deadLetterStore) remove(name string) error {
+	path := filepath.Join(s.dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.bytes -= info.Size()
+	s.mu.Unlock()
+	return nil
+}
+
+// storedAt returns when a stored event failed, from the time its file name
+// starts with, falling back to the file's modification time
+func (s *deadLetterStore) storedAt(name string) (time.Time, error) {
+	if prefix, _, ok := strings.Cut(name, "-"); ok {
+		if nanos, err := strconv.ParseInt(prefix, 10, 64); err == nil {
+			return time.Unix(0, nanos), nil
+		}
+	}
+	info, err := os.Stat(filepath.Join(s.dir, name))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// expire deletes the events stored before now-maxAge, which are no longer
+// worth replaying, and returns how many it deleted
+func (s *deadLetterStore) expire(maxAge time.Duration, now time.Time) (int, error) {
+	// Not while a replay may be delivering the same files
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	names, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	// Oldest first, so stop at the first event young enough to keep
+	for _, name := range names {
+		storedAt, err := s.storedAt(name)
+		if err != nil {
+			continue
+		}
+		if now.Sub(storedAt) <= maxAge {
+			break
+		}
+		if err := s.remove(name); err != nil {
+			log.Printf("ERROR: Failed to delete expired dead-lettered event %s: %v", name, err)
+			continue
+		}
+		deadLettersExpired.Inc()
+		expired++
+	}
+	return expired, nil
+}
+
+// runDeadLetterJanitor periodically deletes stored events older than maxAge
+func runDeadLetterJanitor(ctx context.Context, store *deadLetterStore, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired, err := store.expire(maxAge, now)
+			if err != nil {
+				log.Printf("ERROR: Failed to expire dead-lettered events: %v", err)
+			} else if expired > 0 {
+				log.Printf("Deleted %d dead-lettered events older than %s", expired, maxAge)
+			}
+		}
+	}
+}
+
+// deadLetterReplayResult counts the events a replay delivered and kept
+type deadLetterReplayResult struct {
+	Replayed int `json:"replayed"`
+	Failed   int `json:"failed"`
+}
+
+// deadLetterReplayStatus is the body answered by /admin/replay: the running
+// replay, or the result of the last one
+type deadLetterReplayStatus struct {
+	Running  bool       `json:"running"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	deadLetterReplayResult
+	Error string `json:"error,omitempty"`
+}
+
+// deadLetterReplayLimits bounds how hard a replay hits a just-recovered downstream
+type deadLetterReplayLimits struct {
+	// Events replayed at once
+	concurrency int
+	// Events started per second (unlimited when zero)
+	rate float64
+}
+
+// replay serves every stored event, oldest first, through handler, deleting
+// each one the handler answers with a 2xx and keeping the rest for next time.
+// With a concurrency above one, events are no longer delivered strictly in order.
+func (s *deadLetterStore) replay(ctx context.Context, handler http.Handler, limits deadLetterReplayLimits) (deadLetterReplayResult, error) {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+
+	var result deadLetterReplayResult
+	names, err := s.list()
+	if err != nil {
+		return result, err
+	}
+	var limiter *rate.Limiter
+	if limits.rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(limits.rate), 1)
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, max(limits.concurrency, 1))
+	)
+	for _, name := range names {
+		if limiter != nil && limiter.Wait(ctx) != nil {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			delivered := s.replayAndRemove(ctx, handler, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if delivered {
+				result.Replayed++
+			} else {
+				result.Failed++
+			}
+		}()
+	}
+	wg.Wait()
+	return result, ctx.Err()
+}
+
+// startReplay runs replay in the background until it's done or ctx is
+// cancelled, so it isn't bound by the deadline of the request that started it.
+// It reports false, with the running job's status, if a replay is already running.
+func (s *deadLetterStore) startReplay(ctx context.Context, handler http.Handler, limits deadLetterReplayLimits) (deadLetterReplayStatus, bool) {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	if s.job.Running {
+		return s.job, false
+	}
+	started := time.Now()
+	s.job = deadLetterReplayStatus{Running: true, Started: &started}
+
+	go func() {
+		result, err := s.replay(ctx, handler, limits)
+		finished := time.Now()
+		status := deadLetterReplayStatus{Started: &started, Finished: &finished, deadLetterReplayResult: result}
+		if err != nil {
+			status.Error = err.Error()
+			log.Printf("ERROR: Dead-letter replay stopped after %s: %v (%d delivered, %d kept)", finished.Sub(started), err, result.Replayed, result.Failed)
+		} else {
+			log.Printf("Dead-letter replay finished in %s: %d delivered, %d kept", finished.Sub(started), result.Replayed, result.Failed)
+		}
+		s.jobMu.Lock()
+		defer s.jobMu.Unlock()
+		s.job = status
+	}()
+	return s.job, true
+}
+
+// replayStatus returns the status of the running or last replay job
+func (s *deadLetterStore) replayStatus() deadLetterReplayStatus {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	return s.job
+}
+
+// replayAndRemove replays one stored event, deleting it once delivered, and
+// reports whether it was
+func (s *deadLetterStore) replayAndRemove(ctx context.Context, handler http.Handler, name string) bool {
+	status, err := s.replayOne(ctx, handler, name)
+	if err != nil {
+		log.Printf("ERROR: Failed to replay dead-lettered event %s: %v", name, err)
+		deadLetterReplays.WithLabelValues("failed").Inc()
+		return false
+	}
+	if status < 200 || status > 299 {
+		log.Printf("Replay of dead-lettered event %s got status %d, keeping it", name, status)
+		deadLetterReplays.WithLabelValues("failed").Inc()
+		return false
+	}
+	if err := s.remove(name); err != nil {
+		log.Printf("ERROR: Replayed dead-lettered event %s but failed to delete it: %v", name, err)
+	}
+	deadLetterReplays.WithLabelValues("delivered").Inc()
+	return true
+}
+
+func (s *deadLetterStore) replayOne(ctx context.Context, handler http.Handler, name string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	var event storedDeadLetter
+	if err := json.Unmarshal(data, &event); err != nil {
+		return 0, err
+	}
+	ctx = context.WithValue(ctx, deadLetterReplayKey{}, true)
+	req, err := http.NewRequestWithContext(ctx, event.Method, event.URI, bytes.NewReader(event.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = event.Header
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.RemoteAddr = "dead-letter-replay"
+
+	w := &smeeResponseWriter{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(w, req)
+	return w.status, nil
+}
+
+// isDeadLetterReplay reports whether a forward was replayed from the store
+func isDeadLetterReplay(r *http.Request) bool {
+	return r.Context().Value(deadLetterReplayKey{}) != nil
+}
+
+// replayLimits returns the configured replay limits, overridden for one
+// replay by the concurrency and rate query parameters
+func replayLimits(r *http.Request) (deadLetterReplayLimits, error) {
+	limits := deadLetterReplayLimits{concurrency: deadLetterReplayConcurrency, rate: deadLetterReplayRate}
+	query := r.URL.Query()
+	if value := query.Get("concurrency"); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency <= 0 {
+			return limits, fmt.Errorf("invalid concurrency %q, must be a positive integer", value)
+		}
+		limits.concurrency = concurrency
+	}
+	if value := query.Get("rate"); value != "" {
+		replayRate, err := strconv.ParseFloat(value, 64)
+		if err != nil || replayRate <= 0 {
+			return limits, fmt.Errorf("invalid rate %q, must be a positive number of events per second", value)
+		}
+		limits.rate = replayRate
+	}
+	return limits, nil
+}
+
+// newReplayHandler starts a replay of the dead-letter store through
+// forwardHandler on POST, answering 202 right away, and reports its progress
+// on GET, for callers presenting the admin token. Replays run until done or
+// until ctx is cancelled at shutdown.
+func newReplayHandler(ctx context.Context, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, token) {
+			rejectUnauthorized(w)
+			return
+		}
+
+		code, status := http.StatusOK, deadLetters.replayStatus()
+		if r.Method == http.MethodPost {
+			limits, err := replayLimits(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var started bool
+			if status, started = deadLetters.startReplay(ctx, http.HandlerFunc(forwardHandler), limits); started {
+				log.Printf("Dead-letter replay started via /admin/replay")
+				code = http.StatusAccepted
+			} else {
+				code = http.StatusConflict
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("Failed to encode replay status: %v", err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Dead Letter Store", func() {
+	var (
+		dir   string
+		store *deadLetterStore
+	)
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		var err error
+		store, err = openDeadLetterStore(dir, 1024)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	event := func(body string, at time.Time) storedDeadLetter {
+		return storedDeadLetter{Time: at, Reason: "test", Method: "POST", URI: "/", Body: []byte(body)}
+	}
+
+	It("should list stored events oldest first", func() {
+		now := time.Now()
+		Expect(store.store(event("second", now.Add(time.Second)))).To(Succeed())
+		Expect(store.store(event("first", now))).To(Succeed())
+
+		names, err := store.list()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(HaveLen(2))
+		data, err := os.ReadFile(dir + "/" + names[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"body":"Zmlyc3Q="`))
+	})
+
+	It("should refuse events beyond its size limit, counting files from a previous run", func() {
+		Expect(store.store(event(strings.Repeat("a", 400), time.Now()))).To(Succeed())
+
+		reopened, err := openDeadLetterStore(dir, 1024)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reopened.bytes).To(Equal(store.bytes))
+		Expect(reopened.store(event(strings.Repeat("b", 400), time.Now()))).To(MatchError(errDeadLetterStoreFull))
+	})
+
+	It("should expire only the events older than the max age", func() {
+		now := time.Now()
+		Expect(store.store(event("old", now.Add(-2*time.Hour)))).To(Succeed())
+		Expect(store.store(event("new", now.Add(-time.Minute)))).To(Succeed())
+		before := testutil.ToFloat64(deadLettersExpired)
+
+		expired, err := store.expire(time.Hour, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expired).To(Equal(1))
+
+		names, err := store.list()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(HaveLen(1))
+		data, err := os.ReadFile(dir + "/" + names[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"body":"bmV3"`))
+		Expect(store.bytes).To(Equal(int64(len(data))))
+		Expect(testutil.ToFloat64(deadLettersExpired)).To(Equal(before + 1))
+	})
+
+	It("should expire events from the background janitor", func() {
+		Expect(store.store(event("old", time.Now().Add(-time.Hour)))).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go runDeadLetterJanitor(ctx, store, 50*time.Millisecond, time.Minute)
+
+		Eventually(store.list).Should(BeEmpty())
+	})
+
+	Describe("replaying through forwardHandler", func() {
+		var (
+			downstream     *httptest.Server
+			downstreamCode int
+			received       chan *http.Request
+		)
+
+		BeforeEach(func() {
+			downstreamCode = http.StatusServiceUnavailable
+			received = make(chan *http.Request, 4)
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r
+				w.WriteHeader(downstreamCode)
+			}))
+			downstreamServiceURL = downstream.URL
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			proxyError = nil
+			bufferForwardBodies = true
+			forwardDedup = newDedupCache(time.Minute, 10)
+			deadLetters = store
+		})
+
+		AfterEach(func() {
+			deadLetters = nil
+			forwardDedup = nil
+			bufferForwardBodies = false
+			downstream.Close()
+		})
+
+		replayStatus := func() deadLetterReplayStatus {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "/admin/replay", nil)
+			request.Header.Set("Authorization", "Bearer admin")
+			newReplayHandler(context.Background(), "admin")(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			var status deadLetterReplayStatus
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(Succeed())
+			return status
+		}
+
+		finished := func() deadLetterReplayResult {
+			var status deadLetterReplayStatus
+			Eventually(func() bool {
+				status = replayStatus()
+				return status.Running
+			}).Should(BeFalse())
+			Expect(status.Finished).NotTo(BeNil())
+			Expect(status.Error).To(BeEmpty())
+			return status.deadLetterReplayResult
+		}
+
+		start := func(query string) int {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/admin/replay"+query, nil)
+			request.Header.Set("Authorization", "Bearer admin")
+			newReplayHandler(context.Background(), "admin")(recorder, request)
+			return recorder.Code
+		}
+
+		// replay starts a replay and waits for it to finish
+		replay := func(query string) (int, deadLetterReplayResult) {
+			code := start(query)
+			if code != http.StatusAccepted {
+				return code, deadLetterReplayResult{}
+			}
+			return code, finished()
+		}
+
+		It("should store a failed forward and delete it once a replay is delivered", func() {
+			request := httptest.NewRequest("POST", "/hook?installation=1", strings.NewReader(`{"action": "opened"}`))
+			request.Header.Set("X-GitHub-Delivery", "delivery-1")
+			forwardHandler(httptest.NewRecorder(), request)
+			Eventually(received).Should(Receive())
+
+			names, err := store.list()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(HaveLen(1))
+
+			// Still failing: the event is kept, once
+			code, result := replay("")
+			Expect(code).To(Equal(http.StatusAccepted))
+			Expect(result).To(Equal(deadLetterReplayResult{Failed: 1}))
+			Eventually(received).Should(Receive())
+			names, _ = store.list()
+			Expect(names).To(HaveLen(1))
+
+			downstreamCode = http.StatusOK
+			before := testutil.ToFloat64(deadLetterReplays.WithLabelValues("delivered"))
+			code, result = replay("")
+			Expect(code).To(Equal(http.StatusAccepted))
+			Expect(result).To(Equal(deadLetterReplayResult{Replayed: 1}))
+
+			var replayed *http.Request
+			Eventually(received).Should(Receive(&replayed))
+			Expect(replayed.URL.RequestURI()).To(Equal("/hook?installation=1"))
+			Expect(replayed.Header.Get("X-GitHub-Delivery")).To(Equal("delivery-1"))
+			names, _ = store.list()
+			Expect(names).To(BeEmpty())
+			Expect(store.bytes).To(BeZero())
+			Expect(testutil.ToFloat64(deadLetterReplays.WithLabelValues("delivered"))).To(Equal(before + 1))
+		})
+
+		It("should keep at most the requested number of replays in flight", func() {
+			var inFlight, maxInFlight atomic.Int32
+			downstream.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for {
+					seen := maxInFlight.Load()
+					if n <= seen || maxInFlight.CompareAndSwap(seen, n) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+			})
+			now := time.Now()
+			for i := 0; i < 6; i++ {
+				Expect(store.store(event("event", now.Add(time.Duration(i))))).To(Succeed())
+			}
+
+			code, result := replay("?concurrency=2")
+			Expect(code).To(Equal(http.StatusAccepted))
+			Expect(result).To(Equal(deadLetterReplayResult{Replayed: 6}))
+			Expect(maxInFlight.Load()).To(Equal(int32(2)))
+		})
+
+		It("should pace replays to the requested rate", func() {
+			now := time.Now()
+			for i := 0; i < 3; i++ {
+				Expect(store.store(event("event", now.Add(time.Duration(i))))).To(Succeed())
+			}
+			downstreamCode = http.StatusOK
+
+			start := time.Now()
+			code, result := replay("?concurrency=3&rate=10")
+			Expect(code).To(Equal(http.StatusAccepted))
+			Expect(result).To(Equal(deadLetterReplayResult{Replayed: 3}))
+			// The first starts at once, the next two 100ms apart
+			Expect(time.Since(start)).To(BeNumerically(">=", 190*time.Millisecond))
+		})
+
+		It("should not post failed replays to the dead-letter endpoint", func() {
+			var posted atomic.Int32
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				posted.Add(1)
+			}))
+			defer endpoint.Close()
+			deadLetterURL = endpoint.URL
+			deadLetterClient = http.DefaultClient
+			defer func() {
+				deadLetterURL = ""
+				deadLetterClient = nil
+			}()
+			Expect(store.store(event("event", time.Now()))).To(Succeed())
+
+			code, result := replay("")
+			Expect(code).To(Equal(http.StatusAccepted))
+			Expect(result).To(Equal(deadLetterReplayResult{Failed: 1}))
+			Consistently(posted.Load, "200ms").Should(BeZero())
+			names, _ := store.list()
+			Expect(names).To(HaveLen(1))
+		})
+
+		It("should keep replaying after the request that started it has timed out", func() {
+			downstream.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(300 * time.Millisecond)
+			})
+			Expect(store.store(event("event", time.Now()))).To(Succeed())
+			admin := httptest.NewUnstartedServer(newReplayHandler(context.Background(), "admin"))
+			admin.Config.WriteTimeout = 100 * time.Millisecond
+			admin.Start()
+			defer admin.Close()
+
+			request, _ := http.NewRequest("POST", admin.URL+"/admin/replay", nil)
+			request.Header.Set("Authorization", "Bearer admin")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+
+			Expect(finished()).To(Equal(deadLetterReplayResult{Replayed: 1}))
+			names, _ := store.list()
+			Expect(names).To(BeEmpty())
+		})
+
+		It("should refuse to start a second replay while one is running", func() {
+			release := make(chan struct{})
+			downstream.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-release
+			})
+			Expect(store.store(event("event", time.Now()))).To(Succeed())
+
+			Expect(start("")).To(Equal(http.StatusAccepted))
+			Expect(replayStatus().Running).To(BeTrue())
+			Expect(start("")).To(Equal(http.StatusConflict))
+
+			close(release)
+			Expect(finished()).To(Equal(deadLetterReplayResult{Replayed: 1}))
+		})
+
+		It("should reject invalid limits", func() {
+			code, _ := replay("?concurrency=0")
+			Expect(code).To(Equal(http.StatusBadRequest))
+			code, _ = replay("?rate=fast")
+			Expect(code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should require the admin token", func() {
+			recorder := httptest.NewRecorder()
+			newReplayHandler(context.Background(), "admin")(recorder, httptest.NewRequest("POST", "/admin/replay", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+})
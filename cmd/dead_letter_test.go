@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Dead Letter", func() {
+	It("should only dead-letter forwards that failed", func() {
+		Expect(deadLetterReason(http.StatusOK, nil)).To(BeEmpty())
+		Expect(deadLetterReason(http.StatusBadRequest, nil)).To(BeEmpty())
+		Expect(deadLetterReason(http.StatusNotFound, nil)).To(BeEmpty())
+		Expect(deadLetterReason(http.StatusServiceUnavailable, nil)).To(Equal("downstream returned status 503"))
+		Expect(deadLetterReason(http.StatusInternalServerError, nil)).To(Equal("downstream returned status 500"))
+		Expect(deadLetterReason(http.StatusRequestTimeout, nil)).To(Equal("downstream returned status 408"))
+		Expect(deadLetterReason(http.StatusTooManyRequests, nil)).To(Equal("downstream returned status 429"))
+		Expect(deadLetterReason(http.StatusBadGateway, io.ErrUnexpectedEOF)).To(Equal("proxy error: unexpected EOF"))
+	})
+
+	Describe("in forwardHandler", func() {
+		type letter struct {
+			body   string
+			header http.Header
+		}
+
+		var (
+			downstream     *httptest.Server
+			downstreamCode int
+			deadLetters    *httptest.Server
+			deadLetterCode int
+			received       []letter
+			mu             sync.Mutex
+		)
+
+		BeforeEach(func() {
+			received = nil
+			downstreamCode = http.StatusServiceUnavailable
+			deadLetterCode = http.StatusOK
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(downstreamCode)
+			}))
+			deadLetters = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				received = append(received, letter{string(body), r.Header.Clone()})
+				mu.Unlock()
+				w.WriteHeader(deadLetterCode)
+			}))
+			downstreamServiceURL = downstream.URL
+			deadLetterURL = deadLetters.URL
+			deadLetterClient = http.DefaultClient
+			bufferForwardBodies = true
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			proxyError = nil
+		})
+
+		AfterEach(func() {
+			deadLetterURL = ""
+			deadLetterClient = nil
+			bufferForwardBodies = false
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			downstream.Close()
+			deadLetters.Close()
+		})
+
+		forward := func() int {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "webhook"}`))
+			request.Header.Set("X-GitHub-Event", "push")
+			forwardHandler(recorder, request)
+			return recorder.Code
+		}
+
+		letters := func() []letter {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]letter(nil), received...)
+		}
+
+		It("should post the body, original headers and reason to DEAD_LETTER_URL", func() {
+			before := testutil.ToFloat64(deadLettered)
+
+			Expect(forward()).To(Equal(http.StatusServiceUnavailable))
+
+			Eventually(letters).Should(HaveLen(1))
+			Expect(letters()[0].body).To(Equal(`{"type": "webhook"}`))
+			Expect(letters()[0].header.Get("X-GitHub-Event")).To(Equal("push"))
+			Expect(letters()[0].header.Get(deadLetterReasonHeader)).To(Equal("downstream returned status 503"))
+			Eventually(func() float64 { return testutil.ToFloat64(deadLettered) }).Should(Equal(before + 1))
+		})
+
+		It("should report a downstream that can't be reached", func() {
+			before := testutil.ToFloat64(deadLettered)
+			downstream.Close()
+
+			Expect(forward()).To(Equal(http.StatusBadGateway))
+
+			Eventually(letters).Should(HaveLen(1))
+			Expect(letters()[0].header.Get(deadLetterReasonHeader)).To(HavePrefix("proxy error: "))
+			// Let the delivery finish before AfterEach resets the globals
+			Eventually(func() float64 { return testutil.ToFloat64(deadLettered) }).Should(Equal(before + 1))
+		})
+
+		It("should use the endpoint configured when the forward failed", func() {
+			before := testutil.ToFloat64(deadLettered)
+			Expect(forward()).To(Equal(http.StatusServiceUnavailable))
+			deadLetterURL = "http://127.0.0.1:1"
+
+			Eventually(letters).Should(HaveLen(1))
+			Eventually(func() float64 { return testutil.ToFloat64(deadLettered) }).Should(Equal(before + 1))
+		})
+
+		It("should leave delivered and rejected events alone", func() {
+			for _, code := range []int{http.StatusOK, http.StatusUnprocessableEntity} {
+				downstreamCode = code
+				Expect(forward()).To(Equal(code))
+			}
+
+			Consistently(letters, "200ms").Should(BeEmpty())
+		})
+
+		It("should log the body when the dead-letter endpoint fails too", func() {
+			deadLetterCode = http.StatusInternalServerError
+			var logs syncBuffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			forward()
+
+			Eventually(logs.String).Should(ContainSubstring(
+				`ERROR: Dead-letter delivery failed (dead-letter endpoint returned status 500), dropping event (downstream returned status 503): {"type": "webhook"}`))
+		})
+	})
+})
+
+// syncBuffer is a bytes.Buffer safe to log to from the dead-letter goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers the delivery IDs seen within the last ttl so redelivered
+// events can be dropped. It holds at most maxEntries IDs, forgetting the
+// oldest first, so a flood of unique IDs can't grow it without bound.
+type dedupCache struct {
+	ttl        time.Duration
+	maxEntries int
+	// Overridable clock for tests
+	now func() time.Time
+
+	mu sync.Mutex
+	// IDs oldest first; with a single ttl that is also expiry order
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+func newDedupCache(ttl time.Duration, maxEntries int) *dedupCache {
+	return &dedupCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// seen records key and reports whether it was already recorded within the ttl
+func (c *dedupCache) seen(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		if now.Sub(front.Value.(*dedupEntry).seenAt) < c.ttl {
+			break
+		}
+		c.remove(front)
+	}
+
+	if _, ok := c.entries[key]; ok {
+		return true
+	}
+	c.entries[key] = c.order.PushBack(&dedupEntry{key: key, seenAt: now})
+	if c.order.Len() > c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	return false
+}
+
+// forget drops key, so the next delivery with it is no longer a duplicate
+func (c *dedupCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *dedupCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*dedupEntry).key)
+}
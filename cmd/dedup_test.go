@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Delivery Dedup", func() {
+	var (
+		cache *dedupCache
+		now   time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+		cache = newDedupCache(time.Minute, 3)
+		cache.now = func() time.Time { return now }
+	})
+
+	It("should report an ID seen again within the window", func() {
+		Expect(cache.seen("a")).To(BeFalse())
+		Expect(cache.seen("b")).To(BeFalse())
+		Expect(cache.seen("a")).To(BeTrue())
+	})
+
+	It("should forget IDs once the window passes", func() {
+		Expect(cache.seen("a")).To(BeFalse())
+		now = now.Add(61 * time.Second)
+
+		Expect(cache.seen("a")).To(BeFalse())
+		Expect(cache.seen("a")).To(BeTrue())
+	})
+
+	It("should evict the oldest ID beyond its capacity", func() {
+		for i := 0; i < 4; i++ {
+			Expect(cache.seen(fmt.Sprintf("id-%d", i))).To(BeFalse())
+		}
+
+		Expect(cache.order.Len()).To(Equal(3))
+		Expect(cache.seen("id-3")).To(BeTrue())
+		Expect(cache.seen("id-0")).To(BeFalse())
+	})
+
+	Describe("in forwardHandler", func() {
+		var (
+			downstream *httptest.Server
+			hits       atomic.Int32
+		)
+
+		BeforeEach(func() {
+			hits.Store(0)
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+			}))
+			downstreamServiceURL = downstream.URL
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			proxyError = nil
+			forwardDedup = cache
+		})
+
+		AfterEach(func() {
+			forwardDedup = nil
+			downstream.Close()
+		})
+
+		forward := func(header, value string) int {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			if header != "" {
+				request.Header.Set(header, value)
+			}
+			forwardHandler(recorder, request)
+			return recorder.Code
+		}
+
+		It("should acknowledge a redelivery without forwarding it", func() {
+			before := testutil.ToFloat64(dedupedEvents)
+
+			Expect(forward("X-GitHub-Delivery", "72d3162e")).To(Equal(http.StatusOK))
+			Expect(forward("X-GitHub-Delivery", "72d3162e")).To(Equal(http.StatusOK))
+
+			Expect(hits.Load()).To(Equal(int32(1)))
+			Expect(testutil.ToFloat64(dedupedEvents)).To(Equal(before + 1))
+		})
+
+		It("should forward a redelivery when the first forward failed", func() {
+			downstreamCode := http.StatusBadGateway
+			downstream.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.WriteHeader(downstreamCode)
+			})
+
+			Expect(forward("X-GitHub-Delivery", "5f9a1c0e")).To(Equal(http.StatusBadGateway))
+			downstreamCode = http.StatusOK
+			Expect(forward("X-GitHub-Delivery", "5f9a1c0e")).To(Equal(http.StatusOK))
+			Expect(forward("X-GitHub-Delivery", "5f9a1c0e")).To(Equal(http.StatusOK))
+
+			Expect(hits.Load()).To(Equal(int32(2)))
+		})
+
+		It("should forward every event without a delivery ID", func() {
+			Expect(forward("", "")).To(Equal(http.StatusOK))
+			Expect(forward("", "")).To(Equal(http.StatusOK))
+
+			Expect(hits.Load()).To(Equal(int32(2)))
+		})
+
+		It("should never drop health checks", func() {
+			cache.seen("dedup-check")
+
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{}`))
+			request.Header.Set("X-Health-Check-ID", "dedup-check")
+			request.Header.Set("X-GitHub-Delivery", "dedup-check")
+			before := testutil.ToFloat64(dedupedEvents)
+			forwardHandler(httptest.NewRecorder(), request)
+
+			Expect(testutil.ToFloat64(dedupedEvents)).To(Equal(before))
+		})
+	})
+})
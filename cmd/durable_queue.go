@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The durable queue gives at-least-once delivery across sidecar restarts.
+// Events are appended to numbered segment files as length-prefixed,
+// CRC-checked records and fsynced before the relay is acknowledged. A single
+// consumer delivers them in order and persists its read cursor after each
+// success, so a restarted sidecar resumes from the first unacknowledged event.
+
+const (
+	durableQueueSegmentPrefix = "segment-"
+	durableQueueSegmentSuffix = ".log"
+	durableQueueCursorFile    = "cursor"
+	// Record header: 4-byte payload length followed by 4-byte CRC-32 of the payload
+	durableQueueHeaderSize = 8
+)
+
+var (
+	errDurableQueueFull   = errors.New("durable queue is full")
+	errCorruptQueueRecord = errors.New("corrupt durable queue record")
+	errDeliveryRejected   = errors.New("downstream rejected event")
+
+	// Delivery retry backoff bounds for the queue consumer
+	durableQueueRetryInitial = time.Second
+	durableQueueRetryMax     = 30 * time.Second
+
+	// Headers that only apply to the original connection and must not be replayed
+	hopHeaders = []string{
+		"Connection",
+		"Content-Length",
+		"Keep-Alive",
+		"Proxy-Connection",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+		"Upgrade",
+	}
+)
+
+// queuedEvent is a relayed request persisted for later delivery
+type queuedEvent struct {
+	Method string      `json:"method"`
+	URI    string      `json:"uri"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// queuePosition identifies a record boundary within the queue
+type queuePosition struct {
+	Segment uint64
+	Offset  int64
+}
+
+type durableQueue struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu           sync.Mutex
+	writer       *os.File
+	write        queuePosition
+	read         queuePosition
+	pending      int
+	pendingBytes int64
+	// Total size of the segment files on disk
+	diskBytes int64
+	// Signals the consumer that new records were appended
+	notify chan struct{}
+}
+
+// openDurableQueue opens (or creates) the queue in dir, recovering the read
+// cursor and the pending records left by a previous run
+func openDurableQueue(dir string, maxBytes, segmentBytes int64) (*durableQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create durable queue directory: %v", err)
+	}
+
+	q := &durableQueue{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		notify:       make(chan struct{}, 1),
+	}
+
+	segments, err := listQueueSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		segments = []uint64{1}
+	}
+	q.read = queuePosition{Segment: segments[0]}
+	if cursor, err := q.loadCursor(); err == nil && cursor.Segment >= segments[0] {
+		q.read = cursor
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Printf("WARNING: Ignoring unreadable durable queue cursor, replaying from segment %d: %v", segments[0], err)
+	}
+
+	last := segments[len(segments)-1]
+	for _, segment := range segments {
+		if segment < q.read.Segment {
+			continue
+		}
+		start := int64(0)
+		if segment == q.read.Segment {
+			start = q.read.Offset
+		}
+		end, count, size, err := scanQueueSegment(q.segmentPath(segment), start)
+		q.pending += count
+		q.pendingBytes += size
+		if err == nil {
+			continue
+		}
+		if segment != last {
+			log.Printf("WARNING: Durable queue segment %d is unreadable after offset %d, skipping the rest of it: %v", segment, end, err)
+			continue
+		}
+		// A torn write from a crash mid-append; drop the partial record
+		log.Printf("WARNING: Truncating durable queue segment %d at offset %d: %v", segment, end, err)
+		if err := os.Truncate(q.segmentPath(segment), end); err != nil {
+			return nil, fmt.Errorf("failed to truncate corrupt durable queue segment: %v", err)
+		}
+	}
+
+	writer, err := os.OpenFile(q.segmentPath(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open durable queue segment: %v", err)
+	}
+	info, err := writer.Stat()
+	if err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to stat durable queue segment: %v", err)
+	}
+	q.writer = writer
+	q.write = queuePosition{Segment: last, Offset: info.Size()}
+
+	for _, segment := range segments {
+		if info, err := os.Stat(q.segmentPath(segment)); err == nil {
+			q.diskBytes += info.Size()
+		}
+	}
+	q.updateGauges()
+
+	return q, nil
+}
+
+func (q *durableQueue) segmentPath(segment uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s%020d%s", durableQueueSegmentPrefix, segment, durableQueueSegmentSuffix))
+}
+
+// listQueueSegments returns the segment numbers present in dir, oldest first
+func listQueueSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list durable queue directory: %v", err)
+	}
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, durableQueueSegmentPrefix) || !strings.HasSuffix(name, durableQueueSegmentSuffix) {
+			continue
+		}
+		number := strings.TrimSuffix(strings.TrimPrefix(name, durableQueueSegmentPrefix), durableQueueSegmentSuffix)
+		if segment, err := strconv.ParseUint(number, 10, 64); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// scanQueueSegment validates the records of a segment from offset onwards and
+// returns the end of the last valid record along with the count and size of
+// the valid records
+func scanQueueSegment(path string, offset int64) (int64, int, int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return offset, 0, 0, nil
+	}
+	if err != nil {
+		return offset, 0, 0, err
+	}
+	defer file.Close()
+
+	count, size := 0, int64(0)
+	for {
+		_, recordSize, err := readQueueRecord(file, offset)
+		if errors.Is(err, io.EOF) {
+			return offset, count, size, nil
+		}
+		if err != nil {
+			return offset, count, size, err
+		}
+		offset += recordSize
+		count++
+		size += recordSize
+	}
+}
+
+// readQueueRecord reads the record at offset, returning its payload and its
+// total size on disk. io.EOF means there is no record at offset.
+func readQueueRecord(file *os.File, offset int64) ([]byte, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset >= info.Size() {
+		return nil, 0, io.EOF
+	}
+
+	header := make([]byte, durableQueueHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, 0, fmt.Errorf("%w: short header at offset %d", errCorruptQueueRecord, offset)
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	// Check the length against the file first so a garbage header can't
+	// trigger a huge allocation
+	if offset+durableQueueHeaderSize+length > info.Size() {
+		return nil, 0, fmt.Errorf("%w: truncated record at offset %d", errCorruptQueueRecord, offset)
+	}
+
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, offset+durableQueueHeaderSize); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errCorruptQueueRecord, err)
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch at offset %d", errCorruptQueueRecord, offset)
+	}
+	return payload, durableQueueHeaderSize + length, nil
+}
+
+// enqueue durably appends an event, returning errDurableQueueFull when the
+// pending events would exceed the configured size
+func (q *durableQueue) enqueue(event queuedEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+	record := make([]byte, durableQueueHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[durableQueueHeaderSize:], payload)
+	size := int64(len(record))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pendingBytes+size > q.maxBytes {
+		return errDurableQueueFull
+	}
+	if q.write.Offset > 0 && q.write.Offset+size > q.segmentBytes {
+		if err := q.rollSegment(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.writer.Write(record); err != nil {
+		// Don't leave a partial record behind for the consumer to trip on
+		_ = q.writer.Truncate(q.write.Offset)
+		return fmt.Errorf("failed to append to durable queue: %v", err)
+	}
+	if err := q.writer.Sync(); err != nil {
+		return fmt.Errorf("failed to sync durable queue: %v", err)
+	}
+	q.write.Offset += size
+	q.pending++
+	q.pendingBytes += size
+	q.diskBytes += size
+	q.updateGauges()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rollSegment starts a new segment file for subsequent appends
+func (q *durableQueue) rollSegment() error {
+	if err := q.writer.Close(); err != nil {
+		return fmt.Errorf("failed to close durable queue segment: %v", err)
+	}
+	next := queuePosition{Segment: q.write.Segment + 1}
+	writer, err := os.OpenFile(q.segmentPath(next.Segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create durable queue segment: %v", err)
+	}
+	q.writer = writer
+	q.write = next
+	return nil
+}
+
+// next returns the oldest unacknowledged event and the position just past
+// it, or a nil event when the consumer has caught up
+func (q *durableQueue) next() (*queuedEvent, queuePosition, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		payload, size, err := q.readAt(q.read)
+		switch {
+		case err == nil:
+			var event queuedEvent
+			if err := json.Unmarshal(payload, &event); err != nil {
+				log.Printf("WARNING: Dropping undecodable durable queue record: %v", err)
+				q.advance(queuePosition{Segment: q.read.Segment, Offset: q.read.Offset + size})
+				continue
+			}
+			return &event, queuePosition{Segment: q.read.Segment, Offset: q.read.Offset + size}, nil
+		case errors.Is(err, io.EOF) && q.read.Segment >= q.write.Segment:
+			return nil, queuePosition{}, nil
+		case errors.Is(err, io.EOF):
+			q.read = queuePosition{Segment: q.read.Segment + 1}
+		case q.read.Segment >= q.write.Segment:
+			return nil, queuePosition{}, err
+		default:
+			log.Printf("WARNING: Skipping the rest of durable queue segment %d: %v", q.read.Segment, err)
+			q.read = queuePosition{Segment: q.read.Segment + 1}
+		}
+	}
+}
+
+func (q *durableQueue) readAt(position queuePosition) ([]byte, int64, error) {
+	file, err := os.Open(q.segmentPath(position.Segment))
+	if os.IsNotExist(err) {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	return readQueueRecord(file, position.Offset)
+}
+
+// ack marks the event ending at end as delivered and persists the cursor
+func (q *durableQueue) ack(end queuePosition) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.advance(end)
+	return q.saveCursor()
+}
+
+// advance moves the read cursor past the record starting at the current cursor
+func (q *durableQueue) advance(end queuePosition) {
+	q.pending--
+	q.pendingBytes -= end.Offset - q.read.Offset
+	q.read = end
+	q.updateGauges()
+}
+
+func (q *durableQueue) updateGauges() {
+	durableQueueDepth.Set(float64(q.pending))
+	durableQueueBytes.Set(float64(q.diskBytes))
+}
+
+// compact removes segment files the consumer has fully drained. It holds the
+// queue lock, so appends and reads never observe a half-removed segment.
+func (q *durableQueue) compact() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	segments, err := listQueueSegments(q.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, segment := range segments {
+		// The read segment may still hold pending records and the write
+		// segment is still being appended to
+		if segment >= q.read.Segment || segment >= q.write.Segment {
+			break
+		}
+		path := q.segmentPath(segment)
+		info, err := os.Stat(path)
+		if err != nil {
+			return removed, err
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, fmt.Errorf("failed to remove drained segment %d: %v", segment, err)
+		}
+		q.diskBytes -= info.Size()
+		removed++
+	}
+	q.updateGauges()
+	return removed, nil
+}
+
+// runDurableQueueCompactor periodically removes drained segment files
+func runDurableQueueCompactor(ctx context.Context, q *durableQueue, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed, err := q.compact(); err != nil {
+				log.Printf("ERROR: Durable queue compaction failed: %v", err)
+			} else if removed > 0 {
+				log.Printf("Compacted %d drained durable queue segments", removed)
+			}
+		}
+	}
+}
+
+func (q *durableQueue) loadCursor() (queuePosition, error) {
+	var cursor queuePosition
+	content, err := os.ReadFile(filepath.Join(q.dir, durableQueueCursorFile))
+	if err != nil {
+		return cursor, err
+	}
+	if _, err := fmt.Sscanf(string(content), "%d %d\n", &cursor.Segment, &cursor.Offset); err != nil {
+		return cursor, fmt.Errorf("malformed cursor: %v", err)
+	}
+	return cursor, nil
+}
+
+// saveCursor atomically records the read position
+func (q *durableQueue) saveCursor() error {
+	cursorPath := filepath.Join(q.dir, durableQueueCursorFile)
+	tmpPath := cursorPath + ".tmp"
+	content := fmt.Sprintf("%d %d\n", q.read.Segment, q.read.Offset)
+	if err := os.WriteFile(tmpPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write durable queue cursor: %v", err)
+	}
+	if err := os.Rename(tmpPath, cursorPath); err != nil {
+		return fmt.Errorf("failed to rename durable queue cursor: %v", err)
+	}
+	return nil
+}
+
+// depth returns the number of events awaiting delivery
+func (q *durableQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func (q *durableQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.writer.Close()
+}
+
+// runDurableQueueConsumer delivers queued events in order until ctx is done,
+// retrying failed deliveries with exponential backoff. Events the downstream
+// rejects outright (errDeliveryRejected) are dropped rather than retried.
+func runDurableQueueConsumer(ctx context.Context, q *durableQueue, deliver func(context.Context, *queuedEvent) error) {
+	backoff := durableQueueRetryInitial
+	wait := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+			backoff = min(backoff*2, durableQueueRetryMax)
+			return true
+		}
+	}
+
+	for {
+		event, end, err := q.next()
+		if err != nil {
+			log.Printf("ERROR: Failed to read durable queue: %v", err)
+			if !wait() {
+				return
+			}
+			continue
+		}
+		if event == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+			}
+			continue
+		}
+
+		if err := deliver(ctx, event); err != nil {
+			if !errors.Is(err, errDeliveryRejected) {
+				log.Printf("Durable queue delivery failed, retrying in %s: %v", backoff, err)
+				if !wait() {
+					return
+				}
+				continue
+			}
+			log.Printf("WARNING: Dropping queued event: %v", err)
+		}
+		backoff = durableQueueRetryInitial
+
+		if err := q.ack(end); err != nil {
+			log.Printf("ERROR: Failed to acknowledge durable queue event: %v", err)
+		}
+	}
+}
+
+// deliverQueuedEvent sends a queued event to the downstream service, counting
+// successes under the target label. Client errors other than 408 and 429 are
+// reported as errDeliveryRejected since retrying the same request can't succeed.
+func deliverQueuedEvent(ctx context.Context, client *http.Client, downstream *url.URL, target string, event *queuedEvent) error {
+	ref, err := url.ParseRequestURI(event.URI)
+	if err != nil {
+		return fmt.Errorf("%w: invalid request URI %q: %v", errDeliveryRejected, event.URI, err)
+	}
+	rewriteForwardPath(ref)
+	// Join like the reverse proxy does; url.JoinPath would clean dot segments
+	// and decode escaped slashes in the event's path
+	eventURL := *downstream
+	eventURL.Path, eventURL.RawPath = joinURLPath(downstream, ref)
+	switch {
+	case downstream.RawQuery == "":
+		eventURL.RawQuery = ref.RawQuery
+	case ref.RawQuery != "":
+		eventURL.RawQuery = downstream.RawQuery + "&" + ref.RawQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, event.Method, eventURL.String(), bytes.NewReader(event.Body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDeliveryRejected, err)
+	}
+	req.Header = event.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	applyExtraHeaders(req.Header)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	drainBounded(resp.Body, healthCheckMaxResponseBytes)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 400:
+		forwardAttempts.WithLabelValues(target).Inc()
+		if resp.StatusCode < 300 {
+			forwardDeliveries.WithLabelValues(target).Inc()
+		}
+		return nil
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: status %d", errDeliveryRejected, resp.StatusCode)
+	default:
+		return fmt.Errorf("downstream returned status %d", resp.StatusCode)
+	}
+}
+
+// enqueueForDelivery persists the request in the durable queue and
+// acknowledges it to the relay with 202 Accepted
+func enqueueForDelivery(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			rejectOversizeRequest(w)
+			return
+		}
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	header := r.Header.Clone()
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+
+	err = eventQueue.enqueue(queuedEvent{
+		Method: r.Method,
+		URI:    r.URL.RequestURI(),
+		Header: header,
+		Body:   body,
+	})
+	if errors.Is(err, errDurableQueueFull) {
+		http.Error(w, "durable queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to enqueue event: %v", err)
+		http.Error(w, "failed to persist event", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Durable Queue", func() {
+	var (
+		queueDir string
+		queue    *durableQueue
+	)
+
+	event := func(n int) queuedEvent {
+		return queuedEvent{
+			Method: "POST",
+			URI:    "/webhook?n=" + fmt.Sprint(n),
+			Header: http.Header{"Content-Type": {"application/json"}},
+			Body:   []byte(fmt.Sprintf(`{"n": %d}`, n)),
+		}
+	}
+
+	open := func() *durableQueue {
+		q, err := openDurableQueue(queueDir, 1<<20, 1<<20)
+		Expect(err).NotTo(HaveOccurred())
+		return q
+	}
+
+	BeforeEach(func() {
+		var err error
+		queueDir, err = os.MkdirTemp("", "smee-queue-*")
+		Expect(err).NotTo(HaveOccurred())
+		queue = open()
+
+		durableQueueRetryInitial = 10 * time.Millisecond
+		durableQueueRetryMax = 50 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		queue.close()
+		os.RemoveAll(queueDir)
+		durableQueueRetryInitial = time.Second
+		durableQueueRetryMax = 30 * time.Second
+	})
+
+	Describe("enqueue and drain", func() {
+		It("should deliver queued events to the downstream in order", func() {
+			var (
+				received []string
+				mu       sync.Mutex
+			)
+			downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				received = append(received, r.URL.RequestURI()+" "+string(body))
+				mu.Unlock()
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer downstream.Close()
+			downstreamURL, _ := url.Parse(downstream.URL)
+
+			for i := 1; i <= 3; i++ {
+				Expect(queue.enqueue(event(i))).To(Succeed())
+			}
+			Expect(queue.depth()).To(Equal(3))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go runDurableQueueConsumer(ctx, queue, func(ctx context.Context, e *queuedEvent) error {
+				return deliverQueuedEvent(ctx, http.DefaultClient, downstreamURL, downstreamURL.Host, e)
+			})
+
+			Eventually(queue.depth, time.Second, 10*time.Millisecond).Should(BeZero())
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(received).To(Equal([]string{
+				`/webhook?n=1 {"n": 1}`,
+				`/webhook?n=2 {"n": 2}`,
+				`/webhook?n=3 {"n": 3}`,
+			}))
+		})
+
+		It("should deliver to the same path as a synchronous forward", func() {
+			received := make(chan string, 1)
+			downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r.URL.RequestURI()
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer downstream.Close()
+			downstreamURL, _ := url.Parse(downstream.URL + "/api?tenant=a")
+
+			queued := queuedEvent{Method: "POST", URI: "/repos/a%2Fb/../hooks?source=app"}
+			Expect(deliverQueuedEvent(context.Background(), http.DefaultClient, downstreamURL, downstreamURL.Host, &queued)).To(Succeed())
+			Expect(<-received).To(Equal("/api/repos/a%2Fb/../hooks?tenant=a&source=app"))
+		})
+
+		It("should retry an event until the downstream accepts it", func() {
+			var attempts int
+			var mu sync.Mutex
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			Expect(queue.enqueue(event(1))).To(Succeed())
+			go runDurableQueueConsumer(ctx, queue, func(ctx context.Context, e *queuedEvent) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if attempts < 3 {
+					return fmt.Errorf("downstream returned status 503")
+				}
+				return nil
+			})
+
+			Eventually(queue.depth, time.Second, 10*time.Millisecond).Should(BeZero())
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(attempts).To(Equal(3))
+		})
+
+		It("should reject events once the queue is full", func() {
+			queue.close()
+			var err error
+			queue, err = openDurableQueue(queueDir, 200, 1<<20)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(queue.enqueue(event(1))).To(Succeed())
+			Expect(queue.enqueue(event(2))).To(MatchError(errDurableQueueFull))
+		})
+
+		It("should roll over to new segments", func() {
+			queue.close()
+			var err error
+			queue, err = openDurableQueue(queueDir, 1<<20, 64)
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 1; i <= 3; i++ {
+				Expect(queue.enqueue(event(i))).To(Succeed())
+			}
+			segments, err := listQueueSegments(queueDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(segments).To(Equal([]uint64{1, 2, 3}))
+
+			for i := 1; i <= 3; i++ {
+				next, end, err := queue.next()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(next.Body).To(Equal(event(i).Body))
+				Expect(queue.ack(end)).To(Succeed())
+			}
+		})
+	})
+
+	Describe("restart recovery", func() {
+		It("should resume with the first unacknowledged event", func() {
+			for i := 1; i <= 3; i++ {
+				Expect(queue.enqueue(event(i))).To(Succeed())
+			}
+			first, end, err := queue.next()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(first.Body).To(Equal(event(1).Body))
+			Expect(queue.ack(end)).To(Succeed())
+
+			// Simulate a restart
+			queue.close()
+			queue = open()
+
+			Expect(queue.depth()).To(Equal(2))
+			next, _, err := queue.next()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(next.Body).To(Equal(event(2).Body))
+			Expect(next.Header.Get("Content-Type")).To(Equal("application/json"))
+		})
+
+		It("should drop a torn record left by a crash mid-append", func() {
+			Expect(queue.enqueue(event(1))).To(Succeed())
+			queue.close()
+
+			segment, err := os.OpenFile(queue.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0644)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = segment.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+			Expect(err).NotTo(HaveOccurred())
+			segment.Close()
+
+			queue = open()
+			Expect(queue.depth()).To(Equal(1))
+			Expect(queue.enqueue(event(2))).To(Succeed())
+
+			for i := 1; i <= 2; i++ {
+				next, end, err := queue.next()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(next.Body).To(Equal(event(i).Body))
+				Expect(queue.ack(end)).To(Succeed())
+			}
+		})
+	})
+
+	Describe("compaction", func() {
+		BeforeEach(func() {
+			queue.close()
+			var err error
+			// Tiny segments so every event lands in its own segment
+			queue, err = openDurableQueue(queueDir, 1<<20, 64)
+			Expect(err).NotTo(HaveOccurred())
+			for i := 1; i <= 4; i++ {
+				Expect(queue.enqueue(event(i))).To(Succeed())
+			}
+		})
+
+		It("should remove drained segments and keep pending ones", func() {
+			for i := 1; i <= 2; i++ {
+				_, end, err := queue.next()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(queue.ack(end)).To(Succeed())
+			}
+			Expect(testutil.ToFloat64(durableQueueDepth)).To(Equal(2.0))
+			bytesBefore := testutil.ToFloat64(durableQueueBytes)
+
+			// The cursor moves into the third segment once the consumer reads it
+			next, _, err := queue.next()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(next.Body).To(Equal(event(3).Body))
+
+			removed, err := queue.compact()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(Equal(2))
+
+			segments, err := listQueueSegments(queueDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(segments).To(Equal([]uint64{3, 4}))
+			Expect(testutil.ToFloat64(durableQueueDepth)).To(Equal(2.0))
+			Expect(testutil.ToFloat64(durableQueueBytes)).To(BeNumerically("<", bytesBefore))
+
+			// Compaction survives a restart
+			queue.close()
+			queue = open()
+			Expect(queue.depth()).To(Equal(2))
+		})
+
+		It("should stay consistent under concurrent enqueue and drain", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go runDurableQueueConsumer(ctx, queue, func(context.Context, *queuedEvent) error { return nil })
+			go runDurableQueueCompactor(ctx, queue, 5*time.Millisecond)
+
+			for i := 5; i <= 50; i++ {
+				Expect(queue.enqueue(event(i))).To(Succeed())
+			}
+
+			Eventually(queue.depth, 2*time.Second, 10*time.Millisecond).Should(BeZero())
+			Eventually(func() []uint64 {
+				segments, _ := listQueueSegments(queueDir)
+				return segments
+			}, 2*time.Second, 10*time.Millisecond).Should(HaveLen(1))
+			Expect(testutil.ToFloat64(durableQueueDepth)).To(BeZero())
+		})
+	})
+
+	Describe("forwardHandler with a durable queue", func() {
+		BeforeEach(func() {
+			eventQueue = queue
+		})
+
+		AfterEach(func() {
+			eventQueue = nil
+		})
+
+		It("should persist the event and acknowledge it with 202", func() {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/webhook", bytes.NewBufferString(`{"action": "opened"}`))
+			request.Header.Set("X-GitHub-Event", "pull_request")
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			next, _, err := queue.next()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(next.URI).To(Equal("/webhook"))
+			Expect(string(next.Body)).To(Equal(`{"action": "opened"}`))
+			Expect(next.Header.Get("X-GitHub-Event")).To(Equal("pull_request"))
+		})
+	})
+})
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// forwardSemaphore bounds the number of forwards in flight. When all slots
+// are taken a forward either fails right away or, with queueing enabled,
+// waits up to queueTimeout for one to free up.
+type forwardSemaphore struct {
+	slots        chan struct{}
+	queue        bool
+	queueTimeout time.Duration
+}
+
+func newForwardSemaphore(limit int, queue bool, queueTimeout time.Duration) *forwardSemaphore {
+	return &forwardSemaphore{
+		slots:        make(chan struct{}, limit),
+		queue:        queue,
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire takes a slot, reporting false when none could be had. Every
+// successful acquire must be followed by a call to release.
+func (s *forwardSemaphore) acquire(ctx context.Context) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if !s.queue {
+		return false
+	}
+
+	forwardQueueDepth.Inc()
+	defer forwardQueueDepth.Dec()
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *forwardSemaphore) release() {
+	<-s.slots
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Forward Concurrency", func() {
+	It("should reject once every slot is taken without queueing", func() {
+		slots := newForwardSemaphore(1, false, time.Minute)
+
+		Expect(slots.acquire(context.Background())).To(BeTrue())
+		Expect(slots.acquire(context.Background())).To(BeFalse())
+
+		slots.release()
+		Expect(slots.acquire(context.Background())).To(BeTrue())
+	})
+
+	It("should queue for a slot until one frees up", func() {
+		slots := newForwardSemaphore(1, true, time.Minute)
+		Expect(slots.acquire(context.Background())).To(BeTrue())
+
+		acquired := make(chan bool)
+		go func() { acquired <- slots.acquire(context.Background()) }()
+		Eventually(func() float64 { return testutil.ToFloat64(forwardQueueDepth) }).Should(Equal(1.0))
+
+		slots.release()
+		Eventually(acquired).Should(Receive(BeTrue()))
+		Expect(testutil.ToFloat64(forwardQueueDepth)).To(BeZero())
+	})
+
+	It("should give up queueing after the timeout", func() {
+		slots := newForwardSemaphore(1, true, 20*time.Millisecond)
+		Expect(slots.acquire(context.Background())).To(BeTrue())
+
+		Expect(slots.acquire(context.Background())).To(BeFalse())
+		Expect(testutil.ToFloat64(forwardQueueDepth)).To(BeZero())
+	})
+
+	Describe("in forwardHandler", func() {
+		var (
+			downstream *httptest.Server
+			release    chan struct{}
+			arrived    chan struct{}
+		)
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			arrived = make(chan struct{}, 10)
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				arrived <- struct{}{}
+				<-release
+			}))
+			downstreamServiceURL = downstream.URL
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			proxyError = nil
+		})
+
+		AfterEach(func() {
+			forwardSlots = nil
+			downstream.Close()
+		})
+
+		forward := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
+			return recorder
+		}
+
+		// Occupies the only slot with a forward the downstream holds open
+		occupySlot := func() chan *httptest.ResponseRecorder {
+			first := make(chan *httptest.ResponseRecorder, 1)
+			go func() { first <- forward() }()
+			Eventually(arrived).Should(Receive())
+			return first
+		}
+
+		It("should answer 503 with Retry-After when saturated in reject mode", func() {
+			forwardSlots = newForwardSemaphore(1, false, time.Minute)
+			first := occupySlot()
+
+			recorder := forward()
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(recorder.Header().Get("Retry-After")).To(Equal("1"))
+
+			close(release)
+			Expect((<-first).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should hold a forward until a slot frees up in queue mode", func() {
+			forwardSlots = newForwardSemaphore(1, true, time.Minute)
+			first := occupySlot()
+
+			second := make(chan *httptest.ResponseRecorder, 1)
+			go func() { second <- forward() }()
+			Consistently(arrived, "100ms").ShouldNot(Receive())
+
+			close(release)
+			Expect((<-first).Code).To(Equal(http.StatusOK))
+			Expect((<-second).Code).To(Equal(http.StatusOK))
+		})
+	})
+})
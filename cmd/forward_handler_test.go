@@ -2,15 +2,24 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -18,6 +27,13 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/time/rate"
 )
 
 var _ = Describe("forwardHandler", func() {
@@ -28,6 +44,11 @@ var _ = Describe("forwardHandler", func() {
 		requestMutex       sync.Mutex
 	)
 
+	// Events relayed to the mock downstream
+	relayed := func() float64 {
+		return testutil.ToFloat64(forwardAttempts.WithLabelValues(mockDownstream.Listener.Addr().String()))
+	}
+
 	BeforeEach(func() {
 		recorder = httptest.NewRecorder()
 		downstreamRequests = nil
@@ -51,18 +72,13 @@ var _ = Describe("forwardHandler", func() {
 
 		// Reset HTTP clients for each test
 		healthCheckClient = nil
-		proxyInstance = nil
+		proxyReplicas = nil
 		healthCheckOnce = sync.Once{}
 		proxyOnce = sync.Once{}
 		proxyError = nil
 
-		// Re-create the counter for each test
-		forwardAttempts = prometheus.NewCounter(
-			prometheus.CounterOpts{
-				Name: "smee_events_relayed_total",
-				Help: "Total number of regular events relayed by the sidecar.",
-			},
-		)
+		// Start each test from a zeroed counter
+		resetMetrics()
 	})
 
 	AfterEach(func() {
@@ -89,7 +105,7 @@ var _ = Describe("forwardHandler", func() {
 			requestMutex.Unlock()
 
 			// Verify the counter was incremented
-			Expect(testutil.ToFloat64(forwardAttempts)).To(Equal(1.0))
+			Expect(relayed()).To(Equal(1.0))
 		})
 
 		It("should NOT set Connection: close header for regular requests", func() {
@@ -113,7 +129,7 @@ var _ = Describe("forwardHandler", func() {
 			requestMutex.Unlock()
 
 			// Verify the counter was incremented
-			Expect(testutil.ToFloat64(forwardAttempts)).To(Equal(1.0))
+			Expect(relayed()).To(Equal(1.0))
 		})
 
 		It("should forward non-JSON events to downstream service", func() {
@@ -133,7 +149,7 @@ var _ = Describe("forwardHandler", func() {
 			requestMutex.Unlock()
 
 			// Verify the counter was incremented
-			Expect(testutil.ToFloat64(forwardAttempts)).To(Equal(1.0))
+			Expect(relayed()).To(Equal(1.0))
 		})
 
 		It("should forward JSON events that are not health checks", func() {
@@ -153,7 +169,7 @@ var _ = Describe("forwardHandler", func() {
 			requestMutex.Unlock()
 
 			// Verify the counter was incremented
-			Expect(testutil.ToFloat64(forwardAttempts)).To(Equal(1.0))
+			Expect(relayed()).To(Equal(1.0))
 		})
 	})
 
@@ -197,11 +213,13 @@ var _ = Describe("forwardHandler", func() {
 			requestMutex.Unlock()
 
 			// Verify the counter was NOT incremented (health checks don't count as regular events)
-			Expect(testutil.ToFloat64(forwardAttempts)).To(Equal(0.0))
+			Expect(relayed()).To(Equal(0.0))
 		})
 
 		It("should handle health check events when no channel is waiting", func() {
 			testID := "unknown-health-check-456"
+			orphansBefore := testutil.ToFloat64(orphanHealthChecks)
+			lateBefore := testutil.ToFloat64(lateHealthCheckArrivals)
 
 			// Use header-based approach
 			payload := fmt.Sprintf(`{"type": "health-check", "id": "%s"}`, testID)
@@ -221,7 +239,28 @@ var _ = Describe("forwardHandler", func() {
 			requestMutex.Unlock()
 
 			// Verify the counter was NOT incremented
-			Expect(testutil.ToFloat64(forwardAttempts)).To(Equal(0.0))
+			Expect(relayed()).To(Equal(0.0))
+
+			// No check ever registered the ID, so it is an orphan rather than late
+			Expect(testutil.ToFloat64(orphanHealthChecks)).To(Equal(orphansBefore + 1))
+			Expect(testutil.ToFloat64(lateHealthCheckArrivals)).To(Equal(lateBefore))
+		})
+
+		It("should answer health check events with the configured response", func() {
+			healthCheckResponseStatus = http.StatusAccepted
+			healthCheckResponseBody = "ok"
+			defer func() {
+				healthCheckResponseStatus = http.StatusOK
+				healthCheckResponseBody = ""
+			}()
+
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "configured-response-check")
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			Expect(recorder.Body.String()).To(Equal("ok"))
+			Expect(downstreamRequests).To(BeEmpty())
 		})
 
 		It("should forward health check events without header as regular events", func() {
@@ -244,7 +283,7 @@ var _ = Describe("forwardHandler", func() {
 			requestMutex.Unlock()
 
 			// Verify the counter was incremented
-			Expect(testutil.ToFloat64(forwardAttempts)).To(Equal(1.0))
+			Expect(relayed()).To(Equal(1.0))
 		})
 
 		It("should forward malformed JSON as regular events", func() {
@@ -266,11 +305,86 @@ var _ = Describe("forwardHandler", func() {
 			requestMutex.Unlock()
 
 			// Verify the counter was incremented
-			Expect(testutil.ToFloat64(forwardAttempts)).To(Equal(1.0))
+			Expect(relayed()).To(Equal(1.0))
+		})
+
+		Context("with HEALTH_CHECK_BODY_FALLBACK", func() {
+			var (
+				bodyDownstream *httptest.Server
+				received       chan string
+			)
+
+			BeforeEach(func() {
+				healthCheckBodyFallback = true
+				received = make(chan string, 1)
+				bodyDownstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ := io.ReadAll(r.Body)
+					received <- string(body)
+				}))
+				downstreamServiceURL = bodyDownstream.URL
+			})
+
+			AfterEach(func() {
+				healthCheckBodyFallback = false
+				bodyDownstream.Close()
+			})
+
+			It("should intercept a probe identified only by its body", func() {
+				resultChan := make(chan bool, 1)
+				mutex.Lock()
+				healthChecks["headerless-check"] = resultChan
+				mutex.Unlock()
+
+				request := httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "health-check", "id": "headerless-check"}`))
+				forwardHandler(recorder, request)
+
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				Expect(resultChan).To(Receive(BeTrue()))
+				Expect(received).NotTo(Receive())
+			})
+
+			It("should forward other bodies intact", func() {
+				payloads := []string{
+					`{"type": "webhook", "id": "not-a-probe"}`,
+					`{"type": "health-check", "id": "test-123"`,
+					`{"type": "health-check", "padding": "` + strings.Repeat("a", healthCheckPeekLimit) + `"}`,
+				}
+				for _, payload := range payloads {
+					// Unknown length, so the peek can't skip large bodies up front
+					request := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(payload)))
+					forwardHandler(httptest.NewRecorder(), request)
+					Eventually(received).Should(Receive(Equal(payload)))
+				}
+			})
 		})
 	})
 
 	Describe("error handling", func() {
+		It("should answer a refused connection with a JSON 502 and count it", func() {
+			before := testutil.ToFloat64(proxyErrors.WithLabelValues("connrefused"))
+			mockDownstream.Close()
+
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusBadGateway))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+			var response proxyErrorResponse
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+			Expect(response.Error).To(Equal("forward to downstream failed"))
+			Expect(response.CorrelationID).To(Equal(recorder.Header().Get("X-Smee-Correlation-ID")))
+			Expect(response.CorrelationID).NotTo(BeEmpty())
+			Expect(testutil.ToFloat64(proxyErrors.WithLabelValues("connrefused"))).To(Equal(before + 1))
+		})
+
+		DescribeTable("should classify forward errors",
+			func(err error, class string) {
+				Expect(errorClass(err)).To(Equal(class))
+			},
+			Entry("deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), "timeout"),
+			Entry("refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connrefused"),
+			Entry("anything else", io.ErrUnexpectedEOF, "other"),
+		)
+
 		It("should handle proxy creation errors", func() {
 			// Set an invalid downstream URL
 			originalURL := downstreamServiceURL
@@ -291,173 +405,1603 @@ var _ = Describe("forwardHandler", func() {
 		})
 	})
 
-	Describe("concurrent access", func() {
-		It("should handle concurrent health check requests safely", func() {
-			const numRequests = 10
-			testIDs := make([]string, numRequests)
-			resultChans := make([]chan bool, numRequests)
+	Describe("last event received timestamp", func() {
+		BeforeEach(func() {
+			lastEventReceived.Set(0)
+		})
 
-			// Set up multiple health check channels
-			mutex.Lock()
-			for i := 0; i < numRequests; i++ {
-				testIDs[i] = fmt.Sprintf("concurrent-test-%d", i)
-				resultChans[i] = make(chan bool, 1)
-				healthChecks[testIDs[i]] = resultChans[i]
-			}
-			mutex.Unlock()
+		It("should be set by regular events", func() {
+			before := float64(time.Now().Unix())
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
 
-			// Launch concurrent requests
-			done := make(chan bool, numRequests)
-			for i := 0; i < numRequests; i++ {
-				go func(index int) {
-					defer func() { done <- true }()
+			Expect(testutil.ToFloat64(lastEventReceived)).To(BeNumerically(">=", before))
+		})
 
-					// Use BOTH headers and JSON body approach for optimal performance + compatibility
-					payload := fmt.Sprintf(`{"type": "health-check", "id": "%s"}`, testIDs[index])
-					request, err := http.NewRequest("POST", "/", bytes.NewBufferString(payload))
-					Expect(err).NotTo(HaveOccurred())
-					request.Header.Set("X-Health-Check-ID", testIDs[index])
-					request.Header.Set("Content-Type", "application/json")
+		It("should not be touched by health check events", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "unknown-check")
+			forwardHandler(recorder, request)
 
-					recorder := httptest.NewRecorder()
-					forwardHandler(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(testutil.ToFloat64(lastEventReceived)).To(BeZero())
+		})
+	})
 
-					Expect(recorder.Code).To(Equal(http.StatusOK))
-				}(i)
-			}
+	Describe("content type allow-list", func() {
+		BeforeEach(func() {
+			forwardAllowedContentTypes = map[string]bool{"application/json": true}
+		})
 
-			// Wait for all requests to complete
-			for i := 0; i < numRequests; i++ {
-				<-done
-			}
+		AfterEach(func() {
+			forwardAllowedContentTypes = nil
+		})
 
-			// Verify all channels were signaled
-			for i := 0; i < numRequests; i++ {
-				Eventually(resultChans[i]).Should(Receive(Equal(true)))
-			}
+		It("should forward allowed types regardless of parameters and case", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			request.Header.Set("Content-Type", "Application/JSON; charset=utf-8")
+			forwardHandler(recorder, request)
 
-			// Verify all health checks are still in the map (cleanup happens in performHealthCheck, not forwardHandler)
-			mutex.Lock()
-			Expect(len(healthChecks)).To(Equal(numRequests))
-			// Clean up for the test
-			for _, testID := range testIDs {
-				delete(healthChecks, testID)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(downstreamRequests).To(HaveLen(1))
+		})
+
+		DescribeTable("should reject other types with 415",
+			func(contentType string) {
+				before := testutil.ToFloat64(contentTypeRejections)
+				request := httptest.NewRequest("POST", "/", bytes.NewBufferString("payload=1"))
+				if contentType != "" {
+					request.Header.Set("Content-Type", contentType)
+				}
+				forwardHandler(recorder, request)
+
+				Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+				Expect(downstreamRequests).To(BeEmpty())
+				Expect(testutil.ToFloat64(contentTypeRejections)).To(Equal(before + 1))
+			},
+			Entry("form encoded", "application/x-www-form-urlencoded"),
+			Entry("plain text", "text/plain"),
+			Entry("missing", ""),
+		)
+
+		It("should let health checks through", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString("probe"))
+			request.Header.Set("Content-Type", "text/plain")
+			request.Header.Set("X-Health-Check-ID", "unregistered-check")
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("events by type", func() {
+		var originalLabels map[string]bool
+
+		BeforeEach(func() {
+			originalLabels = eventTypeLabels
+			eventTypeLabels = map[string]bool{"push": true}
+		})
+
+		AfterEach(func() {
+			eventTypeLabels = originalLabels
+		})
+
+		forwardEvent := func(eventType string) {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			if eventType != "" {
+				request.Header.Set("X-GitHub-Event", eventType)
 			}
-			mutex.Unlock()
+			forwardHandler(httptest.NewRecorder(), request)
+		}
+
+		It("should count allowed types under their own label", func() {
+			before := testutil.ToFloat64(eventsByType.WithLabelValues("push"))
+			forwardEvent("push")
+
+			Expect(testutil.ToFloat64(eventsByType.WithLabelValues("push"))).To(Equal(before + 1))
+		})
+
+		It("should bucket other and missing types as other", func() {
+			before := testutil.ToFloat64(eventsByType.WithLabelValues("other"))
+			forwardEvent("deployment")
+			forwardEvent("")
+
+			Expect(testutil.ToFloat64(eventsByType.WithLabelValues("other"))).To(Equal(before + 2))
+			Expect(testutil.CollectAndCount(eventsByType, "smee_events_by_type_total")).NotTo(BeZero())
+		})
+
+		It("should not count health checks", func() {
+			before := testutil.ToFloat64(eventsByType.WithLabelValues("other"))
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "unknown-check")
+			forwardHandler(recorder, request)
+
+			Expect(testutil.ToFloat64(eventsByType.WithLabelValues("other"))).To(Equal(before))
 		})
 	})
 
-	It("should force connection closure to prevent connection pooling (behavioral test)", func() {
-		// Set up the global state needed for forwardHandler to work
-		mutex.Lock()
-		healthChecks = make(map[string]chan bool)
-		mutex.Unlock()
+	Describe("request body size limit", func() {
+		var originalMaxRequestBodyBytes int64
 
-		// Create a real HTTP server using the actual forwardHandler
-		testServer := httptest.NewServer(http.HandlerFunc(forwardHandler))
-		defer testServer.Close()
+		BeforeEach(func() {
+			originalMaxRequestBodyBytes = maxRequestBodyBytes
+			maxRequestBodyBytes = 16
 
-		connections := measureConnectionBehaviorWithHealthChecks(testServer.URL, 5)
+			oversizeRejections = prometheus.NewCounter(
+				prometheus.CounterOpts{
+					Name: "smee_requests_rejected_oversize_total",
+					Help: "Total number of forwarded requests rejected for exceeding the maximum body size.",
+				},
+			)
+		})
 
-		// Log the results
-		GinkgoWriter.Printf("forwardHandler created %d connections for 5 health check requests\n", connections)
+		AfterEach(func() {
+			maxRequestBodyBytes = originalMaxRequestBodyBytes
+		})
 
-		// We should see more connections being created because
-		// Connection: close prevents connection reuse
-		// If the fix is working, we should see >= 3 connections for 5 requests
-		// If the fix is broken, we'd see only 1-2 connections due to reuse
-		Expect(connections).To(BeNumerically(">=", 3),
-			"forwardHandler should prevent connection reuse for health checks")
+		It("should forward bodies within the limit", func() {
+			request, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"a": "b"}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(testutil.ToFloat64(oversizeRejections)).To(Equal(0.0))
+		})
+
+		It("should reject bodies with an oversized Content-Length before forwarding", func() {
+			request, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"data": "this is far too long"}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(testutil.ToFloat64(oversizeRejections)).To(Equal(1.0))
+
+			requestMutex.Lock()
+			Expect(len(downstreamRequests)).To(Equal(0))
+			requestMutex.Unlock()
+		})
+
+		It("should reject oversized bodies of unknown length while streaming", func() {
+			request, err := http.NewRequest("POST", "/", io.NopCloser(strings.NewReader(`{"data": "this is far too long"}`)))
+			Expect(err).NotTo(HaveOccurred())
+			request.ContentLength = -1
+
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(testutil.ToFloat64(oversizeRejections)).To(Equal(1.0))
+		})
 	})
-})
 
-func TestForwardHandler_NonHealthCheckRequest(t *testing.T) {
-	// Create a test downstream server
-	downstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Verify the request was forwarded correctly (accept trailing slash)
-		if r.URL.Path != "/webhook" && r.URL.Path != "/webhook/" {
-			t.Errorf("Expected path /webhook or /webhook/, got %s", r.URL.Path)
-		}
+	Describe("local downstream modes", func() {
+		BeforeEach(func() {
+			downstreamServiceURL = ""
+		})
 
-		// Read and verify the body was forwarded correctly
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			t.Errorf("Failed to read forwarded body: %v", err)
-		}
+		AfterEach(func() {
+			downstreamMode = downstreamModeProxy
+		})
 
-		expectedBody := `{"type":"webhook","data":"test"}`
-		if string(body) != expectedBody {
-			t.Errorf("Expected body %s, got %s", expectedBody, string(body))
-		}
+		It("should echo events back in echo mode", func() {
+			downstreamMode = downstreamModeEcho
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	}))
-	defer downstreamServer.Close()
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			request.Header.Set("Content-Type", "application/json")
+			forwardHandler(recorder, request)
 
-	// Set the downstream service URL
-	downstreamServiceURL = downstreamServer.URL + "/webhook"
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal(`{"type": "webhook"}`))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(testutil.ToFloat64(forwardAttempts.WithLabelValues("echo"))).To(Equal(1.0))
+		})
 
-	// Create a test request (non-health-check)
-	requestBody := `{"type":"webhook","data":"test"}`
-	req := httptest.NewRequest("POST", "/", strings.NewReader(requestBody))
-	req.Header.Set("Content-Type", "application/json")
-	// Note: No X-Health-Check-ID header, so it should be forwarded
+		It("should acknowledge and drop events in discard mode", func() {
+			downstreamMode = downstreamModeDiscard
 
-	// Create a response recorder
-	w := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			forwardHandler(recorder, request)
 
-	// Call the handler
-	forwardHandler(w, req)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(BeEmpty())
+			requestMutex.Lock()
+			Expect(downstreamRequests).To(BeEmpty())
+			requestMutex.Unlock()
+		})
 
-	// Verify the response
-	if w.Code != http.StatusOK {
-		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
-	}
+		It("should still intercept health checks", func() {
+			downstreamMode = downstreamModeEcho
+			resultChan := make(chan bool, 1)
+			mutex.Lock()
+			healthChecks["echo-mode-check"] = resultChan
+			mutex.Unlock()
 
-	if w.Body.String() != "ok" {
-		t.Errorf("Expected response body 'ok', got %s", w.Body.String())
-	}
-}
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "echo-mode-check")
+			forwardHandler(recorder, request)
 
-// measureConnectionBehaviorWithHealthChecks measures how many connections are created
-// when making health check requests to the server
-func measureConnectionBehaviorWithHealthChecks(serverURL string, requestCount int) int {
-	var connectionCount int32
+			Expect(recorder.Body.String()).To(BeEmpty())
+			Eventually(resultChan).Should(Receive(Equal(true)))
+		})
+	})
 
-	// Create a custom transport to count connections
-	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			atomic.AddInt32(&connectionCount, 1)
-			return (&net.Dialer{}).DialContext(ctx, network, addr)
-		},
-		DisableKeepAlives: false,
-	}
+	Describe("health check origin verification", func() {
+		BeforeEach(func() {
+			healthCheckSigningKey = []byte("test-signing-key")
+		})
 
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   time.Second * 5,
-	}
+		AfterEach(func() {
+			healthCheckSigningKey = nil
+		})
 
-	// Make multiple health check requests with the X-Health-Check-ID header
-	for i := 0; i < requestCount; i++ {
-		req, err := http.NewRequest("GET", serverURL, nil)
-		if err != nil {
-			continue
+		healthCheckRequest := func(id, signature string) *http.Request {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(fmt.Sprintf(`{"type": "health-check", "id": "%s"}`, id)))
+			request.Header.Set("X-Health-Check-ID", id)
+			if signature != "" {
+				request.Header.Set(healthCheckSignatureHeader, signature)
+			}
+			return request
 		}
 
-		// Add health check header to trigger our fix
-		req.Header.Set("X-Health-Check-ID", fmt.Sprintf("test-%d", i))
+		It("should signal a signed probe with a local map entry", func() {
+			resultChan := make(chan bool, 1)
+			mutex.Lock()
+			healthChecks["signed-probe"] = resultChan
+			mutex.Unlock()
 
-		resp, err := client.Do(req)
-		if err != nil {
-			continue
-		}
-		resp.Body.Close()
+			forwardHandler(recorder, healthCheckRequest("signed-probe", signHealthCheckID("signed-probe")))
 
-		// Brief pause to ensure connections are properly handled
-		time.Sleep(10 * time.Millisecond)
-	}
+			Expect(resultChan).To(Receive(BeTrue()))
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(BeEmpty())
+		})
 
-	return int(atomic.LoadInt32(&connectionCount))
+		It("should forward a spoofed probe with no map entry and no valid signature", func() {
+			forwardHandler(recorder, healthCheckRequest("7f1c9a3e-1d2b-4c5d-8e9f-0a1b2c3d4e5f", "forged"))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			Expect(relayed()).To(Equal(1.0))
+		})
+
+		It("should forward a replayed signed probe whose check is no longer known", func() {
+			forwardHandler(recorder, healthCheckRequest("forgotten-probe", signHealthCheckID("forgotten-probe")))
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+		})
+
+		It("should absorb a signed probe that arrives after its check finished", func() {
+			mutex.Lock()
+			finishedHealthChecks["late-probe"] = time.Now()
+			mutex.Unlock()
+			defer func() {
+				mutex.Lock()
+				delete(finishedHealthChecks, "late-probe")
+				mutex.Unlock()
+			}()
+
+			forwardHandler(recorder, healthCheckRequest("late-probe", signHealthCheckID("late-probe")))
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(BeEmpty())
+		})
+
+		It("should not signal a replayed ID that lacks the signature", func() {
+			resultChan := make(chan bool, 1)
+			mutex.Lock()
+			healthChecks["observed-id"] = resultChan
+			mutex.Unlock()
+
+			forwardHandler(recorder, healthCheckRequest("observed-id", ""))
+
+			Expect(resultChan).NotTo(Receive())
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+		})
+	})
+
+	Describe("request decompression", func() {
+		var receivedBody string
+
+		BeforeEach(func() {
+			decompressRequests = true
+			receivedBody = ""
+			mockDownstream.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				requestMutex.Lock()
+				downstreamRequests = append(downstreamRequests, r)
+				receivedBody = string(body)
+				requestMutex.Unlock()
+				w.WriteHeader(http.StatusOK)
+			})
+		})
+
+		AfterEach(func() {
+			decompressRequests = false
+		})
+
+		compressed := func(encoding, payload string) *bytes.Buffer {
+			var buf bytes.Buffer
+			var writer io.WriteCloser
+			if encoding == "gzip" {
+				writer = gzip.NewWriter(&buf)
+			} else {
+				writer = zlib.NewWriter(&buf)
+			}
+			writer.Write([]byte(payload))
+			writer.Close()
+			return &buf
+		}
+
+		DescribeTable("should forward the decoded body",
+			func(encoding string) {
+				payload := `{"action": "opened"}`
+				request := httptest.NewRequest("POST", "/", compressed(encoding, payload))
+				request.Header.Set("Content-Encoding", encoding)
+				forwardHandler(recorder, request)
+
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				requestMutex.Lock()
+				defer requestMutex.Unlock()
+				Expect(receivedBody).To(Equal(payload))
+				Expect(downstreamRequests[0].Header.Get("Content-Encoding")).To(BeEmpty())
+				Expect(downstreamRequests[0].ContentLength).To(Equal(int64(len(payload))))
+			},
+			Entry("gzip", "gzip"),
+			Entry("deflate", "deflate"),
+		)
+
+		It("should reject malformed gzip with 400", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString("not gzip at all"))
+			request.Header.Set("Content-Encoding", "gzip")
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(BeEmpty())
+		})
+
+		It("should reject bodies that inflate beyond the size limit", func() {
+			originalMax := maxRequestBodyBytes
+			maxRequestBodyBytes = 1024
+			defer func() { maxRequestBodyBytes = originalMax }()
+
+			request := httptest.NewRequest("POST", "/", compressed("gzip", strings.Repeat("a", 4096)))
+			request.Header.Set("Content-Encoding", "gzip")
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+	})
+
+	Describe("idempotency key", func() {
+		const header = "X-Smee-Idempotency-Key"
+
+		BeforeEach(func() {
+			forwardIdempotencyHeader = header
+		})
+
+		AfterEach(func() {
+			forwardIdempotencyHeader = ""
+		})
+
+		forward := func(body string, headers map[string]string) {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+			for name, value := range headers {
+				request.Header.Set(name, value)
+			}
+			forwardHandler(httptest.NewRecorder(), request)
+		}
+
+		It("should carry the same key on repeated deliveries of the same event", func() {
+			forward(`{"action": "opened"}`, nil)
+			forward(`{"action": "opened"}`, nil)
+			forward(`{"action": "closed"}`, nil)
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(3))
+			first := downstreamRequests[0].Header.Get(header)
+			Expect(first).To(HaveLen(64))
+			Expect(downstreamRequests[1].Header.Get(header)).To(Equal(first))
+			Expect(downstreamRequests[2].Header.Get(header)).NotTo(Equal(first))
+		})
+
+		It("should still forward the body intact after hashing it", func() {
+			var receivedBody string
+			mockDownstream.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				receivedBody = string(body)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			forward(`{"action": "opened"}`, nil)
+			Expect(receivedBody).To(Equal(`{"action": "opened"}`))
+		})
+
+		It("should prefer the GitHub delivery ID", func() {
+			forward(`{"action": "opened"}`, map[string]string{"X-GitHub-Delivery": "72d3162e-cc78-11e3-81ab-4c9367dc0958"})
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests[0].Header.Get(header)).To(Equal("72d3162e-cc78-11e3-81ab-4c9367dc0958"))
+		})
+
+		It("should preserve a key set by an upstream hop", func() {
+			forward(`{"action": "opened"}`, map[string]string{header: "upstream-key"})
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests[0].Header.Get(header)).To(Equal("upstream-key"))
+		})
+	})
+
+	Describe("relay prefix stripping", func() {
+		BeforeEach(func() {
+			relayStripPrefix = "/webhooks/myteam"
+		})
+
+		AfterEach(func() {
+			relayStripPrefix = ""
+		})
+
+		DescribeTable("should forward the path the downstream expects",
+			func(incoming, expected string) {
+				forwardHandler(recorder, httptest.NewRequest("POST", incoming, bytes.NewBufferString(`{"type": "webhook"}`)))
+
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				requestMutex.Lock()
+				defer requestMutex.Unlock()
+				Expect(downstreamRequests).To(HaveLen(1))
+				Expect(downstreamRequests[0].URL.RequestURI()).To(Equal(expected))
+			},
+			Entry("prefix only", "/webhooks/myteam", "/"),
+			Entry("prefix with trailing slash", "/webhooks/myteam/", "/"),
+			Entry("nested path and query", "/webhooks/myteam/github?source=app", "/github?source=app"),
+			Entry("sibling path sharing the prefix text", "/webhooks/myteamx/github", "/webhooks/myteamx/github"),
+			Entry("unrelated path", "/other", "/other"),
+		)
+	})
+
+	Describe("buffered forwarding", func() {
+		BeforeEach(func() {
+			bufferForwardBodies = true
+		})
+
+		AfterEach(func() {
+			bufferForwardBodies = false
+		})
+
+		It("should forward the buffered body with a known length", func() {
+			request := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(`{"type": `), strings.NewReader(`"webhook"}`)))
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			Expect(downstreamRequests[0].ContentLength).To(Equal(int64(len(`{"type": "webhook"}`))))
+		})
+
+		It("should answer a failed forward with a 502 carrying a correlation ID", func() {
+			mockDownstream.Close()
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusBadGateway))
+			id := recorder.Header().Get("X-Smee-Correlation-ID")
+			Expect(id).NotTo(BeEmpty())
+			Expect(recorder.Body.String()).To(ContainSubstring(id))
+		})
+
+		It("should still reject oversized bodies with 413", func() {
+			originalLimit := maxRequestBodyBytes
+			maxRequestBodyBytes = 8
+			defer func() { maxRequestBodyBytes = originalLimit }()
+
+			request := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(`{"type": "webhook"}`)))
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(downstreamRequests).To(BeEmpty())
+		})
+	})
+
+	Describe("chunked bodies with trailers", func() {
+		type received struct {
+			body             string
+			contentLength    int64
+			transferEncoding []string
+			trailer          http.Header
+		}
+
+		var (
+			relay      *httptest.Server
+			deliveries chan received
+		)
+
+		BeforeEach(func() {
+			deliveries = make(chan received, 1)
+			mockDownstream.Close()
+			mockDownstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				// Trailers are only known once the body has been read to the end
+				deliveries <- received{string(body), r.ContentLength, r.TransferEncoding, r.Trailer}
+			}))
+			downstreamServiceURL = mockDownstream.URL
+			relay = httptest.NewServer(http.HandlerFunc(forwardHandler))
+		})
+
+		AfterEach(func() {
+			relay.Close()
+			bufferForwardBodies = false
+		})
+
+		send := func() received {
+			// An unknown length makes the client send the body chunked, with the trailer after it
+			request, err := http.NewRequest("POST", relay.URL, io.MultiReader(strings.NewReader(`{"type": `), strings.NewReader(`"webhook"}`)))
+			Expect(err).NotTo(HaveOccurred())
+			request.ContentLength = -1
+			request.Trailer = http.Header{"X-Hub-Signature-256": []string{"sha256=abc123"}}
+
+			resp, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var delivery received
+			Eventually(deliveries).Should(Receive(&delivery))
+			return delivery
+		}
+
+		It("should stream the chunked body and its trailer through", func() {
+			delivery := send()
+
+			Expect(delivery.body).To(Equal(`{"type": "webhook"}`))
+			Expect(delivery.transferEncoding).To(Equal([]string{"chunked"}))
+			Expect(delivery.trailer.Get("X-Hub-Signature-256")).To(Equal("sha256=abc123"))
+		})
+
+		It("should keep the trailer when the body is buffered", func() {
+			bufferForwardBodies = true
+
+			delivery := send()
+
+			Expect(delivery.body).To(Equal(`{"type": "webhook"}`))
+			Expect(delivery.trailer.Get("X-Hub-Signature-256")).To(Equal("sha256=abc123"))
+		})
+	})
+
+	Describe("error response body logging", func() {
+		var (
+			logs     *bytes.Buffer
+			rejecter *httptest.Server
+		)
+
+		BeforeEach(func() {
+			logs = &bytes.Buffer{}
+			log.SetOutput(logs)
+			logErrorResponseBodies = true
+			errorBodyLogLimit = 16
+			rejecter = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/ok" {
+					w.Write([]byte("accepted"))
+					return
+				}
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"error": "missing installation id"}`))
+			}))
+			downstreamServiceURL = rejecter.URL
+		})
+
+		AfterEach(func() {
+			log.SetOutput(os.Stderr)
+			logErrorResponseBodies = false
+			errorBodyLogLimit = 4096
+			rejecter.Close()
+		})
+
+		It("should log the start of the error body with the correlation ID and pass the body through", func() {
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(recorder.Body.String()).To(Equal(`{"error": "missing installation id"}`))
+			id := recorder.Header().Get("X-Smee-Correlation-ID")
+			Expect(id).NotTo(BeEmpty())
+			Expect(logs.String()).To(ContainSubstring(fmt.Sprintf(`status 422 (correlation ID %s): "{\"error\": \"missi" (truncated)`, id)))
+		})
+
+		It("should not log successful responses", func() {
+			forwardHandler(recorder, httptest.NewRequest("POST", "/ok", strings.NewReader(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("X-Smee-Correlation-ID")).To(BeEmpty())
+			Expect(logs.String()).NotTo(ContainSubstring("Downstream returned status"))
+		})
+	})
+
+	Describe("delivered events", func() {
+		var flaky *httptest.Server
+
+		BeforeEach(func() {
+			flaky = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/fail" {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			downstreamServiceURL = flaky.URL
+		})
+
+		AfterEach(func() {
+			flaky.Close()
+		})
+
+		It("should count only forwards the downstream answered with 2xx", func() {
+			target := flaky.Listener.Addr().String()
+			forwardHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "webhook"}`)))
+			forwardHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/fail", strings.NewReader(`{"type": "webhook"}`)))
+
+			Expect(testutil.ToFloat64(forwardAttempts.WithLabelValues(target))).To(Equal(2.0))
+			Expect(testutil.ToFloat64(forwardDeliveries.WithLabelValues(target))).To(Equal(1.0))
+		})
+	})
+
+	Describe("payload size histogram", func() {
+		BeforeEach(func() {
+			forwardedBytes = prometheus.NewHistogram(
+				prometheus.HistogramOpts{
+					Name:    "smee_forwarded_bytes",
+					Help:    "Size in bytes of regular event payloads forwarded by the sidecar.",
+					Buckets: prometheus.ExponentialBuckets(1024, 4, 9),
+				},
+			)
+		})
+
+		observed := func() (uint64, float64) {
+			metric := &dto.Metric{}
+			Expect(forwardedBytes.Write(metric)).To(Succeed())
+			return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+		}
+
+		It("should observe the Content-Length of forwarded events", func() {
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "webhook"}`)))
+
+			count, sum := observed()
+			Expect(count).To(Equal(uint64(1)))
+			Expect(sum).To(Equal(float64(len(`{"type": "webhook"}`))))
+		})
+
+		It("should count the bytes of events with an unknown length", func() {
+			request := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(`{"type": `), strings.NewReader(`"webhook"}`)))
+			Expect(request.ContentLength).To(Equal(int64(-1)))
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			count, sum := observed()
+			Expect(count).To(Equal(uint64(1)))
+			Expect(sum).To(Equal(float64(len(`{"type": "webhook"}`))))
+		})
+
+		It("should not observe health checks", func() {
+			request := httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "probe")
+			forwardHandler(recorder, request)
+
+			count, _ := observed()
+			Expect(count).To(BeZero())
+		})
+	})
+
+	Describe("forward duration histogram", func() {
+		BeforeEach(func() {
+			forwardDuration = prometheus.NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:    "smee_forward_duration_seconds",
+					Help:    "Time in seconds for the downstream service to answer a forwarded regular event.",
+					Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+				},
+				[]string{"target"},
+			)
+		})
+
+		observed := func() uint64 {
+			metric := &dto.Metric{}
+			histogram := forwardDuration.WithLabelValues(mockDownstream.Listener.Addr().String()).(prometheus.Histogram)
+			Expect(histogram.Write(metric)).To(Succeed())
+			return metric.GetHistogram().GetSampleCount()
+		}
+
+		It("should observe each forward under its target", func() {
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(observed()).To(Equal(uint64(1)))
+		})
+
+		It("should not observe health checks", func() {
+			request := httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "probe")
+			forwardHandler(recorder, request)
+
+			Expect(testutil.CollectAndCount(forwardDuration)).To(BeZero())
+		})
+	})
+
+	Describe("forward path prefixes", func() {
+		AfterEach(func() {
+			forwardStripPrefix = ""
+			forwardPathPrefix = ""
+		})
+
+		DescribeTable("should rewrite the forwarded path",
+			func(strip, prefix, incoming, expected string) {
+				forwardStripPrefix = strip
+				forwardPathPrefix = prefix
+				forwardHandler(recorder, httptest.NewRequest("POST", incoming, bytes.NewBufferString(`{"type": "webhook"}`)))
+
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				requestMutex.Lock()
+				defer requestMutex.Unlock()
+				Expect(downstreamRequests).To(HaveLen(1))
+				Expect(downstreamRequests[0].URL.RequestURI()).To(Equal(expected))
+			},
+			Entry("prefix added to the root", "", "/webhook", "/", "/webhook"),
+			Entry("prefix added to a nested path", "", "/webhook", "/github?source=app", "/webhook/github?source=app"),
+			Entry("prefix stripped", "/smee", "", "/smee/github", "/github"),
+			Entry("prefix stripped on segment boundaries only", "/smee", "", "/smeeish/github", "/smeeish/github"),
+			Entry("strip then add", "/smee", "/webhook", "/smee/github?source=app", "/webhook/github?source=app"),
+			Entry("strip down to the root then add", "/smee", "/webhook", "/smee", "/webhook"),
+		)
+	})
+
+	Describe("downstream base path", func() {
+		AfterEach(func() {
+			forwardPathPrefix = ""
+		})
+
+		DescribeTable("should prepend the downstream URL's path and keep the query",
+			func(basePath, pathPrefix, incoming, expected string) {
+				downstreamServiceURL = mockDownstream.URL + basePath
+				forwardPathPrefix = pathPrefix
+				forwardHandler(recorder, httptest.NewRequest("POST", incoming, bytes.NewBufferString(`{"type": "webhook"}`)))
+
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				requestMutex.Lock()
+				defer requestMutex.Unlock()
+				Expect(downstreamRequests).To(HaveLen(1))
+				Expect(downstreamRequests[0].URL.RequestURI()).To(Equal(expected))
+			},
+			Entry("root", "/api", "", "/", "/api/"),
+			Entry("nested path with query", "/api", "", "/github/app?source=app", "/api/github/app?source=app"),
+			Entry("base path with trailing slash", "/api/", "", "/github", "/api/github"),
+			Entry("multi-segment base path", "/api/v1", "", "/github", "/api/v1/github"),
+			Entry("escaped path segments", "/api", "", "/repos/a%2Fb", "/api/repos/a%2Fb"),
+			Entry("base query merged with the incoming query", "/api?tenant=a", "", "/github?source=app", "/api/github?tenant=a&source=app"),
+			Entry("forward path prefix", "/api", "/webhook", "/github", "/api/webhook/github"),
+		)
+	})
+
+	Describe("multiple downstream replicas", func() {
+		var replicas []*httptest.Server
+
+		BeforeEach(func() {
+			replicas = nil
+			for _, name := range []string{"a", "b"} {
+				replicas = append(replicas, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte("replica " + name))
+				})))
+			}
+			downstreamServiceURL = replicas[0].URL + ", " + replicas[1].URL
+		})
+
+		AfterEach(func() {
+			for _, replica := range replicas {
+				replica.Close()
+			}
+		})
+
+		It("should spread forwards round-robin and count them per target", func() {
+			var bodies []string
+			for i := 0; i < 4; i++ {
+				recorder := httptest.NewRecorder()
+				forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				bodies = append(bodies, recorder.Body.String())
+			}
+
+			Expect(bodies).To(ConsistOf("replica a", "replica b", "replica a", "replica b"))
+			Expect(bodies[0]).NotTo(Equal(bodies[1]))
+			for _, replica := range replicas {
+				Expect(testutil.ToFloat64(forwardAttempts.WithLabelValues(replica.Listener.Addr().String()))).To(Equal(2.0))
+			}
+		})
+	})
+
+	Describe("unix socket downstream", func() {
+		var (
+			socketPath string
+			server     *http.Server
+			received   chan *http.Request
+		)
+
+		BeforeEach(func() {
+			dir, err := os.MkdirTemp("", "smee-downstream-*")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(os.RemoveAll, dir)
+			socketPath = filepath.Join(dir, "app.sock")
+
+			listener, err := net.Listen("unix", socketPath)
+			Expect(err).NotTo(HaveOccurred())
+			received = make(chan *http.Request, 1)
+			server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r
+				w.Write([]byte("socket response"))
+			})}
+			go server.Serve(listener)
+			downstreamServiceURL = "unix://" + socketPath
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should forward over the socket", func() {
+			forwardHandler(recorder, httptest.NewRequest("POST", "/github?source=app", bytes.NewBufferString(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal("socket response"))
+			var r *http.Request
+			Eventually(received).Should(Receive(&r))
+			// The sender's Host passes through as it does for TCP downstreams
+			Expect(r.Host).To(Equal("example.com"))
+			Expect(r.URL.RequestURI()).To(Equal("/github?source=app"))
+			Expect(testutil.ToFloat64(forwardAttempts.WithLabelValues(socketPath))).To(Equal(1.0))
+		})
+
+		It("should be reported as reachable once the socket accepts connections", func() {
+			Expect(waitForDownstream(context.Background(), downstreamServiceURL, time.Second, 100*time.Millisecond)).To(Succeed())
+		})
+	})
+
+	Describe("rate limiting", func() {
+		BeforeEach(func() {
+			// One event per minute with a burst of two, so the third is always rejected
+			forwardLimiter = rate.NewLimiter(rate.Every(time.Minute), 2)
+			rateLimitedEvents = prometheus.NewCounter(
+				prometheus.CounterOpts{
+					Name: "smee_events_rate_limited_total",
+					Help: "Total number of events rejected with 429 by the forward rate limiter.",
+				},
+			)
+		})
+
+		AfterEach(func() {
+			forwardLimiter = nil
+		})
+
+		It("should reject events beyond the burst with 429", func() {
+			codes := []int{}
+			for i := 0; i < 3; i++ {
+				recorder := httptest.NewRecorder()
+				forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
+				codes = append(codes, recorder.Code)
+			}
+
+			Expect(codes).To(Equal([]int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}))
+			Expect(testutil.ToFloat64(rateLimitedEvents)).To(Equal(1.0))
+			Expect(relayed()).To(Equal(2.0))
+		})
+
+		It("should let health checks bypass an exhausted limiter", func() {
+			forwardLimiter = rate.NewLimiter(rate.Every(time.Minute), 0)
+
+			resultChan := make(chan bool, 1)
+			mutex.Lock()
+			healthChecks["flooded-check"] = resultChan
+			mutex.Unlock()
+
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "flooded-check")
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(resultChan).To(Receive(BeTrue()))
+			Expect(testutil.ToFloat64(rateLimitedEvents)).To(BeZero())
+		})
+	})
+
+	Describe("recent events", func() {
+		BeforeEach(func() {
+			recentEvents = newRing[recentEvent](2)
+		})
+
+		AfterEach(func() {
+			recentEvents = nil
+		})
+
+		It("should keep the metadata of the last forwards without their bodies", func() {
+			for _, eventType := range []string{"push", "issues", "check_run"} {
+				request := httptest.NewRequest("POST", "/hook", strings.NewReader(`{"token": "s3cret"}`))
+				request.Header.Set("X-GitHub-Event", eventType)
+				forwardHandler(httptest.NewRecorder(), request)
+			}
+
+			events := recentEvents.snapshot()
+			Expect(events).To(HaveLen(2))
+			Expect(events[0].Event).To(Equal("issues"))
+			Expect(events[1].Event).To(Equal("check_run"))
+			Expect(events[1].Method).To(Equal("POST"))
+			Expect(events[1].Path).To(Equal("/hook"))
+			Expect(events[1].Status).To(Equal(http.StatusOK))
+
+			handlerRecorder := httptest.NewRecorder()
+			recentEventsHandler(handlerRecorder, httptest.NewRequest("GET", "/debug/recent-events", nil))
+			Expect(handlerRecorder.Code).To(Equal(http.StatusOK))
+			Expect(handlerRecorder.Body.String()).To(ContainSubstring(`"event":"check_run"`))
+			Expect(handlerRecorder.Body.String()).NotTo(ContainSubstring("s3cret"))
+		})
+	})
+
+	Describe("debug body capture", func() {
+		BeforeEach(func() {
+			capturedBodies = newRing[capturedBody](3)
+			debugCaptureMaxBytes = 4096
+		})
+
+		AfterEach(func() {
+			capturedBodies = nil
+			debugCaptureRedactFields = nil
+		})
+
+		forward := func(body string) {
+			request := httptest.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+			request.Header.Set("Content-Type", "application/json")
+			forwardHandler(httptest.NewRecorder(), request)
+		}
+
+		It("should keep the most recent bodies up to the configured count", func() {
+			for i := 1; i <= 5; i++ {
+				forward(fmt.Sprintf(`{"n": %d}`, i))
+			}
+
+			captured := capturedBodies.snapshot()
+			Expect(captured).To(HaveLen(3))
+			Expect(captured[0].Body).To(Equal(`{"n": 3}`))
+			Expect(captured[2].Body).To(Equal(`{"n": 5}`))
+			Expect(captured[2].Path).To(Equal("/webhook"))
+
+			// The downstream still receives the full body
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(5))
+		})
+
+		It("should truncate bodies beyond the per-body limit", func() {
+			debugCaptureMaxBytes = 8
+
+			forward(`{"action": "opened"}`)
+
+			captured := capturedBodies.snapshot()
+			Expect(captured).To(HaveLen(1))
+			Expect(captured[0].Body).To(Equal(`{"action`))
+			Expect(captured[0].Truncated).To(BeTrue())
+		})
+
+		It("should redact configured sensitive fields", func() {
+			debugCaptureRedactFields = map[string]bool{"token": true}
+
+			forward(`{"action": "opened", "installation": {"Token": "ghs_secret"}}`)
+
+			captured := capturedBodies.snapshot()
+			Expect(captured).To(HaveLen(1))
+			Expect(captured[0].Body).NotTo(ContainSubstring("ghs_secret"))
+			Expect(captured[0].Body).To(ContainSubstring(`"Token":"[REDACTED]"`))
+			Expect(captured[0].Body).To(ContainSubstring(`"action":"opened"`))
+		})
+
+		It("should not capture anything when disabled", func() {
+			capturedBodies = nil
+
+			forward(`{"action": "opened"}`)
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+		})
+	})
+
+	Describe("trace propagation", func() {
+		const incomingTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+		var spans *tracetest.SpanRecorder
+
+		BeforeEach(func() {
+			spans = tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+			otel.SetTextMapPropagator(propagation.TraceContext{})
+			tracingEnabled = true
+		})
+
+		AfterEach(func() {
+			tracingEnabled = false
+		})
+
+		It("should continue the incoming trace and record the forward", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			request.Header.Set("traceparent", incomingTraceparent)
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+
+			ended := spans.Ended()
+			Expect(ended).To(HaveLen(1))
+			span := ended[0]
+			Expect(span.Parent().TraceID().String()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+			Expect(span.Parent().SpanID().String()).To(Equal("00f067aa0ba902b7"))
+			Expect(span.Attributes()).To(ContainElement(attribute.Int("http.response.status_code", http.StatusOK)))
+			Expect(span.Attributes()).To(ContainElement(HaveField("Key", attribute.Key("smee.forward.duration_ms"))))
+
+			// The downstream sees the sidecar's span as its parent
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			expected := fmt.Sprintf("00-%s-%s-01", span.SpanContext().TraceID(), span.SpanContext().SpanID())
+			Expect(downstreamRequests[0].Header.Get("traceparent")).To(Equal(expected))
+		})
+
+		It("should not trace health check events", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "unknown-id")
+			forwardHandler(recorder, request)
+
+			Expect(spans.Ended()).To(BeEmpty())
+		})
+	})
+
+	Describe("X-Forwarded-Proto", func() {
+		AfterEach(func() {
+			forwardSetXFP = false
+		})
+
+		It("should reflect https when the relay received a TLS request", func() {
+			forwardSetXFP = true
+
+			request := httptest.NewRequest("POST", "https://relay.example.com/", bytes.NewBufferString(`{"type": "webhook"}`))
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			Expect(downstreamRequests[0].Header.Get("X-Forwarded-Proto")).To(Equal("https"))
+		})
+
+		It("should reflect http for plaintext requests", func() {
+			forwardSetXFP = true
+
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			forwardHandler(recorder, request)
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			Expect(downstreamRequests[0].Header.Get("X-Forwarded-Proto")).To(Equal("http"))
+		})
+
+		It("should not set the header unless enabled", func() {
+			request := httptest.NewRequest("POST", "https://relay.example.com/", bytes.NewBufferString(`{"type": "webhook"}`))
+			forwardHandler(recorder, request)
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			Expect(downstreamRequests[0].Header.Get("X-Forwarded-Proto")).To(BeEmpty())
+		})
+	})
+
+	Describe("HTTP/2 downstream", func() {
+		var protocols chan string
+
+		BeforeEach(func() {
+			protocols = make(chan string, 1)
+			mockDownstream.Close()
+			mockDownstream = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				protocols <- r.Proto
+				w.Write([]byte("downstream response"))
+			}))
+			mockDownstream.EnableHTTP2 = true
+			mockDownstream.StartTLS()
+			downstreamServiceURL = mockDownstream.URL
+
+			// Trust the test server's certificate without offering h2 up front,
+			// so only FORWARD_ENABLE_HTTP2 decides the protocol
+			roots := x509.NewCertPool()
+			roots.AddCert(mockDownstream.Certificate())
+			originalFactory := transportFactory
+			transportFactory = func() http.RoundTripper {
+				transport := createOptimizedTransport()
+				transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+				return transport
+			}
+			DeferCleanup(func() { transportFactory = originalFactory })
+		})
+
+		AfterEach(func() {
+			forwardHTTP2 = false
+		})
+
+		It("should negotiate HTTP/2 when enabled", func() {
+			forwardHTTP2 = true
+
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal("downstream response"))
+			Expect(<-protocols).To(Equal("HTTP/2.0"))
+		})
+
+		It("should stay on HTTP/1.1 by default", func() {
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(<-protocols).To(Equal("HTTP/1.1"))
+		})
+	})
+
+	Describe("extra headers", func() {
+		BeforeEach(func() {
+			forwardExtraHeaders = map[string]string{"Authorization": "Bearer s3cret", "X-Internal-Token": "abc"}
+		})
+
+		AfterEach(func() {
+			forwardExtraHeaders = nil
+		})
+
+		It("should set them on forwards, replacing the sender's", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			request.Header.Set("Authorization", "Bearer from-sender")
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			Expect(downstreamRequests[0].Header.Values("Authorization")).To(Equal([]string{"Bearer s3cret"}))
+			Expect(downstreamRequests[0].Header.Get("X-Internal-Token")).To(Equal("abc"))
+		})
+	})
+
+	Describe("transportFactory", func() {
+		var requests atomic.Int32
+
+		BeforeEach(func() {
+			requests.Store(0)
+			originalFactory := transportFactory
+			transportFactory = func() http.RoundTripper {
+				return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					requests.Add(1)
+					return http.DefaultTransport.RoundTrip(r)
+				})
+			}
+			DeferCleanup(func() {
+				transportFactory = originalFactory
+				healthCheckClient = nil
+				healthCheckOnce = sync.Once{}
+			})
+		})
+
+		It("should create the transport forwards go through", func() {
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(requests.Load()).To(Equal(int32(1)))
+		})
+
+		It("should not create the health check client's transport", func() {
+			resp, err := getHealthCheckClient().Get(mockDownstream.URL)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+
+			Expect(requests.Load()).To(BeZero())
+		})
+	})
+
+	Describe("health check transport", func() {
+		BeforeEach(func() {
+			healthCheckClient = nil
+			healthCheckOnce = sync.Once{}
+		})
+
+		It("should be separate from the downstream pool and its tuning", func() {
+			originalMaxIdleConnsPerHost := maxIdleConnsPerHost
+			maxIdleConnsPerHost = 200
+			defer func() { maxIdleConnsPerHost = originalMaxIdleConnsPerHost }()
+
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`)))
+			proxyTransport := proxyReplicas[0].proxy.Transport.(*http.Transport)
+			healthTransport := getHealthCheckClient().Transport.(*http.Transport)
+
+			Expect(healthTransport).NotTo(BeIdenticalTo(proxyTransport))
+			Expect(proxyTransport.MaxIdleConnsPerHost).To(Equal(200))
+			Expect(healthTransport.MaxIdleConnsPerHost).To(Equal(1))
+		})
+	})
+
+	Describe("User-Agent", func() {
+		It("should identify the sidecar on forwards that arrive without one", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			forwardHandler(recorder, request)
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			Expect(downstreamRequests[0].Header.Get("User-Agent")).To(Equal(userAgent))
+		})
+
+		It("should replace the sender's User-Agent", func() {
+			request := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			request.Header.Set("User-Agent", "GitHub-Hookshot/abc123")
+			forwardHandler(recorder, request)
+
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+			Expect(downstreamRequests).To(HaveLen(1))
+			Expect(downstreamRequests[0].Header.Get("User-Agent")).To(Equal(userAgent))
+		})
+	})
+
+	Describe("slow downstreams", func() {
+		var (
+			slowDownstream         *httptest.Server
+			originalForwardTimeout time.Duration
+		)
+
+		BeforeEach(func() {
+			originalForwardTimeout = forwardTimeout
+
+			slowDownstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(1500 * time.Millisecond)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("slow downstream response"))
+			}))
+			downstreamServiceURL = slowDownstream.URL
+		})
+
+		AfterEach(func() {
+			forwardTimeout = originalForwardTimeout
+			slowDownstream.Close()
+		})
+
+		It("should not truncate forwards that outlive the server WriteTimeout", func() {
+			relay := httptest.NewUnstartedServer(http.HandlerFunc(forwardHandler))
+			relay.Config.WriteTimeout = 500 * time.Millisecond
+			relay.Start()
+			defer relay.Close()
+
+			resp, err := http.Post(relay.URL, "application/json", bytes.NewBufferString(`{"type": "webhook"}`))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(Equal("slow downstream response"))
+		})
+
+		Context("with the timeout header override", func() {
+			var originalMaxTimeout time.Duration
+
+			BeforeEach(func() {
+				originalMaxTimeout = forwardMaxTimeout
+				forwardTimeout = 300 * time.Millisecond
+			})
+
+			AfterEach(func() {
+				forwardAllowTimeoutHeader = false
+				forwardMaxTimeout = originalMaxTimeout
+			})
+
+			It("should extend the effective deadline within bounds", func() {
+				forwardAllowTimeoutHeader = true
+				forwardMaxTimeout = 5 * time.Second
+
+				request, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+				Expect(err).NotTo(HaveOccurred())
+				request.Header.Set("X-Smee-Forward-Timeout", "3")
+
+				forwardHandler(recorder, request)
+
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				Expect(recorder.Body.String()).To(Equal("slow downstream response"))
+			})
+
+			It("should ignore the header unless allowed", func() {
+				request, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+				Expect(err).NotTo(HaveOccurred())
+				request.Header.Set("X-Smee-Forward-Timeout", "3")
+
+				forwardHandler(recorder, request)
+
+				Expect(recorder.Code).To(Equal(http.StatusGatewayTimeout))
+			})
+
+			It("should clamp and validate requested timeouts", func() {
+				forwardAllowTimeoutHeader = true
+				forwardMaxTimeout = 10 * time.Second
+
+				request := httptest.NewRequest("POST", "/", nil)
+				for value, expected := range map[string]time.Duration{
+					"5":    5 * time.Second,
+					"3600": 10 * time.Second,
+					"0":    300 * time.Millisecond,
+					"-1":   300 * time.Millisecond,
+					"soon": 300 * time.Millisecond,
+				} {
+					request.Header.Set("X-Smee-Forward-Timeout", value)
+					Expect(effectiveForwardTimeout(request)).To(Equal(expected), "header value %q", value)
+				}
+			})
+		})
+
+		It("should track forwards in flight to the downstream", func() {
+			inFlightRequests.Reset()
+			target := strings.TrimPrefix(slowDownstream.URL, "http://")
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				request, _ := http.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+				forwardHandler(httptest.NewRecorder(), request)
+			}()
+
+			Eventually(func() float64 {
+				return testutil.ToFloat64(inFlightRequests.WithLabelValues(target))
+			}, time.Second, time.Millisecond*20).Should(Equal(1.0))
+
+			Eventually(done, time.Second*3).Should(BeClosed())
+			Expect(testutil.ToFloat64(inFlightRequests.WithLabelValues(target))).To(Equal(0.0))
+
+			// Health check interceptions are never counted
+			healthRequest := httptest.NewRequest("POST", "/", nil)
+			healthRequest.Header.Set("X-Health-Check-ID", "inflight-test")
+			forwardHandler(recorder, healthRequest)
+			Expect(testutil.CollectAndCount(inFlightRequests)).To(Equal(1))
+			Expect(testutil.ToFloat64(inFlightRequests.WithLabelValues(target))).To(Equal(0.0))
+		})
+
+		It("should track in-flight forwards per target", func() {
+			inFlightRequests.Reset()
+
+			const perTarget = 3
+			release := make(chan struct{})
+			var wg sync.WaitGroup
+			for _, target := range []string{"target-a:8080", "target-b:8080"} {
+				for i := 0; i < perTarget; i++ {
+					wg.Add(1)
+					go func(target string) {
+						defer wg.Done()
+						defer trackInFlight(target)()
+						<-release
+					}(target)
+				}
+			}
+
+			for _, target := range []string{"target-a:8080", "target-b:8080"} {
+				Eventually(func() float64 {
+					return testutil.ToFloat64(inFlightRequests.WithLabelValues(target))
+				}, time.Second, time.Millisecond*10).Should(Equal(float64(perTarget)))
+			}
+
+			close(release)
+			wg.Wait()
+			Expect(testutil.ToFloat64(inFlightRequests.WithLabelValues("target-a:8080"))).To(Equal(0.0))
+			Expect(testutil.ToFloat64(inFlightRequests.WithLabelValues("target-b:8080"))).To(Equal(0.0))
+		})
+
+		It("should release the in-flight count when a forward panics", func() {
+			inFlightRequests.Reset()
+
+			func() {
+				defer func() { _ = recover() }()
+				defer trackInFlight("target-a:8080")()
+				panic(http.ErrAbortHandler)
+			}()
+
+			Expect(testutil.ToFloat64(inFlightRequests.WithLabelValues("target-a:8080"))).To(Equal(0.0))
+		})
+
+		It("should fail forwards that exceed the forward timeout", func() {
+			forwardTimeout = 300 * time.Millisecond
+
+			request, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"type": "webhook"}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusGatewayTimeout))
+		})
+	})
+
+	Describe("concurrent access", func() {
+		It("should handle concurrent health check requests safely", func() {
+			const numRequests = 10
+			testIDs := make([]string, numRequests)
+			resultChans := make([]chan bool, numRequests)
+
+			// Set up multiple health check channels
+			mutex.Lock()
+			for i := 0; i < numRequests; i++ {
+				testIDs[i] = fmt.Sprintf("concurrent-test-%d", i)
+				resultChans[i] = make(chan bool, 1)
+				healthChecks[testIDs[i]] = resultChans[i]
+			}
+			mutex.Unlock()
+
+			// Launch concurrent requests
+			done := make(chan bool, numRequests)
+			for i := 0; i < numRequests; i++ {
+				go func(index int) {
+					defer func() { done <- true }()
+
+					// Use BOTH headers and JSON body approach for optimal performance + compatibility
+					payload := fmt.Sprintf(`{"type": "health-check", "id": "%s"}`, testIDs[index])
+					request, err := http.NewRequest("POST", "/", bytes.NewBufferString(payload))
+					Expect(err).NotTo(HaveOccurred())
+					request.Header.Set("X-Health-Check-ID", testIDs[index])
+					request.Header.Set("Content-Type", "application/json")
+
+					recorder := httptest.NewRecorder()
+					forwardHandler(recorder, request)
+
+					Expect(recorder.Code).To(Equal(http.StatusOK))
+				}(i)
+			}
+
+			// Wait for all requests to complete
+			for i := 0; i < numRequests; i++ {
+				<-done
+			}
+
+			// Verify all channels were signaled
+			for i := 0; i < numRequests; i++ {
+				Eventually(resultChans[i]).Should(Receive(Equal(true)))
+			}
+
+			// Verify all health checks are still in the map (cleanup happens in performHealthCheck, not forwardHandler)
+			mutex.Lock()
+			Expect(len(healthChecks)).To(Equal(numRequests))
+			// Clean up for the test
+			for _, testID := range testIDs {
+				delete(healthChecks, testID)
+			}
+			mutex.Unlock()
+		})
+	})
+
+	It("should force connection closure to prevent connection pooling (behavioral test)", func() {
+		// Set up the global state needed for forwardHandler to work
+		mutex.Lock()
+		healthChecks = make(map[string]chan bool)
+		mutex.Unlock()
+
+		// Create a real HTTP server using the actual forwardHandler
+		testServer := httptest.NewServer(http.HandlerFunc(forwardHandler))
+		defer testServer.Close()
+
+		connections := measureConnectionBehaviorWithHealthChecks(testServer.URL, 5)
+
+		// Log the results
+		GinkgoWriter.Printf("forwardHandler created %d connections for 5 health check requests\n", connections)
+
+		// We should see more connections being created because
+		// Connection: close prevents connection reuse
+		// If the fix is working, we should see >= 3 connections for 5 requests
+		// If the fix is broken, we'd see only 1-2 connections due to reuse
+		Expect(connections).To(BeNumerically(">=", 3),
+			"forwardHandler should prevent connection reuse for health checks")
+	})
+})
+
+func TestForwardHandler_NonHealthCheckRequest(t *testing.T) {
+	// Create a test downstream server
+	downstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Verify the request was forwarded correctly (accept trailing slash)
+		if r.URL.Path != "/webhook" && r.URL.Path != "/webhook/" {
+			t.Errorf("Expected path /webhook or /webhook/, got %s", r.URL.Path)
+		}
+
+		// Read and verify the body was forwarded correctly
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Failed to read forwarded body: %v", err)
+		}
+
+		expectedBody := `{"type":"webhook","data":"test"}`
+		if string(body) != expectedBody {
+			t.Errorf("Expected body %s, got %s", expectedBody, string(body))
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+	defer downstreamServer.Close()
+
+	// Set the downstream service URL
+	downstreamServiceURL = downstreamServer.URL + "/webhook"
+
+	// Create a test request (non-health-check)
+	requestBody := `{"type":"webhook","data":"test"}`
+	req := httptest.NewRequest("POST", "/", strings.NewReader(requestBody))
+	req.Header.Set("Content-Type", "application/json")
+	// Note: No X-Health-Check-ID header, so it should be forwarded
+
+	// Create a response recorder
+	w := httptest.NewRecorder()
+
+	// Call the handler
+	forwardHandler(w, req)
+
+	// Verify the response
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	if w.Body.String() != "ok" {
+		t.Errorf("Expected response body 'ok', got %s", w.Body.String())
+	}
+}
+
+// measureConnectionBehaviorWithHealthChecks measures how many connections are created
+// when making health check requests to the server
+func measureConnectionBehaviorWithHealthChecks(serverURL string, requestCount int) int {
+	var connectionCount int32
+
+	// Create a custom transport to count connections
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&connectionCount, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+		DisableKeepAlives: false,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * 5,
+	}
+
+	// Make multiple health check requests with the X-Health-Check-ID header
+	for i := 0; i < requestCount; i++ {
+		req, err := http.NewRequest("GET", serverURL, nil)
+		if err != nil {
+			continue
+		}
+
+		// Add health check header to trigger our fix
+		req.Header.Set("X-Health-Check-ID", fmt.Sprintf("test-%d", i))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		// Brief pause to ensure connections are properly handled
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return int(atomic.LoadInt32(&connectionCount))
+}
+
+// roundTripperFunc adapts a function to an http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
 }
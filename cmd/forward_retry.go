@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retryTransport retries forwards that failed with a connection error or a
+// 429/502/503/504, waiting as long as a Retry-After header asks (up to
+// maxRetryAfter) and otherwise backing off exponentially. Only requests whose
+// body can be replayed through GetBody are retried.
+type retryTransport struct {
+	next          http.RoundTripper
+	retries       int
+	backoff       time.Duration
+	maxRetryAfter time.Duration
+	// Overridable for tests
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryTransport(next http.RoundTripper, retries int, maxRetryAfter time.Duration) *retryTransport {
+	return &retryTransport{
+		next:          next,
+		retries:       retries,
+		backoff:       forwardRetryBackoff,
+		maxRetryAfter: maxRetryAfter,
+		now:           time.Now,
+		sleep:         sleepContext,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt == t.retries || !retryableForward(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+
+		delay := backoff
+		backoff *= 2
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), t.now()); ok {
+				// The downstream asked for a longer pause than we're willing to hold
+				// the event for, so hand its answer back to the caller
+				if retryAfter > t.maxRetryAfter {
+					return resp, nil
+				}
+				delay = retryAfter
+			}
+			drainBounded(resp.Body, healthCheckMaxResponseBytes)
+			resp.Body.Close()
+			log.Printf("Forward got status %d, retrying in %s (attempt %d of %d)", resp.StatusCode, delay, attempt+1, t.retries)
+		} else {
+			log.Printf("Forward failed, retrying in %s (attempt %d of %d): %v", delay, attempt+1, t.retries, err)
+		}
+
+		if err := t.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryableForward reports whether a forward failed in a way another attempt
+// might fix
+func retryableForward(resp *http.Response, err error) bool {
+	return err != nil || retryableStatus(resp.StatusCode)
+}
+
+// retryableStatus reports whether a downstream status signals a transient failure
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header in either its delay-seconds or
+// HTTP-date form, returning how long to wait from now
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(date.Sub(now), 0), true
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Forward Retries", func() {
+	Describe("parseRetryAfter", func() {
+		now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		wait := func(value string) time.Duration {
+			d, ok := parseRetryAfter(value, now)
+			Expect(ok).To(BeTrue(), value)
+			return d
+		}
+
+		It("should parse the delay-seconds form", func() {
+			Expect(wait("120")).To(Equal(2 * time.Minute))
+		})
+
+		It("should parse the HTTP-date form relative to now", func() {
+			Expect(wait("Sun, 01 Jun 2025 12:00:30 GMT")).To(Equal(30 * time.Second))
+			// A date in the past means no wait at all
+			Expect(wait("Sun, 01 Jun 2025 11:00:00 GMT")).To(BeZero())
+		})
+
+		It("should reject missing, negative and malformed values", func() {
+			for _, value := range []string{"", "-5", "soon"} {
+				_, ok := parseRetryAfter(value, now)
+				Expect(ok).To(BeFalse(), value)
+			}
+		})
+	})
+
+	Describe("retryTransport", func() {
+		var (
+			downstream *httptest.Server
+			responses  []func(w http.ResponseWriter)
+			bodies     []string
+			mu         sync.Mutex
+			delays     []time.Duration
+			transport  *retryTransport
+		)
+
+		BeforeEach(func() {
+			responses = nil
+			bodies = nil
+			delays = nil
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				defer mu.Unlock()
+				bodies = append(bodies, string(body))
+				respond := responses[0]
+				if len(responses) > 1 {
+					responses = responses[1:]
+				}
+				respond(w)
+			}))
+			transport = newRetryTransport(http.DefaultTransport, 2, time.Minute)
+			transport.now = func() time.Time { return time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC) }
+			transport.sleep = func(ctx context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				return nil
+			}
+		})
+
+		AfterEach(func() {
+			downstream.Close()
+		})
+
+		status := func(code int, retryAfter string) func(w http.ResponseWriter) {
+			return func(w http.ResponseWriter) {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(code)
+			}
+		}
+
+		send := func() *http.Response {
+			body := `{"type": "webhook"}`
+			request, _ := http.NewRequest("POST", downstream.URL, strings.NewReader(body))
+			resp, err := transport.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp
+		}
+
+		It("should wait as long as Retry-After asks in either form and replay the body", func() {
+			responses = []func(w http.ResponseWriter){
+				status(http.StatusServiceUnavailable, "3"),
+				status(http.StatusTooManyRequests, "Sun, 01 Jun 2025 12:00:10 GMT"),
+				status(http.StatusOK, ""),
+			}
+
+			Expect(send().StatusCode).To(Equal(http.StatusOK))
+			Expect(delays).To(Equal([]time.Duration{3 * time.Second, 10 * time.Second}))
+			Expect(bodies).To(Equal([]string{`{"type": "webhook"}`, `{"type": "webhook"}`, `{"type": "webhook"}`}))
+		})
+
+		It("should back off exponentially without Retry-After", func() {
+			transport.backoff = 100 * time.Millisecond
+			responses = []func(w http.ResponseWriter){status(http.StatusBadGateway, "")}
+
+			Expect(send().StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(delays).To(Equal([]time.Duration{100 * time.Millisecond, 200 * time.Millisecond}))
+			Expect(bodies).To(HaveLen(3))
+		})
+
+		It("should give up and return the status when Retry-After exceeds the cap", func() {
+			responses = []func(w http.ResponseWriter){status(http.StatusServiceUnavailable, "120"), status(http.StatusOK, "")}
+
+			resp := send()
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(resp.Header.Get("Retry-After")).To(Equal("120"))
+			Expect(delays).To(BeEmpty())
+			Expect(bodies).To(HaveLen(1))
+		})
+
+		It("should not retry client errors", func() {
+			responses = []func(w http.ResponseWriter){status(http.StatusBadRequest, ""), status(http.StatusOK, "")}
+
+			Expect(send().StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(bodies).To(HaveLen(1))
+		})
+	})
+
+	Describe("in forwardHandler", func() {
+		var (
+			downstream *httptest.Server
+			attempts   int
+			mu         sync.Mutex
+		)
+
+		BeforeEach(func() {
+			attempts = 0
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				attempts++
+				first := attempts == 1
+				mu.Unlock()
+				if first {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write(body)
+			}))
+			downstreamServiceURL = downstream.URL
+			forwardRetries = 1
+			bufferForwardBodies = true
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			proxyError = nil
+		})
+
+		AfterEach(func() {
+			forwardRetries = 0
+			bufferForwardBodies = false
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			downstream.Close()
+		})
+
+		It("should deliver the event once the downstream recovers", func() {
+			recorder := httptest.NewRecorder()
+			forwardHandler(recorder, httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "webhook"}`)))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal(`{"type": "webhook"}`))
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(attempts).To(Equal(2))
+		})
+	})
+})
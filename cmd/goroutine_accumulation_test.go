@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // countStuckHTTPGoroutines counts only the goroutines that are stuck in HTTP server
@@ -69,7 +71,7 @@ var _ = Describe("Staging Goroutine Accumulation Issue", func() {
 		downstreamServiceURL = slowDownstream.URL
 
 		// Reset proxy instance to pick up new URL
-		proxyInstance = nil
+		proxyReplicas = nil
 		proxyOnce = sync.Once{}
 		proxyError = nil
 
@@ -95,7 +97,7 @@ var _ = Describe("Staging Goroutine Accumulation Issue", func() {
 		}
 
 		// Reset proxy instance
-		proxyInstance = nil
+		proxyReplicas = nil
 		proxyOnce = sync.Once{}
 		proxyError = nil
 	})
@@ -180,14 +182,12 @@ var _ = Describe("Staging Goroutine Accumulation Issue", func() {
 	Describe("Recovery with Server Timeouts - WITH Our Fix", func() {
 		It("should recover stuck HTTP goroutines using testable timeouts", func() {
 			// Create server WITH timeouts (testing our fix)
-			// Using short timeouts for testing, but same pattern as production
-			testServer = &http.Server{
-				Addr:         ":0",
-				Handler:      http.HandlerFunc(forwardHandler),
-				ReadTimeout:  3 * time.Second, // Short for testing - will cleanup stuck goroutines
-				WriteTimeout: 2 * time.Second, // Short for testing
-				IdleTimeout:  5 * time.Second, // Short for testing
-			}
+			// Using short timeouts for testing, but the same constructor as production
+			testServer = newServer(":0", http.HandlerFunc(forwardHandler), ServerTimeouts{
+				Read:  3 * time.Second, // Short for testing - will cleanup stuck goroutines
+				Write: 2 * time.Second, // Short for testing
+				Idle:  5 * time.Second, // Short for testing
+			})
 
 			var err error
 			testListener, err = net.Listen("tcp", ":0")
@@ -279,4 +279,29 @@ var _ = Describe("Staging Goroutine Accumulation Issue", func() {
 			fmt.Printf("✅ Recovery demonstrated: server timeouts cleaned up %d stuck HTTP goroutines\n", stuckGoroutinesRecovered)
 		})
 	})
+
+	Describe("goroutine sampler", func() {
+		It("should publish the goroutine count so accumulation is visible at runtime", func() {
+			goroutineCount.Set(0)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go runGoroutineSampler(ctx, 10*time.Millisecond)
+
+			Eventually(func() float64 {
+				return testutil.ToFloat64(goroutineCount)
+			}).Should(BeNumerically(">", 1))
+
+			// Leak a few goroutines and watch the next sample pick them up
+			release := make(chan struct{})
+			defer close(release)
+			baseline := testutil.ToFloat64(goroutineCount)
+			for i := 0; i < 10; i++ {
+				go func() { <-release }()
+			}
+			Eventually(func() float64 {
+				return testutil.ToFloat64(goroutineCount)
+			}).Should(BeNumerically(">=", baseline+10))
+		})
+	})
 })
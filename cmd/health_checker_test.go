@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -32,6 +39,7 @@ var _ = Describe("Health Checker", func() {
 		// Reset global state
 		mutex.Lock()
 		healthChecks = make(map[string]chan bool)
+		healthCheckCreated = make(map[string]time.Time)
 		mutex.Unlock()
 
 		// Re-create the gauge for each test
@@ -53,8 +61,9 @@ var _ = Describe("Health Checker", func() {
 	Describe("writeHealthStatus", func() {
 		It("should write health status to file in correct format", func() {
 			status := &HealthStatus{
-				Status:  "success",
-				Message: "Health check completed successfully",
+				Status:    "success",
+				Message:   "Health check completed successfully",
+				Timestamp: time.Date(2025, 6, 1, 12, 30, 0, 0, time.UTC),
 			}
 
 			err := writeHealthStatus(status, healthFilePath)
@@ -63,7 +72,7 @@ var _ = Describe("Health Checker", func() {
 			content, err := os.ReadFile(healthFilePath)
 			Expect(err).NotTo(HaveOccurred())
 
-			expectedContent := "status=success\nmessage=Health check completed successfully\n"
+			expectedContent := "status=success\nmessage=Health check completed successfully\ntimestamp=2025-06-01T12:30:00Z\n"
 			Expect(string(content)).To(Equal(expectedContent))
 		})
 
@@ -109,6 +118,55 @@ var _ = Describe("Health Checker", func() {
 		})
 	})
 
+	Describe("checkWritable", func() {
+		It("should leave a writable directory as it found it", func() {
+			Expect(checkWritable(tempDir)).To(Succeed())
+
+			entries, err := os.ReadDir(tempDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+
+		It("should fail for a directory files can't be created in", func() {
+			Expect(checkWritable(filepath.Join(tempDir, "missing"))).NotTo(Succeed())
+		})
+	})
+
+	Describe("recordHealthStatus", func() {
+		It("should count failed status file writes", func() {
+			before := testutil.ToFloat64(healthFileWriteFailures)
+
+			recordHealthStatus(&HealthStatus{Status: "success"}, filepath.Join(tempDir, "missing", "health-status.txt"))
+
+			Expect(testutil.ToFloat64(healthFileWriteFailures)).To(Equal(before + 1))
+		})
+	})
+
+	Describe("writeSignalFile", func() {
+		It("should write a fixed-width success record", func() {
+			signalPath := filepath.Join(tempDir, "health-signal")
+			now := time.Unix(1700000000, 0)
+
+			err := writeSignalFile(&HealthStatus{Status: "success"}, signalPath, now)
+			Expect(err).NotTo(HaveOccurred())
+
+			content, err := os.ReadFile(signalPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("1 1700000000\n"))
+		})
+
+		It("should write a failure record of the same width", func() {
+			signalPath := filepath.Join(tempDir, "health-signal")
+
+			err := writeSignalFile(&HealthStatus{Status: "failure"}, signalPath, time.Unix(42, 0))
+			Expect(err).NotTo(HaveOccurred())
+
+			content, err := os.ReadFile(signalPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("0 0000000042\n"))
+		})
+	})
+
 	Describe("writeScriptsToVolume", func() {
 		It("should write probe scripts to shared volume", func() {
 			err := writeScriptsToVolume(tempDir)
@@ -202,6 +260,52 @@ var _ = Describe("Health Checker", func() {
 			Expect(string(content)).To(ContainSubstring("#!/bin/bash"))
 			Expect(string(content)).To(ContainSubstring("health-status"))
 		})
+
+		It("should leave existing scripts alone when asked to preserve them", func() {
+			customScriptPath := filepath.Join(tempDir, "check-smee-health.sh")
+			Expect(os.WriteFile(customScriptPath, []byte("#!/bin/sh\nexit 0\n"), 0700)).To(Succeed())
+			preserveExistingScripts = true
+			defer func() { preserveExistingScripts = false }()
+
+			Expect(writeScriptsToVolume(tempDir)).To(Succeed())
+
+			content, err := os.ReadFile(customScriptPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("#!/bin/sh\nexit 0\n"))
+			info, err := os.Stat(customScriptPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode() & 0777).To(Equal(os.FileMode(0700)))
+
+			// Missing scripts are still written
+			_, err = os.Stat(filepath.Join(tempDir, "check-file-age.sh"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should rewrite the shebang when SCRIPT_SHELL is set", func() {
+			scriptShell = "/usr/local/bin/bash"
+			defer func() { scriptShell = "" }()
+
+			Expect(writeScriptsToVolume(tempDir)).To(Succeed())
+
+			content, err := os.ReadFile(filepath.Join(tempDir, "check-smee-health.sh"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(HavePrefix("#!/usr/local/bin/bash\n# Liveness probe for smee container\n"))
+			Expect(string(content)).NotTo(ContainSubstring("#!/bin/bash"))
+		})
+	})
+
+	Describe("drainBounded", func() {
+		It("should read at most the limit from an endless reader", func() {
+			n, truncated := drainBounded(zeroReader{}, 4096)
+			Expect(n).To(Equal(int64(4096)))
+			Expect(truncated).To(BeTrue())
+		})
+
+		It("should not report truncation for small bodies", func() {
+			n, truncated := drainBounded(strings.NewReader("ok"), 4096)
+			Expect(n).To(Equal(int64(2)))
+			Expect(truncated).To(BeFalse())
+		})
 	})
 
 	Describe("performHealthCheck", func() {
@@ -234,6 +338,77 @@ var _ = Describe("Health Checker", func() {
 			})
 		})
 
+		Context("with a custom health check header", func() {
+			var probeHeaders chan http.Header
+
+			BeforeEach(func() {
+				healthCheckHeader = "X-Probe-Id"
+				probeHeaders = make(chan http.Header, 1)
+				// Loop the probe straight back into forwardHandler, as the relay would
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					probeHeaders <- r.Header.Clone()
+					forwardHandler(w, r)
+				}))
+			})
+
+			AfterEach(func() {
+				healthCheckHeader = "X-Health-Check-ID"
+			})
+
+			It("should send and recognize the probe by that header", func() {
+				status := performHealthCheck(mockServer.URL, 5)
+				Expect(status.Status).To(Equal("success"))
+
+				var header http.Header
+				Expect(probeHeaders).To(Receive(&header))
+				Expect(header.Get("X-Probe-Id")).NotTo(BeEmpty())
+				Expect(header.Get("X-Health-Check-ID")).To(BeEmpty())
+			})
+		})
+
+		Context("with the GET method", func() {
+			var (
+				probes  []*http.Request
+				bodies  []string
+				probeMu sync.Mutex
+			)
+
+			BeforeEach(func() {
+				healthCheckMethod = http.MethodGet
+				probes, bodies = nil, nil
+				// Relay that hands the probe straight to forwardHandler, like a smee client would
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ := io.ReadAll(r.Body)
+					probeMu.Lock()
+					probes = append(probes, r)
+					bodies = append(bodies, string(body))
+					probeMu.Unlock()
+
+					relayed := httptest.NewRequest(r.Method, "/", nil)
+					relayed.Header = r.Header.Clone()
+					forwardHandler(httptest.NewRecorder(), relayed)
+					w.WriteHeader(http.StatusOK)
+				}))
+			})
+
+			AfterEach(func() {
+				healthCheckMethod = http.MethodPost
+			})
+
+			It("should round-trip with the ID carried only in the header", func() {
+				status := performHealthCheck(mockServer.URL, 5)
+				Expect(status.Status).To(Equal("success"))
+
+				probeMu.Lock()
+				defer probeMu.Unlock()
+				Expect(probes).To(HaveLen(1))
+				Expect(probes[0].Method).To(Equal(http.MethodGet))
+				Expect(probes[0].Header.Get("X-Health-Check-ID")).NotTo(BeEmpty())
+				Expect(probes[0].Header.Get("Content-Type")).To(BeEmpty())
+				Expect(bodies[0]).To(BeEmpty())
+			})
+		})
+
 		Context("when health check times out", func() {
 			BeforeEach(func() {
 				// Mock server that never responds with the expected signal
@@ -250,17 +425,535 @@ var _ = Describe("Health Checker", func() {
 			})
 		})
 
+		Context("when the relay is slow to answer the POST", func() {
+			BeforeEach(func() {
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(1500 * time.Millisecond):
+					}
+					w.WriteHeader(http.StatusOK)
+				}))
+			})
+
+			It("should report the check deadline as a timeout rather than a failed POST", func() {
+				status := performHealthCheck(mockServer.URL, 1)
+				Expect(status.Reason).To(Equal("timeout"))
+				Expect(status.Message).To(ContainSubstring("timed out posting"))
+			})
+		})
+
+		Context("with a timeout above 30 seconds", func() {
+			It("should leave the check deadline as the only limit on the client", func() {
+				healthCheckClient = nil
+				healthCheckOnce = sync.Once{}
+
+				client := getHealthCheckClient()
+				Expect(client.Timeout).To(BeZero())
+				Expect(client.Transport.(*http.Transport).ResponseHeaderTimeout).To(BeZero())
+
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mutex.Lock()
+					if ch, ok := healthChecks[r.Header.Get("X-Health-Check-ID")]; ok {
+						ch <- true
+					}
+					mutex.Unlock()
+					w.WriteHeader(http.StatusOK)
+				}))
+				status := performHealthCheck(mockServer.URL, 45)
+				Expect(status.Status).To(Equal("success"))
+			})
+		})
+
+		Context("with a custom payload type", func() {
+			var receivedPayload HealthCheckPayload
+
+			BeforeEach(func() {
+				healthCheckPayloadType = "smee-sidecar-probe"
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_ = json.NewDecoder(r.Body).Decode(&receivedPayload)
+					mutex.Lock()
+					if ch, ok := healthChecks[r.Header.Get("X-Health-Check-ID")]; ok {
+						ch <- true
+					}
+					mutex.Unlock()
+					w.WriteHeader(http.StatusOK)
+				}))
+			})
+
+			AfterEach(func() {
+				healthCheckPayloadType = "health-check"
+			})
+
+			It("should send the configured type while detection still relies on the header", func() {
+				status := performHealthCheck(mockServer.URL, 5)
+
+				Expect(status.Status).To(Equal("success"))
+				Expect(receivedPayload.Type).To(Equal("smee-sidecar-probe"))
+				Expect(receivedPayload.ID).NotTo(BeEmpty())
+			})
+		})
+
+		It("should count a loop-back that arrives after the check timed out", func() {
+			lateHealthCheckArrivals = prometheus.NewCounter(prometheus.CounterOpts{
+				Name: "smee_health_check_late_arrivals_total",
+				Help: "Late health check arrivals.",
+			})
+			heldIDs := make(chan string, 1)
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Hold on to the event instead of looping it back in time
+				heldIDs <- r.Header.Get("X-Health-Check-ID")
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			status := performHealthCheck(mockServer.URL, 1)
+			Expect(status.Status).To(Equal("failure"))
+
+			// The late loop-back finds the entry already removed
+			request := httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", <-heldIDs)
+			recorder := httptest.NewRecorder()
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(testutil.ToFloat64(lateHealthCheckArrivals)).To(Equal(1.0))
+		})
+
+		It("should identify itself with the sidecar User-Agent", func() {
+			var receivedUserAgent string
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				receivedUserAgent = r.Header.Get("User-Agent")
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			performHealthCheck(mockServer.URL, 1)
+
+			Expect(receivedUserAgent).To(Equal("smee-sidecar/" + version))
+		})
+
+		Context("when the relay rejects the POST", func() {
+			BeforeEach(func() {
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusInternalServerError)
+				}))
+			})
+
+			It("should fail immediately with an accurate reason", func() {
+				start := time.Now()
+				status := performHealthCheck(mockServer.URL, 5)
+
+				Expect(status.Status).To(Equal("failure"))
+				Expect(status.Message).To(ContainSubstring("relay_rejected_500"))
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			})
+
+			It("should count the status code the relay answered with", func() {
+				before := testutil.ToFloat64(healthCheckPostStatus.WithLabelValues("500"))
+
+				performHealthCheck(mockServer.URL, 5)
+
+				Expect(testutil.ToFloat64(healthCheckPostStatus.WithLabelValues("500"))).To(Equal(before + 1))
+			})
+
+			It("should still report the relay as reachable", func() {
+				smeeRelayReachable.Set(0)
+
+				performHealthCheck(mockServer.URL, 5)
+
+				Expect(testutil.ToFloat64(smeeRelayReachable)).To(Equal(1.0))
+			})
+		})
+
+		Context("when the relay returns an oversized response", func() {
+			var (
+				originalMaxResponseBytes int64
+				bytesWritten             atomic.Int64
+				handlerDone              chan struct{}
+			)
+
+			BeforeEach(func() {
+				originalMaxResponseBytes = healthCheckMaxResponseBytes
+				healthCheckMaxResponseBytes = 1024
+				bytesWritten.Store(0)
+				handlerDone = make(chan struct{})
+
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					defer close(handlerDone)
+					healthCheckID := r.Header.Get("X-Health-Check-ID")
+					mutex.Lock()
+					if ch, ok := healthChecks[healthCheckID]; ok {
+						ch <- true
+					}
+					mutex.Unlock()
+
+					// Stream far more data than the configured limit
+					w.WriteHeader(http.StatusOK)
+					chunk := make([]byte, 64*1024)
+					for i := 0; i < 1024; i++ {
+						n, err := w.Write(chunk)
+						bytesWritten.Add(int64(n))
+						if err != nil {
+							return
+						}
+					}
+				}))
+			})
+
+			AfterEach(func() {
+				healthCheckMaxResponseBytes = originalMaxResponseBytes
+			})
+
+			It("should bound the drain and still report success", func() {
+				status := performHealthCheck(mockServer.URL, 5)
+				Expect(status.Status).To(Equal("success"))
+
+				// The relay should have been cut off well before writing the full 64MB
+				Eventually(handlerDone, time.Second*5).Should(BeClosed())
+				Expect(bytesWritten.Load()).To(BeNumerically("<", 64*1024*1024))
+			})
+		})
+
 		Context("when server is unreachable", func() {
 			It("should return failure status", func() {
 				status := performHealthCheck("http://localhost:99999", 5) // Invalid URL
 				Expect(status.Status).To(Equal("failure"))
 				Expect(status.Message).To(ContainSubstring("Failed to POST to smee server"))
 			})
+
+			It("should report the relay as unreachable", func() {
+				smeeRelayReachable.Set(1)
+
+				performHealthCheck("http://localhost:99999", 5)
+
+				Expect(testutil.ToFloat64(smeeRelayReachable)).To(BeZero())
+			})
+		})
+	})
+
+	Describe("downstream reachability", func() {
+		var (
+			downstream       *httptest.Server
+			downstreamStatus int
+		)
+
+		BeforeEach(func() {
+			// Relay that loops every probe straight back
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				if ch, ok := healthChecks[r.Header.Get("X-Health-Check-ID")]; ok {
+					ch <- true
+				}
+				mutex.Unlock()
+				w.WriteHeader(http.StatusOK)
+			}))
+			downstreamStatus = http.StatusOK
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/healthz" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(downstreamStatus)
+			}))
+			// The health path is resolved against the host, not the base path
+			downstreamServiceURL = downstream.URL + "/api"
+			downstreamHealthPath = "/healthz"
+		})
+
+		AfterEach(func() {
+			downstreamHealthPath = ""
+			downstream.Close()
+		})
+
+		It("should pass when both the round-trip and the downstream succeed", func() {
+			status := performHealthCheck(mockServer.URL, 5)
+
+			Expect(status.Status).To(Equal("success"))
+			Expect(status.Message).To(ContainSubstring("smee_roundtrip=ok, downstream_reachable=ok"))
+			Expect(testutil.ToFloat64(smeeRoundTrip)).To(Equal(1.0))
+			Expect(testutil.ToFloat64(downstreamReachable)).To(Equal(1.0))
+		})
+
+		It("should fail when the downstream answers non-2xx despite a good round-trip", func() {
+			downstreamStatus = http.StatusServiceUnavailable
+
+			status := performHealthCheck(mockServer.URL, 5)
+
+			Expect(status.Status).To(Equal("failure"))
+			Expect(status.Reason).To(Equal("downstream_unreachable"))
+			Expect(status.Message).To(ContainSubstring("status 503"))
+			Expect(status.Message).To(ContainSubstring("smee_roundtrip=ok, downstream_reachable=failed"))
+			Expect(testutil.ToFloat64(smeeRoundTrip)).To(Equal(1.0))
+			Expect(testutil.ToFloat64(downstreamReachable)).To(BeZero())
+		})
+
+		It("should report both halves when the round-trip fails", func() {
+			mockServer.Close()
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			}))
+
+			status := performHealthCheck(mockServer.URL, 5)
+
+			Expect(status.Status).To(Equal("failure"))
+			Expect(status.Reason).To(Equal("relay_rejected_502"))
+			Expect(status.Message).To(ContainSubstring("smee_roundtrip=failed, downstream_reachable=ok"))
+			Expect(testutil.ToFloat64(smeeRoundTrip)).To(BeZero())
+		})
+	})
+
+	Describe("healthCheckLogger", func() {
+		var (
+			logs   *bytes.Buffer
+			logger *healthCheckLogger
+		)
+
+		BeforeEach(func() {
+			logs = &bytes.Buffer{}
+			log.SetOutput(logs)
+			logger = &healthCheckLogger{}
+			healthCheckFailureLogEvery = 3
+		})
+
+		AfterEach(func() {
+			log.SetOutput(os.Stderr)
+			healthCheckFailureLogEvery = 10
+		})
+
+		refused := &HealthStatus{Status: "failure", Message: "Failed to POST to smee server: connection refused"}
+
+		It("should log a run of identical failures once and then every Nth time", func() {
+			for i := 0; i < 7; i++ {
+				logger.log(refused)
+			}
+
+			Expect(strings.Count(logs.String(), "connection refused")).To(Equal(3))
+			Expect(logs.String()).To(ContainSubstring("repeated 3 times"))
+			Expect(logs.String()).To(ContainSubstring("repeated 6 times"))
+			Expect(testutil.ToFloat64(healthCheckConsecutiveFailures)).To(Equal(7.0))
+		})
+
+		It("should log a failure whose message changed", func() {
+			logger.log(refused)
+			logger.log(&HealthStatus{Status: "failure", Message: "Health check timed out waiting for event round-trip"})
+
+			Expect(logs.String()).To(ContainSubstring("connection refused"))
+			Expect(logs.String()).To(ContainSubstring("timed out"))
+		})
+
+		It("should log the recovery and reset the failure count", func() {
+			logger.log(refused)
+			logger.log(refused)
+			logger.log(&HealthStatus{Status: "success", Message: "Health check completed successfully"})
+
+			Expect(logs.String()).To(ContainSubstring("Health check recovered after 2 consecutive failures"))
+			Expect(testutil.ToFloat64(healthCheckConsecutiveFailures)).To(BeZero())
+
+			// A later failure is logged again even with the same message
+			logs.Reset()
+			logger.log(refused)
+			Expect(logs.String()).To(ContainSubstring("connection refused"))
+		})
+	})
+
+	Describe("emitHealthCheckResult", func() {
+		var events *bytes.Buffer
+
+		BeforeEach(func() {
+			events = &bytes.Buffer{}
+			healthCheckResultWriter = events
+			healthCheckResultEvents = "all"
+		})
+
+		AfterEach(func() {
+			healthCheckResultWriter = os.Stdout
+			healthCheckResultEvents = ""
+		})
+
+		lastEvent := func() map[string]any {
+			var event map[string]any
+			lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+			Expect(json.Unmarshal([]byte(lines[len(lines)-1]), &event)).To(Succeed())
+			return event
+		}
+
+		It("should describe a successful check", func() {
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				if ch, ok := healthChecks[r.Header.Get("X-Health-Check-ID")]; ok {
+					ch <- true
+				}
+				mutex.Unlock()
+				w.WriteHeader(http.StatusOK)
+			}))
+			status := performHealthCheck(mockServer.URL, 5)
+
+			emitHealthCheckResult(status, mockServer.URL, 0, true)
+
+			event := lastEvent()
+			Expect(event).To(HaveKeyWithValue("msg", "health_check_result"))
+			Expect(event).To(HaveKeyWithValue("level", "INFO"))
+			Expect(event).To(HaveKeyWithValue("status", "success"))
+			Expect(event).To(HaveKeyWithValue("reason", ""))
+			Expect(event).To(HaveKeyWithValue("channel", mockServer.URL))
+			Expect(event).To(HaveKeyWithValue("consecutive_failures", 0.0))
+			Expect(event).To(HaveKey("round_trip_ms"))
+			Expect(event).To(HaveKeyWithValue("timestamp", status.Timestamp.UTC().Format(time.RFC3339Nano)))
+		})
+
+		It("should describe a timed out check", func() {
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			status := performHealthCheck(mockServer.URL, 1)
+
+			emitHealthCheckResult(status, mockServer.URL, 3, false)
+
+			event := lastEvent()
+			Expect(event).To(HaveKeyWithValue("level", "WARN"))
+			Expect(event).To(HaveKeyWithValue("status", "failure"))
+			Expect(event).To(HaveKeyWithValue("reason", "timeout"))
+			Expect(event).To(HaveKeyWithValue("consecutive_failures", 3.0))
+			Expect(event["round_trip_ms"]).To(BeNumerically(">=", 1000))
+		})
+
+		It("should drop steady-state successes in changes mode", func() {
+			healthCheckResultEvents = "changes"
+			success := &HealthStatus{Status: "success", Timestamp: time.Now()}
+
+			emitHealthCheckResult(success, "https://smee.example.com/channel", 0, false)
+			Expect(events.Len()).To(BeZero())
+
+			emitHealthCheckResult(success, "https://smee.example.com/channel", 0, true)
+			Expect(lastEvent()).To(HaveKeyWithValue("status", "success"))
+		})
+	})
+
+	Describe("relay liveness checker", func() {
+		var (
+			probes  atomic.Int32
+			methods chan string
+		)
+
+		BeforeEach(func() {
+			probes.Store(0)
+			methods = make(chan string, 100)
+			relayLiveness = prometheus.NewGauge(prometheus.GaugeOpts{Name: "smee_relay_liveness", Help: "Relay liveness."})
+		})
+
+		It("should probe the configured URL and set its own gauge", func() {
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/alive" {
+					probes.Add(1)
+					methods <- r.Method
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			health_check.Set(0)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go runRelayLivenessChecker(ctx, mockServer.URL+"/alive", 50*time.Millisecond, time.Second)
+
+			Eventually(func() float64 { return testutil.ToFloat64(relayLiveness) }, time.Second, 20*time.Millisecond).Should(Equal(1.0))
+			Expect(probes.Load()).To(BeNumerically(">=", 1))
+			Expect(<-methods).To(Equal(http.MethodHead))
+			// The round-trip gauge is untouched by the liveness probe
+			Expect(testutil.ToFloat64(health_check)).To(Equal(0.0))
+		})
+
+		It("should fall back to GET when the relay rejects HEAD", func() {
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				methods <- r.Method
+				if r.Method == http.MethodHead {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			Expect(checkRelayLiveness(mockServer.URL, time.Second)).To(BeTrue())
+			Expect(<-methods).To(Equal(http.MethodHead))
+			Expect(<-methods).To(Equal(http.MethodGet))
+		})
+
+		It("should report the relay as down on server errors", func() {
+			mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			relayLiveness.Set(1)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go runRelayLivenessChecker(ctx, mockServer.URL, 50*time.Millisecond, time.Second)
+
+			Eventually(func() float64 { return testutil.ToFloat64(relayLiveness) }, time.Second, 20*time.Millisecond).Should(Equal(0.0))
+		})
+	})
+
+	Describe("sweepHealthChecks", func() {
+		It("should reclaim abandoned entries and keep fresh ones", func() {
+			now := time.Now()
+			mutex.Lock()
+			// Simulate checks whose cleanup never ran
+			for _, id := range []string{"abandoned-1", "abandoned-2"} {
+				healthChecks[id] = make(chan bool, 1)
+				healthCheckCreated[id] = now.Add(-time.Minute)
+			}
+			healthChecks["untracked"] = make(chan bool, 1)
+			healthChecks["in-progress"] = make(chan bool, 1)
+			healthCheckCreated["in-progress"] = now.Add(-time.Second)
+			mutex.Unlock()
+
+			Expect(sweepHealthChecks(10*time.Second, now)).To(Equal(3))
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			Expect(healthChecks).To(HaveLen(1))
+			Expect(healthChecks).To(HaveKey("in-progress"))
+			Expect(healthCheckCreated).To(HaveLen(1))
+			Expect(testutil.ToFloat64(pendingHealthChecks)).To(Equal(1.0))
+		})
+
+		It("should forget finished IDs once a loop-back can no longer be late", func() {
+			now := time.Now()
+			mutex.Lock()
+			finishedHealthChecks["long-finished"] = now.Add(-time.Minute)
+			finishedHealthChecks["just-finished"] = now.Add(-time.Second)
+			mutex.Unlock()
+
+			Expect(sweepHealthChecks(10*time.Second, now)).To(BeZero())
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			Expect(finishedHealthChecks).NotTo(HaveKey("long-finished"))
+			Expect(finishedHealthChecks).To(HaveKey("just-finished"))
+		})
+
+		It("should reclaim entries from the background sweeper", func() {
+			mutex.Lock()
+			healthChecks["abandoned"] = make(chan bool, 1)
+			healthCheckCreated["abandoned"] = time.Now().Add(-time.Minute)
+			mutex.Unlock()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go runHealthCheckSweeper(ctx, 50*time.Millisecond, time.Second)
+
+			Eventually(func() int {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return len(healthChecks)
+			}, time.Second, 20*time.Millisecond).Should(BeZero())
 		})
 	})
 
 	Describe("runHealthChecker", func() {
 		Context("when running background health checker", func() {
+			AfterEach(func() {
+				// A check still in flight would hold the guard into the next spec
+				Eventually(healthCheckInProgress.Load, 10*time.Second).Should(BeFalse())
+			})
+
 			It("should perform health checks at regular intervals", func() {
 				// Mock server for testing
 				requestCount := 0
@@ -285,6 +978,7 @@ var _ = Describe("Health Checker", func() {
 
 				ctx, cancel := context.WithCancel(context.Background())
 				defer cancel()
+				healthCheckEverSucceeded.Store(false)
 
 				// Start the health checker with a very short interval
 				go runHealthChecker(ctx, mockServer.URL, healthFilePath, 1, 5) // 1 second interval
@@ -313,6 +1007,7 @@ var _ = Describe("Health Checker", func() {
 				Eventually(func() float64 {
 					return testutil.ToFloat64(health_check)
 				}, time.Second*2, time.Millisecond*100).Should(Equal(1.0))
+				Expect(healthCheckEverSucceeded.Load()).To(BeTrue())
 
 				// Cancel the context to stop the health checker
 				cancel()
@@ -327,6 +1022,7 @@ var _ = Describe("Health Checker", func() {
 
 				ctx, cancel := context.WithCancel(context.Background())
 				defer cancel()
+				healthCheckEverSucceeded.Store(false)
 
 				// Start the health checker with short timeout
 				go runHealthChecker(ctx, mockServer.URL, healthFilePath, 1, 1) // 1 second interval, 1 second timeout
@@ -344,10 +1040,99 @@ var _ = Describe("Health Checker", func() {
 				Eventually(func() float64 {
 					return testutil.ToFloat64(health_check)
 				}, time.Second*3, time.Millisecond*100).Should(Equal(0.0))
+				Expect(healthCheckEverSucceeded.Load()).To(BeFalse())
+
+				cancel()
+			})
+
+			It("should write the compact signal file when configured", func() {
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}))
+
+				signalFilePath = filepath.Join(tempDir, "health-signal")
+				defer func() { signalFilePath = "" }()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				go runHealthChecker(ctx, mockServer.URL, healthFilePath, 1, 1)
+
+				// The mock never loops the event back, so the signal reflects a failure
+				Eventually(func() string {
+					content, err := os.ReadFile(filepath.Join(tempDir, "health-signal"))
+					if err != nil {
+						return ""
+					}
+					return string(content)
+				}, time.Second*4, time.Millisecond*100).Should(MatchRegexp(`^0 \d{10}\n$`))
 
 				cancel()
 			})
 
+			It("should skip ticks instead of overlapping a slow check", func() {
+				var inFlight, maxInFlight atomic.Int32
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					current := inFlight.Add(1)
+					defer inFlight.Add(-1)
+					if current > maxInFlight.Load() {
+						maxInFlight.Store(current)
+					}
+
+					// A slow relay: each check takes longer than the 1s interval
+					time.Sleep(1500 * time.Millisecond)
+					mutex.Lock()
+					if ch, ok := healthChecks[r.Header.Get("X-Health-Check-ID")]; ok {
+						ch <- true
+					}
+					mutex.Unlock()
+					w.WriteHeader(http.StatusOK)
+				}))
+				skippedBefore := testutil.ToFloat64(healthChecksSkipped)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go runHealthChecker(ctx, mockServer.URL, healthFilePath, 1, 5)
+
+				Eventually(func() float64 {
+					return testutil.ToFloat64(healthChecksSkipped) - skippedBefore
+				}, time.Second*5, time.Millisecond*100).Should(BeNumerically(">=", 2))
+				Expect(maxInFlight.Load()).To(Equal(int32(1)))
+				Eventually(func() string {
+					content, _ := os.ReadFile(healthFilePath)
+					return string(content)
+				}, time.Second*2, time.Millisecond*100).Should(ContainSubstring("status=success"))
+			})
+
+			It("should skip ticks while an on-demand check is in progress", func() {
+				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mutex.Lock()
+					if ch, ok := healthChecks[r.Header.Get("X-Health-Check-ID")]; ok {
+						ch <- true
+					}
+					mutex.Unlock()
+					w.WriteHeader(http.StatusOK)
+				}))
+				healthCheckInProgress.Store(true)
+				skippedBefore := testutil.ToFloat64(healthChecksSkipped)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go runHealthChecker(ctx, mockServer.URL, healthFilePath, 1, 5)
+
+				Eventually(func() float64 {
+					return testutil.ToFloat64(healthChecksSkipped) - skippedBefore
+				}, time.Second*3, time.Millisecond*100).Should(BeNumerically(">=", 1))
+				_, err := os.Stat(healthFilePath)
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				healthCheckInProgress.Store(false)
+				Eventually(func() string {
+					content, _ := os.ReadFile(healthFilePath)
+					return string(content)
+				}, time.Second*3, time.Millisecond*100).Should(ContainSubstring("status=success"))
+			})
+
 			It("should stop when context is cancelled", func() {
 				mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					w.WriteHeader(http.StatusOK)
@@ -372,3 +1157,13 @@ var _ = Describe("Health Checker", func() {
 		})
 	})
 })
+
+// zeroReader is an endless reader used to simulate unbounded response bodies
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -2,27 +2,58 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed scripts/check-smee-health.sh
@@ -34,18 +65,285 @@ var sidecarHealthScript []byte
 //go:embed scripts/check-file-age.sh
 var fileAgeScript []byte
 
+// Header carrying the sidecar's own HMAC of the health check ID
+const healthCheckSignatureHeader = "X-Health-Check-Signature"
+
+// Largest body HEALTH_CHECK_BODY_FALLBACK inspects for a probe payload; our
+// probes are well under it, and anything bigger is an event to forward
+const healthCheckPeekLimit = 1024
+
+// Build metadata, injected at build time via
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 // HealthStatus represents the current health status
 type HealthStatus struct {
-	Status  string // "success" or "failure"
-	Message string
+	Status  string `json:"status"` // "success" or "failure"
+	Message string `json:"message"`
+	// Machine-readable failure cause: request_error, post_failed,
+	// relay_rejected_<code> or timeout
+	Reason      string    `json:"reason,omitempty"`
+	RoundTripMs int64     `json:"roundTripMs"`
+	Timestamp   time.Time `json:"timestamp"` // when the check completed
 }
 
 var (
-	forwardAttempts = prometheus.NewCounter(
+	// Labeled by the downstream host (or the local mode), fixed at startup so
+	// request data can never add label values
+	forwardAttempts = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "smee_events_relayed_total",
 			Help: "Total number of regular events relayed by the sidecar.",
 		},
+		[]string{"target"},
+	)
+	// Only 2xx answers count, so delivered/relayed gives the delivery success ratio
+	forwardDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smee_events_delivered_total",
+			Help: "Total number of regular events the downstream answered with a 2xx status.",
+		},
+		[]string{"target"},
+	)
+	webhookSignatureFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_webhook_signature_failures_total",
+			Help: "Total number of events whose X-Hub-Signature-256 did not match WEBHOOK_HMAC_SECRET.",
+		},
+	)
+	// Labeled by the matching secret's position in WEBHOOK_HMAC_SECRET, never the secret
+	hmacKeyUsed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smee_hmac_key_used_total",
+			Help: "Total number of events whose signature matched a WEBHOOK_HMAC_SECRET entry, by its zero-based position in the list.",
+		},
+		[]string{"key"},
+	)
+	// Labeled "delivered" or "failed"
+	deadLetterReplays = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smee_dead_letter_replays_total",
+			Help: "Total number of events replayed from DEAD_LETTER_DIR, by result.",
+		},
+		[]string{"result"},
+	)
+	deadLettersExpired = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_dead_letters_expired_total",
+			Help: "Total number of events deleted from DEAD_LETTER_DIR for being older than DEAD_LETTER_MAX_AGE_SECONDS.",
+		},
+	)
+	// Forwards that failed without a downstream response, by errorClass
+	proxyErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smee_proxy_errors_total",
+			Help: "Total number of forwards that failed without a downstream response, by error class (timeout, connrefused or other).",
+		},
+		[]string{"class"},
+	)
+	// Gauge metric to track forwards currently waiting on each downstream target.
+	inFlightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "smee_inflight_requests",
+			Help: "Number of forwarded requests currently in flight to the downstream service.",
+		},
+		[]string{"target"},
+	)
+	// Constant gauge exposing the build metadata as labels.
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "smee_build_info",
+			Help: "Build information of the running sidecar (always 1).",
+		},
+		[]string{"version", "commit", "build_date"},
+	)
+	// Histogram of forwarded webhook payload sizes, from 1KiB up to GitHub's 25MB cap
+	forwardedBytes = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "smee_forwarded_bytes",
+			Help:    "Size in bytes of regular event payloads forwarded by the sidecar.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 9),
+		},
+	)
+	// Buckets reach 10 minutes, since downstream pipelines may process an event
+	// for several minutes before answering
+	forwardDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "smee_forward_duration_seconds",
+			Help:    "Time in seconds for the downstream service to answer a forwarded regular event.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+		},
+		[]string{"target"},
+	)
+	// Set on every real event, so alerts can catch a silently broken upstream
+	// that synthetic health checks still pass
+	lastEventReceived = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_last_event_received_timestamp_seconds",
+			Help: "Unix time at which the last regular (non health check) event was received.",
+		},
+	)
+	oversizeRejections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_requests_rejected_oversize_total",
+			Help: "Total number of forwarded requests rejected for exceeding the maximum body size.",
+		},
+	)
+	contentTypeRejections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_events_rejected_content_type_total",
+			Help: "Total number of events rejected with 415 for a Content-Type outside FORWARD_ALLOWED_CONTENT_TYPES.",
+		},
+	)
+	dedupedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_events_deduped_total",
+			Help: "Total number of redelivered events dropped because their DEDUP_HEADER value was already seen.",
+		},
+	)
+	healthFileWriteFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_health_file_write_failures_total",
+			Help: "Total number of failed writes of the health status file read by the probe scripts.",
+		},
+	)
+	// Labeled by X-GitHub-Event, bucketed to eventTypeLabels
+	eventsByType = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smee_events_by_type_total",
+			Help: "Total number of events accepted for forwarding, by X-GitHub-Event (\"other\" for types outside EVENT_TYPE_LABELS).",
+		},
+		[]string{"event"},
+	)
+	forwardQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_forward_queue_depth",
+			Help: "Number of forwards waiting for a FORWARD_MAX_CONCURRENCY slot.",
+		},
+	)
+	rateLimitedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_events_rate_limited_total",
+			Help: "Total number of events rejected with 429 by the forward rate limiter.",
+		},
+	)
+	// Gauge metric to track the lightweight relay liveness probe.
+	relayLiveness = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_relay_liveness",
+			Help: "Indicates whether the relay liveness URL responded to the last probe (1 for alive, 0 for not).",
+		},
+	)
+	healthChecksSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_health_checks_skipped_total",
+			Help: "Total number of health check ticks skipped because the previous check was still in progress.",
+		},
+	)
+	healthCheckConsecutiveFailures = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_health_check_consecutive_failures",
+			Help: "Number of consecutive failed background health checks (0 after a success).",
+		},
+	)
+	lateHealthCheckArrivals = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_health_check_late_arrivals_total",
+			Help: "Total number of health check events that arrived after their check had already finished.",
+		},
+	)
+	orphanHealthChecks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_health_check_orphan_total",
+			Help: "Total number of health check events whose ID no check of this sidecar ever registered.",
+		},
+	)
+	durableQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_durable_queue_depth",
+			Help: "Number of events in the durable queue awaiting delivery.",
+		},
+	)
+	durableQueueBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_durable_queue_bytes",
+			Help: "Disk space used by the durable queue segment files.",
+		},
+	)
+	circuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "smee_circuit_breaker_state",
+			Help: "State of the downstream circuit breaker (0 closed, 1 open, 2 half-open).",
+		},
+		[]string{"target"},
+	)
+	// Gauge metric to track health checks still waiting for their round-trip.
+	pendingHealthChecks = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_pending_health_checks",
+			Help: "Number of health check IDs currently registered and awaiting their event.",
+		},
+	)
+	// Gauges tracking the two halves of a health check separately
+	smeeRoundTrip = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_roundtrip",
+			Help: "Indicates whether the last health check probe made the round-trip through the smee channel (1 for OK, 0 for failure).",
+		},
+	)
+	healthCheckPostStatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smee_health_check_post_status_total",
+			Help: "Total number of health check probes sent to the smee server, by the HTTP status code it answered with.",
+		},
+		[]string{"code"},
+	)
+	smeeSSEConnected = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_sse_connected",
+			Help: "Indicates whether SMEE_CLIENT_MODE is connected to the smee channel's event stream (1 for connected, 0 otherwise).",
+		},
+	)
+	smeeSSEReconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_sse_reconnects_total",
+			Help: "Total number of reconnection attempts to the smee channel's event stream in SMEE_CLIENT_MODE.",
+		},
+	)
+	smeeRelayReachable = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_relay_reachable",
+			Help: "Indicates whether the last health check probe got any HTTP response from the smee server, whether or not it made the round-trip (1 for OK, 0 for failure).",
+		},
+	)
+	downstreamReachable = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_downstream_reachable",
+			Help: "Indicates whether the downstream answered DOWNSTREAM_HEALTH_PATH with a 2xx during the last health check (1 for OK, 0 for failure).",
+		},
+	)
+	deadLettered = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smee_dead_lettered_total",
+			Help: "Total number of events handed to DEAD_LETTER_URL after their forward failed.",
+		},
+	)
+	drainingGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_draining",
+			Help: "Indicates whether the sidecar is draining and rejecting regular events (1 for draining, 0 otherwise).",
+		},
+	)
+	// Sampled periodically so stuck connection goroutines show up as unbounded growth
+	goroutineCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smee_goroutines",
+			Help: "Number of goroutines in the sidecar process, sampled every 15 seconds.",
+		},
 	)
 	// Gauge metric to track the health check status.
 	health_check = prometheus.NewGauge(
@@ -58,12 +356,189 @@ var (
 	// and the VALUE is a channel that the handler will wait on.
 	healthChecks = make(map[string]chan bool)
 	mutex        = &sync.Mutex{}
+	// Registration time of each health check ID, also guarded by mutex,
+	// so abandoned entries can be swept
+	healthCheckCreated = make(map[string]time.Time)
+	// Completion time of recently finished health check IDs, also guarded by
+	// mutex, to tell late loop-backs apart from orphaned IDs
+	finishedHealthChecks = make(map[string]time.Time)
 	// Global downstream service URL for per-request proxy creation
 	downstreamServiceURL string
+	downstreamMode       = downstreamModeProxy
+
+	// Health check settings shared by the background checker and on-demand checks
+	healthCheckEnabled        = true
+	healthCheckURL            string
+	healthCheckTimeoutSeconds = 20
+	// Header carrying the probe ID, by which forwardHandler recognizes health checks
+	healthCheckHeader = "X-Health-Check-ID"
+	// Also detect probes by their payload when healthCheckHeader is missing, for
+	// relays that drop custom headers
+	healthCheckBodyFallback bool
+	// Type string in the probe payload; only used for detection with
+	// healthCheckBodyFallback, otherwise purely cosmetic for downstream filters
+	healthCheckPayloadType = "health-check"
+	// Method of the probe request sent to the smee channel (POST or GET)
+	healthCheckMethod = http.MethodPost
+	// Response given to intercepted health check events, for relays that react to it
+	healthCheckResponseStatus = http.StatusOK
+	healthCheckResponseBody   string
+	// Downstream path that must answer 2xx for a health check to pass (disabled when empty)
+	downstreamHealthPath string
+	// "live" runs a round-trip per /healthz request, "cached" reports the last background result
+	healthzMode = "live"
+	// Body format of the probe endpoints: "text" or "json"
+	probeResponseFormat = "text"
+
+	// Whether /readyz holds off until a background health check has succeeded,
+	// and whether one ever has
+	readinessRequireFirstSuccess = true
+	healthCheckEverSucceeded     atomic.Bool
+	// Set via /admin/drain to turn away regular events while health checks keep flowing
+	draining atomic.Bool
+	// Set on SIGTERM so /readyz fails while the servers keep serving (lame duck)
+	shuttingDown atomic.Bool
+	// Unix nanoseconds of the background health checker's last tick (0 until it starts)
+	healthCheckerHeartbeat atomic.Int64
+	// Held by the background or an on-demand check while its round-trip is in
+	// flight, so two never overlap
+	healthCheckInProgress atomic.Bool
+	// Whether /livez fails once the heartbeat is older than livezMaxHeartbeatAge
+	livezCheckHeartbeat  bool
+	livezMaxHeartbeatAge time.Duration
+
+	// Result of the most recent background health check, nil until one completes
+	lastHealthStatus      *HealthStatus
+	lastHealthStatusMutex sync.RWMutex
+
+	// A run of identical health check failures is logged once and then every Nth time
+	healthCheckFailureLogEvery = 10
+
+	// Upper bound on how much of a health check response body is drained
+	healthCheckMaxResponseBytes int64 = 64 * 1024
+	// Upper bound on forwarded webhook bodies (GitHub caps payloads at 25MB)
+	maxRequestBodyBytes int64 = 25 * 1024 * 1024
+	// Deadline for a single forward, exempting the proxy path from the server WriteTimeout
+	forwardTimeout = 15 * time.Minute
+	// Whether trusted senders may extend the forward deadline via forwardTimeoutHeader,
+	// and the upper bound such an override is clamped to
+	forwardAllowTimeoutHeader bool
+	forwardMaxTimeout         = time.Hour
+	// Header carrying a stable per-event idempotency key on forwards (disabled when empty)
+	forwardIdempotencyHeader string
+	// Static headers set on every forward, replacing any the sender sent, keyed
+	// by canonical name (e.g. a token the downstream requires)
+	forwardExtraHeaders map[string]string
+	// Whether forwarded bodies are read into memory first, so proxy errors can be
+	// answered cleanly and requests replayed
+	bufferForwardBodies bool
+	// Whether the start of 4xx/5xx downstream response bodies is logged, and how
+	// many bytes of each
+	logErrorResponseBodies bool
+	errorBodyLogLimit      int64 = 4096
+	// Extra attempts for forwards failing with a connection error or 429/502/503/504,
+	// the initial backoff between them, and the longest Retry-After honored
+	forwardRetries      int
+	forwardRetryBackoff = 500 * time.Millisecond
+	maxRetryAfter       = time.Minute
+	// Media types regular events may carry, lowercased (nil allows any)
+	forwardAllowedContentTypes map[string]bool
+	// Whether gzip/deflate request bodies are decoded before forwarding
+	decompressRequests bool
+	// Leading path prefix removed from relayed requests before forwarding
+	relayStripPrefix string
+	// Path prefix removed from, then prefix prepended to, the path of each forward
+	forwardStripPrefix string
+	forwardPathPrefix  string
+	// Whether probe scripts already on the shared volume are left untouched, and the
+	// interpreter written into the shebang of the ones we write (embedded one when empty)
+	preserveExistingScripts bool
+	scriptShell             string
+	// Endpoint receiving forwards that failed for good, and the client used for it
+	// (dead-lettering is disabled when the URL is empty)
+	deadLetterURL    string
+	deadLetterClient *http.Client
+	// On-disk store of failed forwards replayed via /admin/replay (nil when disabled)
+	deadLetters *deadLetterStore
+	// Default bounds on a replay of the store: events in flight at once, and
+	// events started per second (unlimited when zero)
+	deadLetterReplayConcurrency = 1
+	deadLetterReplayRate        float64
+	// Age past which stored failed forwards are deleted unreplayed (kept when zero)
+	deadLetterMaxAge time.Duration
+	// Secrets GitHub may sign webhook bodies with, several during a rotation
+	// (verification is disabled when empty)
+	webhookHMACSecrets [][]byte
+	// Forward events with a bad signature instead of rejecting them (HMAC_MODE=log_only)
+	hmacLogOnly bool
+	// X-GitHub-Event values counted under their own label; the rest count as "other"
+	eventTypeLabels = map[string]bool{
+		"push": true, "pull_request": true, "pull_request_review": true, "issue_comment": true,
+		"issues": true, "check_run": true, "check_suite": true, "create": true, "delete": true,
+		"release": true, "workflow_run": true, "ping": true,
+	}
+	// Bound on simultaneous forwards (nil when unlimited)
+	forwardSlots *forwardSemaphore
+	// Settings of the breaker guarding synchronous forwards to each replica
+	// (disabled when the threshold is zero)
+	circuitBreakerThreshold int
+	circuitBreakerCooldown  time.Duration
+	// Header identifying each delivery, and the IDs seen recently (nil when dedup is disabled)
+	dedupHeader  = "X-GitHub-Delivery"
+	forwardDedup *dedupCache
+	// On-disk queue events are delivered from (nil when forwarding synchronously)
+	eventQueue *durableQueue
+	// Token bucket applied to forwarded events (nil when rate limiting is disabled)
+	forwardLimiter *rate.Limiter
+	// Ring buffer of recent forward metadata, served with pprof (nil when pprof is disabled)
+	recentEvents *ring[recentEvent]
+	// Ring buffer of recently forwarded bodies for debugging (nil when capture is disabled)
+	capturedBodies *ring[capturedBody]
+	// Fraction of forwards whose body is captured
+	debugCaptureSampleRate = 1.0
+	// Maximum bytes kept per captured body
+	debugCaptureMaxBytes int64 = 4096
+	// Lower-cased JSON field names whose values are redacted from captured bodies
+	debugCaptureRedactFields map[string]bool
+	// Whether forwards continue the incoming trace and are recorded as spans
+	tracingEnabled bool
+	// Connection pool limits for outgoing transports (0 means unlimited,
+	// except MaxIdleConnsPerHost where Go falls back to its default of 2)
+	maxIdleConns        = 10
+	maxIdleConnsPerHost = 2
+	maxConnsPerHost     = 10
+	// Age past which downstream connections are retired (0 keeps them until IdleConnTimeout)
+	maxConnLifetime time.Duration
+	// Maximum requests the management server handles at once (0 means unlimited)
+	mgmtMaxConcurrent int
+	// Which structured health_check_result events are emitted: "all", "changes" or none
+	healthCheckResultEvents string
+	// Destination of the structured health_check_result events
+	healthCheckResultWriter io.Writer = os.Stdout
+	// Per-process key signing health check IDs (nil when origin verification is disabled)
+	healthCheckSigningKey []byte
+	// Whether debug-level log lines are emitted
+	debugLogging bool
+	// User-Agent identifying the sidecar's own traffic
+	userAgent = "smee-sidecar/" + version
+	// Whether forwarded requests carry X-Forwarded-Proto with the relay's inbound scheme
+	forwardSetXFP bool
+	// Whether downstream transports negotiate HTTP/2 over TLS (HTTP/1.1 otherwise)
+	forwardHTTP2 bool
+	// Explicit egress proxy for outgoing requests, overriding HTTP_PROXY/HTTPS_PROXY
+	forwardProxyURL *url.URL
+	// Optional path of the compact signal file written alongside the status file
+	signalFilePath string
 
 	// Shared HTTP clients to prevent resource accumulation
 	healthCheckClient *http.Client
-	proxyInstance     *httputil.ReverseProxy
+	// Create the base transports of the downstream proxies and of the health
+	// check client; swappable so tests can instrument or fake outgoing requests
+	transportFactory            = func() http.RoundTripper { return createOptimizedTransport() }
+	healthCheckTransportFactory = func() http.RoundTripper { return createHealthCheckTransport() }
+	// One proxy per downstream replica, picked round-robin by proxyNext
+	proxyReplicas []*downstreamReplica
+	proxyNext     atomic.Uint64
 
 	// Thread-safe initialization
 	healthCheckOnce sync.Once
@@ -71,21 +546,220 @@ var (
 	proxyError      error
 )
 
+// Downstream modes: proxy to DOWNSTREAM_SERVICE_URL, or complete events locally
+// for deployments that only validate smee delivery and health checking
+const (
+	downstreamModeProxy   = "proxy"
+	downstreamModeEcho    = "echo"
+	downstreamModeDiscard = "discard"
+)
+
+// ServerTimeouts holds the timeouts applied to the relay and management servers
+type ServerTimeouts struct {
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
 type HealthCheckPayload struct {
 	Type string `json:"type"`
 	ID   string `json:"id"`
 }
 
+// outboundProxy routes outgoing requests through FORWARD_PROXY_URL when set,
+// otherwise through the standard HTTP_PROXY/HTTPS_PROXY/NO_PROXY variables
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	if forwardProxyURL != nil {
+		return forwardProxyURL, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// Host sent to a downstream reached over a unix socket, which has no host of its own
+const unixSocketHost = "localhost"
+
+// parseDownstreamURL resolves DOWNSTREAM_SERVICE_URL into the URL requests are
+// addressed to and, for the unix:///path/to.sock form, the socket they are
+// dialed on. The target label is the host, or the socket path for sockets.
+func parseDownstreamURL(raw string) (target *url.URL, socketPath string, err error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not parse downstream URL %s: %v", raw, err)
+	}
+	if parsed.Scheme != "unix" {
+		return parsed, "", nil
+	}
+	if parsed.Path == "" {
+		return nil, "", fmt.Errorf("downstream URL %s is missing a socket path", raw)
+	}
+	return &url.URL{Scheme: "http", Host: unixSocketHost}, parsed.Path, nil
+}
+
+// downstreamLabel names a downstream for metric labels and logs
+func downstreamLabel(target *url.URL, socketPath string) string {
+	if socketPath != "" {
+		return socketPath
+	}
+	return target.Host
+}
+
+// newDownstreamTransport creates the transport used for forwards, dialing
+// socketPath for every connection when set. A transportFactory that doesn't
+// return an *http.Transport is used as is.
+func newDownstreamTransport(socketPath string) http.RoundTripper {
+	base := transportFactory()
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		return base
+	}
+	// A custom TLS config turns off Go's automatic HTTP/2, so it has to be forced
+	transport.ForceAttemptHTTP2 = forwardHTTP2
+	if socketPath != "" {
+		dialer := &net.Dialer{}
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+	return transport
+}
+
+// limitConnLifetime retires the transport's connections once they are older
+// than lifetime, so pooled connections to a load-balanced downstream don't
+// stay pinned to the same backend after it scales up. Each connection is
+// closed on its own and only while idle: one idle at expiry is closed then,
+// and one busy at expiry as soon as its response hands it back to the pool,
+// so no forward is cut off. HTTP/2 connections multiplex forwards and are
+// left to IdleConnTimeout.
+func limitConnLifetime(transport http.RoundTripper, lifetime time.Duration) http.RoundTripper {
+	base, ok := transport.(*http.Transport)
+	if !ok || lifetime <= 0 {
+		return transport
+	}
+	dial := base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := &lifetimeConn{Conn: conn, expires: time.Now().Add(lifetime)}
+		c.timer = time.AfterFunc(lifetime, c.retireIfIdle)
+		return c, nil
+	}
+	return &lifetimeTransport{Transport: base}
+}
+
+// lifetimeConn is a downstream connection that closes itself once it has
+// expired and is idle
+type lifetimeConn struct {
+	net.Conn
+	expires time.Time
+	timer   *time.Timer
+
+	mu sync.Mutex
+	// Carrying a request, from the transport handing it out until it is
+	// back in the pool
+	busy bool
+	// Negotiated HTTP/2, whose concurrent streams make it never idle for sure
+	multiplexed bool
+}
+
+func (c *lifetimeConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// acquired marks the connection as carrying a request
+func (c *lifetimeConn) acquired(multiplexed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy = true
+	c.multiplexed = multiplexed
+}
+
+// released marks the connection idle again, retiring it if it has expired
+func (c *lifetimeConn) released() {
+	c.mu.Lock()
+	c.busy = false
+	c.mu.Unlock()
+	if !time.Now().Before(c.expires) {
+		c.retireIfIdle()
+	}
+}
+
+// retireIfIdle closes the connection unless it is carrying a request. The
+// transport notices the close and drops the connection from its pool.
+func (c *lifetimeConn) retireIfIdle() {
+	c.mu.Lock()
+	idle := !c.busy && !c.multiplexed
+	c.mu.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+// lifetimeTransport tracks when each connection is carrying a request, so
+// lifetimeConn only retires idle ones
+type lifetimeTransport struct {
+	*http.Transport
+}
+
+func (t *lifetimeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *lifetimeConn
+	clientTrace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := info.Conn
+			multiplexed := false
+			if tlsConn, ok := c.(*tls.Conn); ok {
+				multiplexed = tlsConn.ConnectionState().NegotiatedProtocol == "h2"
+				c = tlsConn.NetConn()
+			}
+			if conn, _ = c.(*lifetimeConn); conn != nil {
+				conn.acquired(multiplexed)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil && conn != nil {
+				conn.released()
+			}
+		},
+	}
+	return t.Transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace)))
+}
+
+// createHealthCheckTransport creates the health check client's transport. Health
+// checks are a trickle of requests to the relay and the downstreams, so it keeps
+// a single idle connection per host whatever the downstream pool is tuned to.
+func createHealthCheckTransport() *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: "true" == os.Getenv("INSECURE_SKIP_VERIFY"),
+		},
+		Proxy:                 outboundProxy,
+		MaxIdleConns:          4,
+		MaxIdleConnsPerHost:   1,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		// The check's own deadline bounds the wait for the relay's answer
+		ResponseHeaderTimeout: 0,
+	}
+}
+
 // createOptimizedTransport creates a transport with proper resource limits
 func createOptimizedTransport() *http.Transport {
 	return &http.Transport{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: "true" == os.Getenv("INSECURE_SKIP_VERIFY"),
 		},
+		Proxy:                 outboundProxy,
 		DisableKeepAlives:     false,
-		MaxIdleConns:          10,
-		MaxIdleConnsPerHost:   2,
-		MaxConnsPerHost:       10,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       maxConnsPerHost,
 		IdleConnTimeout:       90 * time.Second,
 		ResponseHeaderTimeout: 30 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
@@ -93,235 +767,2341 @@ func createOptimizedTransport() *http.Transport {
 	}
 }
 
-// getHealthCheckClient returns the shared health check client, creating it lazily if needed
-func getHealthCheckClient() *http.Client {
-	healthCheckOnce.Do(func() {
-		healthCheckClient = &http.Client{
-			Transport: createOptimizedTransport(),
-			Timeout:   30 * time.Second,
-		}
-	})
-	return healthCheckClient
+// debugf logs only when LOG_LEVEL=debug
+func debugf(format string, args ...any) {
+	if debugLogging {
+		log.Printf("DEBUG: "+format, args...)
+	}
 }
 
-// getProxyInstance returns the shared proxy instance, creating it lazily if needed
-func getProxyInstance() (*httputil.ReverseProxy, error) {
-	proxyOnce.Do(func() {
-		parsedURL, err := url.Parse(downstreamServiceURL)
-		if err != nil {
-			proxyError = fmt.Errorf("could not parse downstream URL %s: %v", downstreamServiceURL, err)
-			return
-		}
-		proxyInstance = httputil.NewSingleHostReverseProxy(parsedURL)
-		proxyInstance.Transport = createOptimizedTransport()
-	})
-	return proxyInstance, proxyError
+// resetMetrics zeroes the relayed events counters by dropping every labeled
+// series, since Prometheus counters can't be decremented
+func resetMetrics() {
+	forwardAttempts.Reset()
+	forwardDeliveries.Reset()
 }
 
-// forwardHandler needs to find the correct channel to signal success.
-func forwardHandler(w http.ResponseWriter, r *http.Request) {
-	// Check for health check header first (fast path)
-	if healthCheckID := r.Header.Get("X-Health-Check-ID"); healthCheckID != "" {
-		// Always drain request body to prevent connection reuse issues
-		_, _ = io.Copy(io.Discard, r.Body)
-
-		// Force connection closure for health checks to prevent connection pooling
-		w.Header().Set("Connection", "close")
-
-		mutex.Lock()
-		resultChan, exists := healthChecks[healthCheckID]
-		mutex.Unlock()
-
-		if exists {
-			// Signal that we received the health check event
-			select {
-			case resultChan <- true:
-			default:
-				// Channel is full or closed, ignore
-			}
+// registerMetric registers a collector without panicking on conflicts. If an
+// identical collector is already registered it is reused; any other
+// registration error is logged and the metric is left unregistered, so the
+// sidecar keeps running without it.
+func registerMetric[T prometheus.Collector](registerer prometheus.Registerer, collector T) T {
+	err := registerer.Register(collector)
+	if err == nil {
+		return collector
+	}
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		if existing, ok := alreadyRegistered.ExistingCollector.(T); ok {
+			return existing
 		}
-
-		w.WriteHeader(http.StatusOK)
-		return
 	}
+	log.Printf("WARNING: Failed to register metric, continuing without it: %v", err)
+	return collector
+}
 
-	// Forward real webhook events directly - no need to read body into memory
-
-	// Use the shared proxy instance
-	proxy, err := getProxyInstance()
-	if err != nil {
-		http.Error(w, "internal server error: failed to create proxy", http.StatusInternalServerError)
-		return
+// getEnvInt returns the positive integer value of an environment variable,
+// falling back to defaultValue when unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	if valStr := os.Getenv(key); valStr != "" {
+		if val, err := strconv.Atoi(valStr); err == nil && val > 0 {
+			return val
+		}
 	}
+	return defaultValue
+}
 
-	// Only count actual forwarding attempts (after successful proxy creation)
-	forwardAttempts.Inc()
-	proxy.ServeHTTP(w, r)
+// getEnvNonNegativeInt returns the value of an environment variable that may
+// legitimately be 0, failing on negative or malformed values
+func getEnvNonNegativeInt(key string, defaultValue int) (int, error) {
+	valStr := os.Getenv(key)
+	if valStr == "" {
+		return defaultValue, nil
+	}
+	val, err := strconv.Atoi(valStr)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a non-negative integer", key, valStr)
+	}
+	return val, nil
 }
 
-// writeScriptsToVolume writes the embedded probe scripts to the shared volume
-func writeScriptsToVolume(sharedPath string) error {
-	scripts := map[string][]byte{
-		"check-smee-health.sh":    smeeHealthScript,
-		"check-sidecar-health.sh": sidecarHealthScript,
-		"check-file-age.sh":       fileAgeScript,
+// drainBounded discards at most limit bytes from r and reports whether more
+// data was available beyond the limit
+func drainBounded(r io.Reader, limit int64) (int64, bool) {
+	n, _ := io.Copy(io.Discard, io.LimitReader(r, limit+1))
+	if n > limit {
+		return limit, true
 	}
+	return n, false
+}
 
-	for filename, content := range scripts {
-		scriptPath := filepath.Join(sharedPath, filename)
+// getHealthCheckClient returns the shared health check client, creating it lazily if needed.
+// It sets no timeouts of its own: every health check request carries a context
+// deadline derived from HEALTH_CHECK_TIMEOUT_SECONDS, which must be the only limit
+// so a slow POST is reported as a timeout rather than a failed POST.
+func getHealthCheckClient() *http.Client {
+	healthCheckOnce.Do(func() {
+		healthCheckClient = &http.Client{Transport: healthCheckTransportFactory()}
+	})
+	return healthCheckClient
+}
 
-		// Check if file exists and make it writable before overwriting
-		// This handles container restarts where the volume persists with read-only files
-		if _, err := os.Stat(scriptPath); err == nil {
-			if err := os.Chmod(scriptPath, 0755); err != nil {
-				return fmt.Errorf("failed to make %s writable: %v", filename, err)
-			}
-		}
+// downstreamReplica is one of the identical downstreams events are spread across
+type downstreamReplica struct {
+	proxy *httputil.ReverseProxy
+	// Host (or socket path) of the replica, used as the "target" metric label
+	target string
+	// Fast-fails forwards while this replica keeps failing (nil when disabled)
+	breaker *circuitBreaker
+}
 
-		if err := os.WriteFile(scriptPath, content, 0755); err != nil {
-			return fmt.Errorf("failed to write %s: %v", filename, err)
+// newDownstreamReplica creates the reverse proxy forwarding to one downstream URL
+func newDownstreamReplica(rawURL string) (*downstreamReplica, error) {
+	parsedURL, socketPath, err := parseDownstreamURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(parsedURL)
+	proxy.Transport = newDownstreamTransport(socketPath)
+	proxy.Transport = limitConnLifetime(proxy.Transport, maxConnLifetime)
+	if forwardRetries > 0 {
+		proxy.Transport = newRetryTransport(proxy.Transport, forwardRetries, maxRetryAfter)
+	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		rewriteForwardPath(req.URL)
+		director(req)
+		if body, ok := req.Body.(*trailerForwardingBody); ok {
+			body.to = req.Trailer
 		}
-
-		// Make script read-only to prevent accidental modification
-		if err := os.Chmod(scriptPath, 0555); err != nil {
-			return fmt.Errorf("failed to make %s read-only: %v", filename, err)
+		// Every forward identifies the sidecar, replacing the sender's User-Agent
+		req.Header.Set("User-Agent", userAgent)
+		if forwardSetXFP {
+			req.Header.Set("X-Forwarded-Proto", requestScheme(req))
 		}
-
-		log.Printf("Wrote read-only probe script: %s", scriptPath)
+		applyExtraHeaders(req.Header)
 	}
-	return nil
+	proxy.ErrorHandler = proxyErrorHandler
+	if logErrorResponseBodies {
+		proxy.ModifyResponse = logErrorResponse
+	}
+	replica := &downstreamReplica{proxy: proxy, target: downstreamLabel(parsedURL, socketPath)}
+	if circuitBreakerThreshold > 0 {
+		replica.breaker = newCircuitBreaker(replica.target, circuitBreakerThreshold, circuitBreakerCooldown)
+	}
+	return replica, nil
 }
 
-// writeHealthStatus writes health status to file atomically
-func writeHealthStatus(status *HealthStatus, filePath string) error {
+// parseExtraHeaders parses FORWARD_EXTRA_HEADERS, either a JSON object of
+// header names to values or a comma-separated list of name=value pairs
+func parseExtraHeaders(raw string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if raw = strings.TrimSpace(raw); strings.HasPrefix(raw, "{") {
+		if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+			return nil, fmt.Errorf("invalid FORWARD_EXTRA_HEADERS JSON: %v", err)
+		}
+	} else {
+		for _, pair := range strings.Split(raw, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid FORWARD_EXTRA_HEADERS entry %q, expected name=value", pair)
+			}
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+
+	canonical := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid FORWARD_EXTRA_HEADERS header %q", name)
+		}
+		canonical[http.CanonicalHeaderKey(name)] = value
+	}
+	return canonical, nil
+}
+
+// applyExtraHeaders sets forwardExtraHeaders on an outgoing forward
+func applyExtraHeaders(header http.Header) {
+	for name, value := range forwardExtraHeaders {
+		header.Set(name, value)
+	}
+}
+
+// splitDownstreamURLs splits DOWNSTREAM_SERVICE_URL into its comma-separated replicas
+func splitDownstreamURLs(raw string) []string {
+	var urls []string
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			urls = append(urls, entry)
+		}
+	}
+	return urls
+}
+
+// errCircuitOpen is returned while the breakers of all replicas are open
+var errCircuitOpen = errors.New("downstream unavailable: circuit breaker open")
+
+// getProxyInstance returns the next downstream replica in round-robin order,
+// creating the shared proxies lazily if needed
+func getProxyInstance() (*downstreamReplica, error) {
+	proxyOnce.Do(func() {
+		for _, rawURL := range splitDownstreamURLs(downstreamServiceURL) {
+			replica, err := newDownstreamReplica(rawURL)
+			if err != nil {
+				proxyError = err
+				return
+			}
+			proxyReplicas = append(proxyReplicas, replica)
+		}
+		if len(proxyReplicas) == 0 {
+			proxyError = errors.New("no downstream URL configured")
+		}
+	})
+	if proxyError != nil {
+		return nil, proxyError
+	}
+	// Round-robin, skipping replicas whose breaker is open. The returned
+	// replica's breaker has allowed the forward, which must record or release it.
+	count := uint64(len(proxyReplicas))
+	start := proxyNext.Add(1) - 1
+	for i := range count {
+		replica := proxyReplicas[(start+i)%count]
+		if replica.breaker == nil || replica.breaker.allow() {
+			return replica, nil
+		}
+	}
+	return nil, errCircuitOpen
+}
+
+// forwardTimeoutHeader lets a trusted sender request a longer forward deadline (in seconds)
+const forwardTimeoutHeader = "X-Smee-Forward-Timeout"
+
+// effectiveForwardTimeout returns the forward deadline for a request, honoring
+// a valid timeout header when allowed and clamping it to forwardMaxTimeout
+func effectiveForwardTimeout(r *http.Request) time.Duration {
+	if !forwardAllowTimeoutHeader {
+		return forwardTimeout
+	}
+	val, err := strconv.Atoi(r.Header.Get(forwardTimeoutHeader))
+	if err != nil || val <= 0 {
+		return forwardTimeout
+	}
+	requested := time.Duration(val) * time.Second
+	if requested > forwardMaxTimeout {
+		return forwardMaxTimeout
+	}
+	return requested
+}
+
+// replaceBody swaps the request body for an in-memory copy that the
+// transport can replay through GetBody
+func replaceBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// correlationIDKey carries a buffered forward's correlation ID in its context
+type correlationIDKey struct{}
+
+// idempotencyKey returns a stable key for the logical event so the downstream
+// can deduplicate redeliveries: the GitHub delivery ID when present, otherwise
+// a SHA-256 of the body (which is buffered and replaced for forwarding)
+func idempotencyKey(r *http.Request) (string, error) {
+	if deliveryID := r.Header.Get("X-GitHub-Delivery"); deliveryID != "" {
+		return deliveryID, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	replaceBody(r, body)
+
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// trackInFlight increments the in-flight gauge for target and returns the
+// matching decrement; deferring it keeps the gauge accurate even if the
+// forward panics (e.g. http.ErrAbortHandler from the reverse proxy)
+func trackInFlight(target string) func() {
+	gauge := inFlightRequests.WithLabelValues(target)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// statusRecorder captures the status code written by the reverse proxy
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// setupTracing installs an OTLP/HTTP tracer provider and the W3C propagators.
+// The exporter honors the standard OTEL_EXPORTER_OTLP_* environment variables.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "smee-sidecar")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return provider.Shutdown, nil
+}
+
+// startForwardSpan continues the trace carried by the incoming request and
+// injects the new span's context into the headers that will be forwarded
+func startForwardSpan(r *http.Request, target string) (*http.Request, trace.Span) {
+	propagator := otel.GetTextMapPropagator()
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer("github.com/konflux-ci/smee-sidecar").Start(ctx, "smee.forward",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("server.address", target),
+		),
+	)
+	propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+	return r.WithContext(ctx), span
+}
+
+// endForwardSpan records the forward outcome on the span and ends it
+func endForwardSpan(span trace.Span, status int, start time.Time) {
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", status),
+		attribute.Int64("smee.forward.duration_ms", time.Since(start).Milliseconds()),
+	)
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// capturedBody is a forwarded request body kept for debugging
+type capturedBody struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	ContentType string    `json:"contentType"`
+	Body        string    `json:"body"`
+	Truncated   bool      `json:"truncated"`
+}
+
+// ring keeps the last N entries added, overwriting the oldest
+type ring[T any] struct {
+	mu      sync.Mutex
+	entries []T
+	next    int
+	count   int
+}
+
+func newRing[T any](size int) *ring[T] {
+	return &ring[T]{entries: make([]T, size)}
+}
+
+func (b *ring[T]) add(entry T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.count < len(b.entries) {
+		b.count++
+	}
+}
+
+// snapshot returns the entries, oldest first
+func (b *ring[T]) snapshot() []T {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := make([]T, 0, b.count)
+	start := (b.next - b.count + len(b.entries)) % len(b.entries)
+	for i := 0; i < b.count; i++ {
+		result = append(result, b.entries[(start+i)%len(b.entries)])
+	}
+	return result
+}
+
+// recentEvent is the metadata of a forward kept for /debug/recent-events.
+// Bodies are never kept, so the tap can't leak payload secrets.
+type recentEvent struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Event      string    `json:"event,omitempty"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// bodyCapture tees the first debugCaptureMaxBytes of a request body as the
+// proxy streams it, so capture never buffers the whole body
+type bodyCapture struct {
+	io.ReadCloser
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+	entry     capturedBody
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if remaining := debugCaptureMaxBytes - int64(c.buf.Len()); remaining < int64(n) {
+		c.buf.Write(p[:max(remaining, 0)])
+		c.truncated = true
+	} else {
+		c.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// record stores whatever was read of the body in the ring buffer
+func (c *bodyCapture) record() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry.Body = redactBody(c.buf.Bytes(), c.truncated)
+	c.entry.Truncated = c.truncated
+	capturedBodies.add(c.entry)
+}
+
+// startBodyCapture wraps the request body for capture when capture is
+// enabled and the request is sampled, returning nil otherwise
+func startBodyCapture(r *http.Request) *bodyCapture {
+	if capturedBodies == nil || mathrand.Float64() >= debugCaptureSampleRate {
+		return nil
+	}
+	capture := &bodyCapture{
+		ReadCloser: r.Body,
+		entry: capturedBody{
+			Time:        time.Now(),
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			ContentType: r.Header.Get("Content-Type"),
+		},
+	}
+	r.Body = capture
+	return capture
+}
+
+// redactBody replaces the values of the configured sensitive fields in a
+// JSON body. Bodies that can't be redacted reliably are withheld entirely.
+func redactBody(body []byte, truncated bool) string {
+	if len(debugCaptureRedactFields) == 0 {
+		return string(body)
+	}
+	if truncated {
+		return "[withheld: body truncated before redaction]"
+	}
+	var document any
+	if err := json.Unmarshal(body, &document); err != nil {
+		return "[withheld: body is not JSON and cannot be redacted]"
+	}
+	redacted, _ := json.Marshal(redactValue(document))
+	return string(redacted)
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if debugCaptureRedactFields[strings.ToLower(key)] {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
+
+// countingReadCloser counts the bytes read through it
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// trailerForwardingBody copies an inbound request's trailers onto its forward
+// once the body has been read to the end. The proxy clones the trailer map
+// before any of the body is read, so without this the values a chunked sender
+// appends after the body would never reach the downstream.
+type trailerForwardingBody struct {
+	io.ReadCloser
+	from http.Header
+	// The forward's trailer map, set by the proxy Director
+	to http.Header
+}
+
+func (b *trailerForwardingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && b.to != nil {
+		for key, values := range b.from {
+			b.to[key] = values
+		}
+	}
+	return n, err
+}
+
+// stripRelayPrefix removes relayStripPrefix from the request path
+func stripRelayPrefix(r *http.Request) {
+	stripPathPrefix(r.URL, relayStripPrefix)
+}
+
+// stripPathPrefix removes prefix from the URL path, matching whole path
+// segments only so "/team" doesn't strip "/teams/..."
+func stripPathPrefix(u *url.URL, prefix string) {
+	if prefix == "" {
+		return
+	}
+	path := u.Path
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return
+	}
+	u.Path = "/" + strings.TrimPrefix(path[len(prefix):], "/")
+	if u.RawPath != "" {
+		u.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(u.RawPath, prefix), "/")
+	}
+}
+
+// joinURLPath appends the path of ref to the base path of the downstream URL
+// with a single slash between them, keeping escaped segments intact. It
+// mirrors how httputil.NewSingleHostReverseProxy joins paths, so queued
+// deliveries land on the same downstream path as synchronous forwards.
+func joinURLPath(base, ref *url.URL) (path, rawPath string) {
+	if base.RawPath == "" && ref.RawPath == "" {
+		return singleJoiningSlash(base.Path, ref.Path), ""
+	}
+	return singleJoiningSlash(base.Path, ref.Path), singleJoiningSlash(base.EscapedPath(), ref.EscapedPath())
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// rewriteForwardPath applies forwardStripPrefix and then forwardPathPrefix to
+// the path of an outgoing forward, ahead of the downstream URL's own base path
+func rewriteForwardPath(u *url.URL) {
+	stripPathPrefix(u, forwardStripPrefix)
+	if forwardPathPrefix == "" {
+		return
+	}
+	// The root maps onto the prefix itself rather than the prefix plus a slash
+	if u.Path == "" || u.Path == "/" {
+		u.Path, u.RawPath = forwardPathPrefix, ""
+		return
+	}
+	if u.RawPath != "" {
+		u.RawPath = (&url.URL{Path: forwardPathPrefix}).EscapedPath() + u.RawPath
+	}
+	u.Path = forwardPathPrefix + u.Path
+}
+
+var errDecompressedTooLarge = errors.New("decompressed body too large")
+
+// decompressRequestBody decodes a gzip or deflate encoded body in place so
+// downstream features see the plain payload, bounding the decoded size by
+// maxRequestBodyBytes. Other encodings are forwarded untouched.
+func decompressRequestBody(r *http.Request) error {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding != "gzip" && encoding != "x-gzip" && encoding != "deflate" {
+		return nil
+	}
+
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	var decoder io.Reader
+	switch encoding {
+	case "deflate":
+		// HTTP deflate is zlib-wrapped, but some senders use raw deflate
+		if zr, err := zlib.NewReader(bytes.NewReader(compressed)); err == nil {
+			decoder = zr
+		} else {
+			decoder = flate.NewReader(bytes.NewReader(compressed))
+		}
+	default:
+		gr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return fmt.Errorf("invalid gzip data: %w", err)
+		}
+		decoder = gr
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(decoder, maxRequestBodyBytes+1))
+	if err != nil {
+		return fmt.Errorf("invalid %s data: %w", encoding, err)
+	}
+	if int64(len(decoded)) > maxRequestBodyBytes {
+		return errDecompressedTooLarge
+	}
+
+	replaceBody(r, decoded)
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	return nil
+}
+
+// requestScheme returns the scheme the relay received the request on
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// proxyErrorResponse is the JSON body answered for a failed forward
+type proxyErrorResponse struct {
+	Error         string `json:"error"`
+	CorrelationID string `json:"correlationId"`
+}
+
+// proxyErrorHandler answers a forward that got no downstream response with a
+// 502 (504 on timeout) and a JSON body carrying a correlation ID the caller
+// can match against the logs. Bodies exceeding the size limit while streaming
+// are reported as 413 instead.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		rejectOversizeRequest(w)
+		return
+	}
+	status := http.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	if forwardErr, ok := r.Context().Value(forwardErrorKey{}).(*error); ok {
+		*forwardErr = err
+	}
+	proxyErrors.WithLabelValues(errorClass(err)).Inc()
+
+	// Only buffered or logged forwards carry an ID already
+	id, ok := r.Context().Value(correlationIDKey{}).(string)
+	if !ok {
+		id = uuid.New().String()
+	}
+	log.Printf("http: proxy error (correlation ID %s): %v", id, err)
+	w.Header().Set("X-Smee-Correlation-ID", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(proxyErrorResponse{Error: "forward to downstream failed", CorrelationID: id}); err != nil {
+		log.Printf("Failed to encode proxy error response: %v", err)
+	}
+}
+
+// errorClass buckets a forward error into a bounded metric label
+func errorClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connrefused"
+	}
+	return "other"
+}
+
+// logErrorResponse is the proxy's ModifyResponse hook: it logs the start of
+// any 4xx/5xx body from the downstream along with the forward's correlation
+// ID, then hands the full body on to the caller
+func logErrorResponse(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, errorBodyLogLimit+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	if err != nil {
+		return err
+	}
+
+	truncated := ""
+	if int64(len(head)) > errorBodyLogLimit {
+		head, truncated = head[:errorBodyLogLimit], " (truncated)"
+	}
+	id, _ := resp.Request.Context().Value(correlationIDKey{}).(string)
+	resp.Header.Set("X-Smee-Correlation-ID", id)
+	log.Printf("Downstream returned status %d (correlation ID %s): %q%s", resp.StatusCode, id, head, truncated)
+	return nil
+}
+
+// eventTypeLabel buckets an X-GitHub-Event value into a bounded metric label
+func eventTypeLabel(eventType string) string {
+	if eventTypeLabels[eventType] {
+		return eventType
+	}
+	return "other"
+}
+
+// allowedContentType reports whether a Content-Type header's media type is in
+// forwardAllowedContentTypes, ignoring parameters such as charset
+func allowedContentType(header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	return forwardAllowedContentTypes[mediaType]
+}
+
+// rejectOversizeRequest responds with 413 and records the rejection
+func rejectOversizeRequest(w http.ResponseWriter) {
+	oversizeRejections.Inc()
+	http.Error(w, fmt.Sprintf("request body exceeds %d bytes", maxRequestBodyBytes), http.StatusRequestEntityTooLarge)
+}
+
+// newServer creates an HTTP server with the given timeouts applied
+func newServer(addr string, handler http.Handler, timeouts ServerTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+	}
+}
+
+// Path prefix the management endpoints are served under in SINGLE_PORT_MODE
+const singlePortMgmtPrefix = "/management"
+
+// newSinglePortHandler serves the management endpoints under
+// singlePortMgmtPrefix (e.g. /management/metrics, /management/debug/pprof/)
+// and relays everything else
+func newSinglePortHandler(relay, mgmt http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", relay)
+	mux.Handle(singlePortMgmtPrefix+"/", http.StripPrefix(singlePortMgmtPrefix, mgmt))
+	return mux
+}
+
+// Longest the servers get to finish in-flight requests once they stop accepting new ones
+const shutdownTimeout = 20 * time.Second
+
+// lameDuckShutdown fails /readyz while the servers keep serving for
+// preShutdown, so the endpoint controller stops routing traffic here before
+// the listeners close, then shuts the servers down gracefully. sleep waits out
+// preShutdown (time.Sleep outside tests).
+func lameDuckShutdown(servers []*http.Server, preShutdown time.Duration, sleep func(time.Duration)) {
+	shuttingDown.Store(true)
+	log.Printf("Shutdown requested: failing /readyz and serving for %s more (PRESHUTDOWN_SECONDS)", preShutdown)
+	sleep(preShutdown)
+
+	log.Printf("Closing servers, waiting up to %s for in-flight requests", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("WARNING: Server on %s did not shut down cleanly: %v", server.Addr, err)
+		}
+	}
+	log.Printf("Shutdown complete")
+}
+
+// parseListenAddr splits a listen address of the form tcp://host:port,
+// unix:///path/to.sock or a bare host:port into a network and address for net.Listen
+func parseListenAddr(addr string) (network, address string, err error) {
+	network, address = "tcp", addr
+	if scheme, rest, found := strings.Cut(addr, "://"); found {
+		network, address = scheme, rest
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid listen address %q: %v", addr, err)
+		}
+	case "unix":
+		if address == "" {
+			return "", "", fmt.Errorf("invalid listen address %q: missing socket path", addr)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid listen address %q: unsupported network %q", addr, network)
+	}
+	return network, address, nil
+}
+
+// listen opens a listener for a listen address as accepted by parseListenAddr,
+// replacing a socket left behind by a previous run on the same volume
+func listen(addr string) (net.Listener, error) {
+	network, address, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return nil, fmt.Errorf("failed to remove stale socket %s: %v", address, err)
+			}
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// waitForDownstream blocks until a TCP connection to the downstream host can be
+// established, retrying every retryInterval until timeout elapses
+func waitForDownstream(ctx context.Context, downstreamURL string, timeout, retryInterval time.Duration) error {
+	parsedURL, socketPath, err := parseDownstreamURL(downstreamURL)
+	if err != nil {
+		return err
+	}
+	network, address := "tcp", parsedURL.Host
+	if socketPath != "" {
+		network, address = "unix", socketPath
+	} else if parsedURL.Port() == "" {
+		port := "80"
+		if parsedURL.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(parsedURL.Hostname(), port)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	for attempt := 1; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err == nil {
+			conn.Close()
+			log.Printf("Downstream %s is reachable after %d attempt(s)", address, attempt)
+			return nil
+		}
+		log.Printf("Waiting for downstream %s to become reachable (attempt %d): %v", address, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("downstream %s not reachable within %s: %v", address, timeout, err)
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// warmUpDownstream polls downstreamHealthPath on every downstream replica until
+// they all answer 2xx, retrying every retryInterval until timeout elapses
+func warmUpDownstream(ctx context.Context, timeout, retryInterval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		var err error
+		for _, rawURL := range splitDownstreamURLs(downstreamServiceURL) {
+			if err = checkReplicaHealth(ctx, rawURL); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			log.Printf("Downstream answered %s after %d attempt(s)", downstreamHealthPath, attempt)
+			return nil
+		}
+		log.Printf("Waiting for downstream to warm up (attempt %d): %v", attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("downstream did not answer %s within %s: %v", downstreamHealthPath, timeout, err)
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// waitStartupDelay holds off serving traffic for delay so sibling containers
+// (e.g. the smee client) can come up first, returning early with an error
+// when ctx is canceled
+func waitStartupDelay(ctx context.Context, delay time.Duration) error {
+	log.Printf("Waiting %s before serving traffic (STARTUP_DELAY_SECONDS)", delay)
+	if err := sleepContext(ctx, delay); err != nil {
+		return fmt.Errorf("startup delay interrupted: %w", err)
+	}
+	log.Printf("Startup delay elapsed")
+	return nil
+}
+
+// handleLocally completes a webhook event without a downstream service, either
+// echoing the body back (echo mode) or acknowledging and dropping it (discard mode)
+func handleLocally(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			rejectOversizeRequest(w)
+			return
+		}
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	forwardAttempts.WithLabelValues(downstreamMode).Inc()
+	forwardDeliveries.WithLabelValues(downstreamMode).Inc()
+	if downstreamMode == downstreamModeEcho {
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateDownstreamConfig checks the downstream mode and that a downstream
+// URL is provided whenever events are actually proxied
+func validateDownstreamConfig(mode, downstreamURL string) error {
+	switch mode {
+	case downstreamModeProxy:
+		replicas := splitDownstreamURLs(downstreamURL)
+		if len(replicas) == 0 {
+			return errors.New("DOWNSTREAM_SERVICE_URL environment variable must be set")
+		}
+		// The host becomes the "target" metric label, so it must be known up front
+		for _, replica := range replicas {
+			parsed, err := url.Parse(replica)
+			if err == nil && parsed.Scheme == "unix" {
+				if parsed.Path == "" {
+					return fmt.Errorf("DOWNSTREAM_SERVICE_URL must name a socket path, got %q", replica)
+				}
+			} else if err != nil || parsed.Host == "" {
+				return fmt.Errorf("DOWNSTREAM_SERVICE_URL must be an absolute URL with a host, got %q", replica)
+			}
+		}
+	case downstreamModeEcho, downstreamModeDiscard:
+	default:
+		return fmt.Errorf("DOWNSTREAM_MODE must be one of %q, %q or %q, got %q",
+			downstreamModeProxy, downstreamModeEcho, downstreamModeDiscard, mode)
+	}
+	return nil
+}
+
+// validateHealthCheckTiming ensures a health check always times out before the
+// next one is due, so checks never overlap
+func validateHealthCheckTiming(intervalSeconds, timeoutSeconds int) error {
+	if timeoutSeconds >= intervalSeconds {
+		return fmt.Errorf("HEALTH_CHECK_TIMEOUT_SECONDS (%d) must be less than HEALTH_CHECK_INTERVAL_SECONDS (%d)",
+			timeoutSeconds, intervalSeconds)
+	}
+	return nil
+}
+
+// forwardHandler needs to find the correct channel to signal success.
+func forwardHandler(w http.ResponseWriter, r *http.Request) {
+	// Check for health check header first (fast path)
+	healthCheckID := r.Header.Get(healthCheckHeader)
+	if healthCheckID == "" && healthCheckBodyFallback {
+		healthCheckID = peekHealthCheckID(r)
+	}
+	if healthCheckID != "" && !validHealthCheckOrigin(r, healthCheckID) {
+		// Not one of our probes; deliver it like any other event rather than
+		// letting it turn the health check green
+		log.Printf("WARNING: Health check event %s failed origin verification, forwarding as a regular event", healthCheckID)
+		healthCheckID = ""
+	}
+	if healthCheckID != "" {
+		// Always drain request body to prevent connection reuse issues
+		_, _ = io.Copy(io.Discard, r.Body)
+
+		// Force connection closure for health checks to prevent connection pooling
+		w.Header().Set("Connection", "close")
+
+		mutex.Lock()
+		resultChan, exists := healthChecks[healthCheckID]
+		_, finished := finishedHealthChecks[healthCheckID]
+		mutex.Unlock()
+
+		if exists {
+			// Signal that we received the health check event
+			select {
+			case resultChan <- true:
+			default:
+				// Channel is full or closed, ignore
+			}
+		} else if finished {
+			// The check already gave up on this event; a rising count suggests
+			// HEALTH_CHECK_TIMEOUT_SECONDS is too short
+			lateHealthCheckArrivals.Inc()
+			debugf("Health check event %s arrived after its check finished", healthCheckID)
+		} else {
+			// Not a probe we know of: a restarted or crashed checker, another
+			// sidecar's probe on a shared channel, or a relay redelivering long after
+			orphanHealthChecks.Inc()
+			debugf("Health check event %s matches no registered health check", healthCheckID)
+		}
+
+		w.WriteHeader(healthCheckResponseStatus)
+		if healthCheckResponseBody != "" {
+			_, _ = io.WriteString(w, healthCheckResponseBody)
+		}
+		return
+	}
+	lastEventReceived.SetToCurrentTime()
+
+	if draining.Load() {
+		http.Error(w, "sidecar is draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	if forwardAllowedContentTypes != nil && !allowedContentType(r.Header.Get("Content-Type")) {
+		contentTypeRejections.Inc()
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Verified before dedup, so a forged event can't suppress the real delivery
+	if len(webhookHMACSecrets) > 0 && !verifyWebhookSignature(w, r) {
+		return
+	}
+
+	// Redeliveries are acknowledged without being forwarded again
+	if forwardDedup != nil && !isDeadLetterReplay(r) {
+		if id := r.Header.Get(dedupHeader); id != "" {
+			if forwardDedup.seen(id) {
+				dedupedEvents.Inc()
+				debugf("Dropping duplicate delivery %s", id)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			// Only a delivered event is a duplicate next time; after a failed
+			// forward the sender's redelivery must go through
+			dedupRecorder := &statusRecorder{ResponseWriter: w}
+			w = dedupRecorder
+			defer func() {
+				if dedupRecorder.status != 0 && (dedupRecorder.status < 200 || dedupRecorder.status > 299) {
+					forwardDedup.forget(id)
+				}
+			}()
+		}
+	}
+
+	// Health checks bypass the limiter above, so monitoring stays accurate during a flood
+	if forwardLimiter != nil && !forwardLimiter.Allow() {
+		rateLimitedEvents.Inc()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "forward rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	// Reject bodies that declare an oversized length up front, and cap the
+	// ones that don't (e.g. chunked) while they are streamed to the downstream
+	if r.ContentLength > maxRequestBodyBytes {
+		rejectOversizeRequest(w)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	if decompressRequests {
+		if err := decompressRequestBody(r); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) || errors.Is(err, errDecompressedTooLarge) {
+				rejectOversizeRequest(w)
+				return
+			}
+			http.Error(w, fmt.Sprintf("malformed request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Counted once accepted, whichever path goes on to deliver it
+	eventsByType.WithLabelValues(eventTypeLabel(r.Header.Get("X-GitHub-Event"))).Inc()
+
+	// Without a real downstream, complete the event locally
+	if downstreamMode != downstreamModeProxy {
+		handleLocally(w, r)
+		return
+	}
+
+	if forwardIdempotencyHeader != "" && r.Header.Get(forwardIdempotencyHeader) == "" {
+		key, err := idempotencyKey(r)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				rejectOversizeRequest(w)
+				return
+			}
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Header.Set(forwardIdempotencyHeader, key)
+	}
+
+	stripRelayPrefix(r)
+
+	// Record the payload size, counting bytes as they stream when the length is unknown
+	if r.ContentLength >= 0 {
+		forwardedBytes.Observe(float64(r.ContentLength))
+	} else {
+		body := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+		defer func() { forwardedBytes.Observe(float64(body.n)) }()
+	}
+
+	// With a durable queue the event is persisted and delivered in the background
+	if eventQueue != nil {
+		enqueueForDelivery(w, r)
+		return
+	}
+
+	// Forward real webhook events directly - no need to read body into memory
+
+	// Use the shared proxy of the next downstream replica, failing fast while
+	// every replica is known to be down
+	replica, err := getProxyInstance()
+	if errors.Is(err, errCircuitOpen) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(circuitBreakerCooldown.Seconds())))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal server error: failed to create proxy", http.StatusInternalServerError)
+		return
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	forwarded := false
+	if replica.breaker != nil {
+		// Registered right away so a forward rejected before reaching the
+		// downstream can't leave a half-open breaker waiting on its probe
+		defer func() {
+			if !forwarded {
+				replica.breaker.release()
+				return
+			}
+			replica.breaker.record(recorder.status != 0 && recorder.status < http.StatusInternalServerError)
+		}()
+	}
+
+	// Each forward holds a downstream connection until it completes, so cap
+	// how many run at once under a burst
+	if forwardSlots != nil {
+		if !forwardSlots.acquire(r.Context()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent forwards", http.StatusServiceUnavailable)
+			return
+		}
+		defer forwardSlots.release()
+	}
+
+	// Slow downstreams may legitimately take minutes to respond, so the
+	// server-wide read/write deadlines are replaced by the forward deadline
+	// for this request only
+	deadline := time.Now().Add(effectiveForwardTimeout(r))
+	r.Header.Del(forwardTimeoutHeader)
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(deadline)
+	_ = rc.SetWriteDeadline(deadline)
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	if bufferForwardBodies {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				rejectOversizeRequest(w)
+				return
+			}
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		replaceBody(r, body)
+	}
+	if bufferForwardBodies || logErrorResponseBodies {
+		r = r.WithContext(context.WithValue(r.Context(), correlationIDKey{}, uuid.New().String()))
+	}
+
+	defer trackInFlight(replica.target)()
+
+	if capture := startBodyCapture(r); capture != nil {
+		defer capture.record()
+	}
+
+	// Only count actual forwarding attempts (after successful proxy creation)
+	forwardAttempts.WithLabelValues(replica.target).Inc()
+
+	defer func() {
+		if recorder.status >= 200 && recorder.status < 300 {
+			forwardDeliveries.WithLabelValues(replica.target).Inc()
+		}
+	}()
+	if tracingEnabled {
+		start := time.Now()
+		var span trace.Span
+		r, span = startForwardSpan(r, replica.target)
+		defer func() {
+			endForwardSpan(span, recorder.status, start)
+		}()
+	}
+	if deadLetterURL != "" || deadLetters != nil {
+		var forwardErr error
+		r = r.WithContext(context.WithValue(r.Context(), forwardErrorKey{}, &forwardErr))
+		defer func() {
+			if reason := deadLetterReason(recorder.status, forwardErr); reason != "" {
+				deadLetter(r, reason)
+			}
+		}()
+	}
+	// Buffering reads the trailers before the proxy clones them; streaming
+	// doesn't, so the outermost body reader hands them over at EOF
+	if !bufferForwardBodies && len(r.Trailer) > 0 {
+		r.Body = &trailerForwardingBody{ReadCloser: r.Body, from: r.Trailer}
+	}
+	start := time.Now()
+	forwarded = true
+	replica.proxy.ServeHTTP(recorder, r)
+	elapsed := time.Since(start)
+	forwardDuration.WithLabelValues(replica.target).Observe(elapsed.Seconds())
+	if recentEvents != nil {
+		recentEvents.add(recentEvent{
+			Time:       start,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Event:      r.Header.Get("X-GitHub-Event"),
+			Status:     recorder.status,
+			DurationMs: elapsed.Milliseconds(),
+		})
+	}
+}
+
+// writeScriptsToVolume writes the embedded probe scripts to the shared volume
+func writeScriptsToVolume(sharedPath string) error {
+	scripts := map[string][]byte{
+		"check-smee-health.sh":    smeeHealthScript,
+		"check-sidecar-health.sh": sidecarHealthScript,
+		"check-file-age.sh":       fileAgeScript,
+	}
+
+	for filename, content := range scripts {
+		scriptPath := filepath.Join(sharedPath, filename)
+
+		// Check if file exists and make it writable before overwriting
+		// This handles container restarts where the volume persists with read-only files
+		if _, err := os.Stat(scriptPath); err == nil {
+			if preserveExistingScripts {
+				log.Printf("Keeping existing probe script: %s", scriptPath)
+				continue
+			}
+			if err := os.Chmod(scriptPath, 0755); err != nil {
+				return fmt.Errorf("failed to make %s writable: %v", filename, err)
+			}
+		}
+
+		if scriptShell != "" {
+			content = withShebang(content, scriptShell)
+		}
+		if err := os.WriteFile(scriptPath, content, 0755); err != nil {
+			return fmt.Errorf("failed to write %s: %v", filename, err)
+		}
+
+		// Make script read-only to prevent accidental modification
+		if err := os.Chmod(scriptPath, 0555); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %v", filename, err)
+		}
+
+		log.Printf("Wrote read-only probe script: %s", scriptPath)
+	}
+	return nil
+}
+
+// withShebang replaces the interpreter line of a script, for base images
+// without the one it was written for
+func withShebang(script []byte, shell string) []byte {
+	rest := script
+	if bytes.HasPrefix(script, []byte("#!")) {
+		rest = nil
+		if i := bytes.IndexByte(script, '\n'); i >= 0 {
+			rest = script[i+1:]
+		}
+	}
+	return append([]byte("#!"+shell+"\n"), rest...)
+}
+
+// checkWritable verifies files can be created in dir by writing and removing
+// a probe file
+func checkWritable(dir string) error {
+	probe, err := os.CreateTemp(dir, ".write-probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// writeHealthStatus writes health status to file atomically
+func writeHealthStatus(status *HealthStatus, filePath string) error {
 	// Simple format with only fields used by probe scripts
-	content := fmt.Sprintf("status=%s\nmessage=%s\n",
+	content := fmt.Sprintf("status=%s\nmessage=%s\ntimestamp=%s\n",
 		status.Status,
 		status.Message,
+		status.Timestamp.UTC().Format(time.RFC3339),
+	)
+
+	// Atomic write: write to temp file, then rename
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("failed to rename temp file: %v", err)
+	}
+
+	return nil
+}
+
+// writeSignalFile writes a compact, fixed-width health record atomically.
+// The record is "<code> <unix-seconds>\n" where code is 1 for success and 0
+// for failure, and the timestamp is zero-padded to 10 digits, so external
+// processes can poll it cheaply at high frequency.
+func writeSignalFile(status *HealthStatus, filePath string, now time.Time) error {
+	code := 0
+	if status.Status == "success" {
+		code = 1
+	}
+	content := fmt.Sprintf("%d %010d\n", code, now.Unix())
+
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("failed to rename temp file: %v", err)
+	}
+
+	return nil
+}
+
+// performHealthCheck executes a single end-to-end health check, additionally
+// requiring the downstream to answer downstreamHealthPath when one is set
+func performHealthCheck(smeeChannelURL string, timeoutSeconds int) *HealthStatus {
+	status := performRoundTrip(smeeChannelURL, timeoutSeconds)
+	if status.Status == "success" {
+		smeeRoundTrip.Set(1)
+	} else {
+		smeeRoundTrip.Set(0)
+	}
+	if downstreamHealthPath == "" {
+		return status
+	}
+
+	roundTrip := "ok"
+	if status.Status != "success" {
+		roundTrip = "failed"
+	}
+	if err := checkDownstreamHealth(timeoutSeconds); err != nil {
+		downstreamReachable.Set(0)
+		if status.Status == "success" {
+			status.Status = "failure"
+			status.Reason = "downstream_unreachable"
+			status.Message = fmt.Sprintf("Downstream health check failed: %v", err)
+		}
+		status.Message += fmt.Sprintf(" (smee_roundtrip=%s, downstream_reachable=failed)", roundTrip)
+		return status
+	}
+	downstreamReachable.Set(1)
+	status.Message += fmt.Sprintf(" (smee_roundtrip=%s, downstream_reachable=ok)", roundTrip)
+	return status
+}
+
+// checkDownstreamHealth GETs downstreamHealthPath on every downstream replica,
+// failing unless they all answer 2xx
+func checkDownstreamHealth(timeoutSeconds int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+	for _, rawURL := range splitDownstreamURLs(downstreamServiceURL) {
+		if err := checkReplicaHealth(ctx, rawURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReplicaHealth GETs downstreamHealthPath on a single downstream replica
+func checkReplicaHealth(ctx context.Context, rawURL string) error {
+	base, socketPath, err := parseDownstreamURL(rawURL)
+	if err != nil {
+		return err
+	}
+	target := base.ResolveReference(&url.URL{Path: downstreamHealthPath})
+	client := getHealthCheckClient()
+	if socketPath != "" {
+		client = &http.Client{Transport: newDownstreamTransport(socketPath)}
+		defer client.CloseIdleConnections()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	drainBounded(resp.Body, healthCheckMaxResponseBytes)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d from %s", downstreamHealthPath, resp.StatusCode, downstreamLabel(base, socketPath))
+	}
+	return nil
+}
+
+// performRoundTrip sends a probe through the smee channel and waits for it
+// to loop back to forwardHandler
+func performRoundTrip(smeeChannelURL string, timeoutSeconds int) *HealthStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	testID := uuid.New().String()
+	status := &HealthStatus{
+		Status:  "failure",
+		Message: "Health check failed",
+	}
+	// Stamp the result with its completion time, whichever path returns it
+	start := time.Now()
+	defer func() {
+		status.Timestamp = time.Now()
+		status.RoundTripMs = status.Timestamp.Sub(start).Milliseconds()
+	}()
+
+	payload := HealthCheckPayload{Type: healthCheckPayloadType, ID: testID}
+	payloadBytes, _ := json.Marshal(payload)
+
+	// Create a channel for this specific request and register it.
+	resultChan := make(chan bool, 1)
+	mutex.Lock()
+	healthChecks[testID] = resultChan
+	healthCheckCreated[testID] = time.Now()
+	pendingHealthChecks.Set(float64(len(healthChecks)))
+	mutex.Unlock()
+
+	// Ensure we always clean up the map entry for this ID.
+	defer func() {
+		mutex.Lock()
+		delete(healthChecks, testID)
+		delete(healthCheckCreated, testID)
+		finishedHealthChecks[testID] = time.Now()
+		pendingHealthChecks.Set(float64(len(healthChecks)))
+		mutex.Unlock()
+	}()
+
+	// Create and send the probe request. A GET probe carries no body, so
+	// the header alone identifies it
+	var body io.Reader
+	if healthCheckMethod == http.MethodPost {
+		body = bytes.NewBuffer(payloadBytes)
+	}
+	req, err := http.NewRequestWithContext(ctx, healthCheckMethod, smeeChannelURL, body)
+	if err != nil {
+		status.Message = fmt.Sprintf("Failed to create request: %v", err)
+		status.Reason = "request_error"
+		return status
+	}
+
+	// Send health check ID in header for fast detection AND JSON body for server compatibility
+	req.Header.Set(healthCheckHeader, testID)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if healthCheckSigningKey != nil {
+		req.Header.Set(healthCheckSignatureHeader, signHealthCheckID(testID))
+	}
+
+	// Ensure connection is closed after use
+	req.Close = true
+
+	// Use the shared HTTP client
+	client := getHealthCheckClient()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		smeeRelayReachable.Set(0)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			status.Message = "Health check timed out posting to smee server"
+			status.Reason = "timeout"
+			return status
+		}
+		status.Message = fmt.Sprintf("Failed to POST to smee server: %v", err)
+		status.Reason = "post_failed"
+		return status
+	}
+	// Any answer, even a rejection, shows the transport to the relay works
+	smeeRelayReachable.Set(1)
+	healthCheckPostStatus.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+
+	// Always close response body to prevent resource leaks
+	defer func() {
+		if resp != nil && resp.Body != nil {
+			// Drain (bounded) and close the body to ensure resources are freed
+			// without reading an arbitrarily large response from a misbehaving relay
+			if _, truncated := drainBounded(resp.Body, healthCheckMaxResponseBytes); truncated {
+				log.Printf("WARNING: Health check response exceeded %d bytes, discarding the remainder", healthCheckMaxResponseBytes)
+			}
+			resp.Body.Close()
+		}
+	}()
+
+	// A relay that rejected the POST will never deliver the event, so fail
+	// immediately instead of waiting out the full timeout
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		status.Reason = fmt.Sprintf("relay_rejected_%d", resp.StatusCode)
+		status.Message = "Smee server rejected health check POST: " + status.Reason
+		return status
+	}
+
+	// Wait for the forwardHandler to receive the event, or for the timeout.
+	select {
+	case <-resultChan:
+		status.Status = "success"
+		status.Message = "Health check completed successfully"
+	case <-ctx.Done():
+		status.Message = "Health check timed out waiting for event round-trip"
+		status.Reason = "timeout"
+	}
+
+	return status
+}
+
+// setLastHealthStatus caches the result of the latest background health check
+func setLastHealthStatus(status *HealthStatus) {
+	lastHealthStatusMutex.Lock()
+	defer lastHealthStatusMutex.Unlock()
+	lastHealthStatus = status
+}
+
+// getLastHealthStatus returns the cached background health check result, if any
+func getLastHealthStatus() *HealthStatus {
+	lastHealthStatusMutex.RLock()
+	defer lastHealthStatusMutex.RUnlock()
+	return lastHealthStatus
+}
+
+// healthState is the outcome of the cached background health check
+type healthState int
+
+const (
+	// No background check has completed yet (e.g. right after startup)
+	healthUnknown healthState = iota
+	healthSuccess
+	healthFailure
+)
+
+// healthStateOf classifies a health check result, nil meaning none has completed
+func healthStateOf(status *HealthStatus) healthState {
+	switch {
+	case status == nil:
+		return healthUnknown
+	case status.Status == "success":
+		return healthSuccess
+	}
+	return healthFailure
+}
+
+// healthzHandler reports end-to-end health, either by running a live
+// round-trip check or, in cached mode, from the last background result
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	// Readiness is driven externally, so only report that the process is up
+	if !healthCheckEnabled {
+		writeProbeResponse(w, http.StatusOK, "health checking disabled")
+		return
+	}
+
+	var status *HealthStatus
+	if healthzMode == "cached" {
+		status = getLastHealthStatus()
+	} else {
+		status = performHealthCheck(healthCheckURL, healthCheckTimeoutSeconds)
+	}
+
+	switch healthStateOf(status) {
+	case healthUnknown:
+		// Cold start: distinct from a failure so it isn't mistaken for one
+		writeProbeResponse(w, http.StatusServiceUnavailable, "no health check has completed yet")
+	case healthFailure:
+		writeProbeResponse(w, http.StatusServiceUnavailable, status.Message)
+	default:
+		writeProbeResponse(w, http.StatusOK, "")
+	}
+}
+
+// probeResponse is the body of a probe endpoint with PROBE_RESPONSE_FORMAT=json
+type probeResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// writeProbeResponse answers a probe endpoint with either 200 or 503 in the
+// configured format. As text, success is "OK" (with any message in
+// parentheses) and failure is the message itself.
+func writeProbeResponse(w http.ResponseWriter, code int, message string) {
+	writeProbeStatus(w, code, "ok", message)
+}
+
+// writeProbeStatus is writeProbeResponse with the status reported on success:
+// the JSON status, and the text body unless it is "ok", written "OK"
+func writeProbeStatus(w http.ResponseWriter, code int, okStatus, message string) {
+	if probeResponseFormat == "json" {
+		response := probeResponse{Status: okStatus, Message: message}
+		if code != http.StatusOK {
+			response.Status = "unavailable"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Failed to encode probe response: %v", err)
+		}
+		return
+	}
+
+	if code != http.StatusOK {
+		http.Error(w, message, code)
+		return
+	}
+	text := okStatus
+	if okStatus == "ok" {
+		text = "OK"
+	}
+	w.WriteHeader(code)
+	if message != "" {
+		_, _ = fmt.Fprintf(w, "%s (%s)", text, message)
+		return
+	}
+	_, _ = io.WriteString(w, text)
+}
+
+// healthCheckLogger logs background health check results, collapsing runs of
+// identical failures (e.g. during a long relay outage) so the first one is
+// logged and then only every healthCheckFailureLogEvery-th repeat
+type healthCheckLogger struct {
+	consecutiveFailures int
+	lastFailure         string
+	repeats             int
+}
+
+func (l *healthCheckLogger) log(status *HealthStatus) {
+	if status.Status == "success" {
+		if l.consecutiveFailures > 0 {
+			log.Printf("Health check recovered after %d consecutive failures", l.consecutiveFailures)
+		} else {
+			log.Printf("Health check completed: %s (%s)", status.Status, status.Message)
+		}
+		l.consecutiveFailures, l.lastFailure, l.repeats = 0, "", 0
+		healthCheckConsecutiveFailures.Set(0)
+		return
+	}
+
+	l.consecutiveFailures++
+	healthCheckConsecutiveFailures.Set(float64(l.consecutiveFailures))
+	if status.Message != l.lastFailure {
+		l.lastFailure, l.repeats = status.Message, 1
+		log.Printf("Health check completed: %s (%s)", status.Status, status.Message)
+		return
+	}
+	l.repeats++
+	if l.repeats%healthCheckFailureLogEvery == 0 {
+		log.Printf("Health check completed: %s (%s), repeated %d times", status.Status, status.Message, l.repeats)
+	}
+}
+
+// readyzHandler reports readiness, holding off until the first background
+// health check has succeeded so no traffic is routed to a pod whose smee
+// channel has never worked
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeProbeResponse(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	if draining.Load() {
+		writeProbeResponse(w, http.StatusServiceUnavailable, "draining")
+		return
+	}
+	if readinessRequireFirstSuccess && healthCheckEnabled && !healthCheckEverSucceeded.Load() {
+		writeProbeResponse(w, http.StatusServiceUnavailable, "waiting for the first successful health check")
+		return
+	}
+	writeProbeResponse(w, http.StatusOK, "")
+}
+
+// livezHandler reports liveness. It always answers 200 unless
+// LIVEZ_CHECK_HEARTBEAT is set, in which case it fails once the background
+// health checker has stopped ticking, so a pod whose checker died is restarted.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	if livezCheckHeartbeat {
+		if last := healthCheckerHeartbeat.Load(); last != 0 {
+			if age := time.Since(time.Unix(0, last)); age > livezMaxHeartbeatAge {
+				writeProbeStatus(w, http.StatusServiceUnavailable, "alive", fmt.Sprintf("health checker last ticked %s ago", age.Round(time.Second)))
+				return
+			}
+		}
+	}
+	writeProbeStatus(w, http.StatusOK, "alive", "")
+}
+
+// runHealthChecker runs the background health checker
+func runHealthChecker(ctx context.Context, smeeChannelURL, healthFilePath string, intervalSeconds, timeoutSeconds int) {
+	ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	log.Printf("Starting background health checker (interval: %ds, timeout: %ds)", intervalSeconds, timeoutSeconds)
+	healthCheckerHeartbeat.Store(time.Now().UnixNano())
+
+	results := &healthCheckLogger{}
+	previousStatus := ""
+	// Buffered so an in-progress check can finish after the checker stops
+	completed := make(chan *HealthStatus, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Health checker stopped")
+			return
+		case <-ticker.C:
+			healthCheckerHeartbeat.Store(time.Now().UnixNano())
+			// Never start a check while the previous (or an on-demand) one is
+			// still waiting on its round-trip
+			if !healthCheckInProgress.CompareAndSwap(false, true) {
+				healthChecksSkipped.Inc()
+				log.Println("WARNING: Skipping health check tick, previous check still in progress")
+				continue
+			}
+			go func() {
+				completed <- performHealthCheck(smeeChannelURL, timeoutSeconds)
+				healthCheckInProgress.Store(false)
+			}()
+		case status := <-completed:
+			if status.Status == "success" && !healthCheckEverSucceeded.Swap(true) {
+				log.Println("First health check succeeded, reporting ready")
+			}
+			recordHealthStatus(status, healthFilePath)
+			results.log(status)
+			emitHealthCheckResult(status, smeeChannelURL, results.consecutiveFailures, status.Status != previousStatus)
+			previousStatus = status.Status
+		}
+	}
+}
+
+// emitHealthCheckResult writes a structured health_check_result event as a
+// JSON line. In "changes" mode, successes are only emitted when they follow
+// a failure (or are the first result), so steady-state success is dropped.
+func emitHealthCheckResult(status *HealthStatus, channel string, consecutiveFailures int, changed bool) {
+	switch healthCheckResultEvents {
+	case "all":
+	case "changes":
+		if status.Status == "success" && !changed {
+			return
+		}
+	default:
+		return
+	}
+
+	level := slog.LevelInfo
+	if status.Status != "success" {
+		level = slog.LevelWarn
+	}
+	slog.New(slog.NewJSONHandler(healthCheckResultWriter, nil)).Log(context.Background(), level, "health_check_result",
+		slog.String("status", status.Status),
+		slog.String("reason", status.Reason),
+		slog.Int64("round_trip_ms", status.RoundTripMs),
+		slog.String("channel", channel),
+		slog.Int("consecutive_failures", consecutiveFailures),
+		slog.String("timestamp", status.Timestamp.UTC().Format(time.RFC3339Nano)),
 	)
+}
 
-	// Atomic write: write to temp file, then rename
-	tmpPath := filePath + ".tmp"
-	if err := os.WriteFile(tmpPath, []byte(content), 0644); err != nil {
-		return fmt.Errorf("failed to write temp file: %v", err)
+// signHealthCheckID returns the hex HMAC-SHA256 of a health check ID
+func signHealthCheckID(id string) string {
+	mac := hmac.New(sha256.New, healthCheckSigningKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// peekHealthCheckID returns the probe ID when the body is a health check
+// payload, for relays that drop the health check header. At most
+// healthCheckPeekLimit bytes are read, and they are put back in front of the
+// rest of the body so any other event still forwards intact.
+func peekHealthCheckID(r *http.Request) string {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength > healthCheckPeekLimit {
+		return ""
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, healthCheckPeekLimit+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil || len(head) > healthCheckPeekLimit {
+		return ""
+	}
+	var payload HealthCheckPayload
+	if json.Unmarshal(head, &payload) != nil || payload.Type != healthCheckPayloadType {
+		return ""
+	}
+	return payload.ID
+}
+
+// validHealthCheckOrigin reports whether a health check event was generated by
+// this sidecar. Only this process knows the signing key, so a valid signature
+// can't be produced by anyone else on the channel, and the ID must belong to a
+// check that is pending or just finished (a late arrival), so a signed event
+// replayed once its check is forgotten is rejected too. Always true when
+// origin verification is disabled.
+func validHealthCheckOrigin(r *http.Request, id string) bool {
+	if healthCheckSigningKey == nil {
+		return true
+	}
+	expected := signHealthCheckID(id)
+	if !hmac.Equal([]byte(r.Header.Get(healthCheckSignatureHeader)), []byte(expected)) {
+		return false
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, pending := healthChecks[id]
+	_, finished := finishedHealthChecks[id]
+	return pending || finished
+}
+
+// checkRelayLiveness probes the relay's liveness endpoint with HEAD, falling
+// back to GET for relays that don't allow HEAD. Any 2xx or 3xx counts as alive.
+func checkRelayLiveness(livenessURL string, timeout time.Duration) bool {
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		req, err := http.NewRequestWithContext(ctx, method, livenessURL, nil)
+		if err != nil {
+			cancel()
+			log.Printf("Relay liveness check failed to create request: %v", err)
+			return false
+		}
+		resp, err := getHealthCheckClient().Do(req)
+		if err != nil {
+			cancel()
+			log.Printf("Relay liveness check failed: %v", err)
+			return false
+		}
+		drainBounded(resp.Body, healthCheckMaxResponseBytes)
+		resp.Body.Close()
+		cancel()
+
+		if resp.StatusCode == http.StatusMethodNotAllowed && method == http.MethodHead {
+			continue
+		}
+		return resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+	return false
+}
+
+// runRelayLivenessChecker periodically probes the relay liveness URL,
+// independently of the slower end-to-end round-trip check
+func runRelayLivenessChecker(ctx context.Context, livenessURL string, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Starting relay liveness checker (url: %s, interval: %s)", livenessURL, interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if checkRelayLiveness(livenessURL, timeout) {
+				relayLiveness.Set(1)
+			} else {
+				relayLiveness.Set(0)
+			}
+		}
+	}
+}
+
+// sweepHealthChecks evicts health check entries registered before now-maxAge,
+// reclaiming entries whose owning check never cleaned up, and returns the
+// number of entries evicted
+func sweepHealthChecks(maxAge time.Duration, now time.Time) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	evicted := 0
+	for id, created := range healthCheckCreated {
+		if now.Sub(created) > maxAge {
+			delete(healthChecks, id)
+			delete(healthCheckCreated, id)
+			evicted++
+		}
+	}
+	// IDs without a registration time can't be aged, so treat them as abandoned
+	for id := range healthChecks {
+		if _, ok := healthCheckCreated[id]; !ok {
+			delete(healthChecks, id)
+			evicted++
+		}
+	}
+	pendingHealthChecks.Set(float64(len(healthChecks)))
+	// Loop-backs older than maxAge are orphans rather than late arrivals
+	for id, finished := range finishedHealthChecks {
+		if now.Sub(finished) > maxAge {
+			delete(finishedHealthChecks, id)
+		}
+	}
+	return evicted
+}
+
+// runHealthCheckSweeper periodically evicts stale health check entries
+func runHealthCheckSweeper(ctx context.Context, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if evicted := sweepHealthChecks(maxAge, now); evicted > 0 {
+				log.Printf("WARNING: Evicted %d abandoned health check entries", evicted)
+			}
+		}
+	}
+}
+
+// runGoroutineSampler periodically records the goroutine count
+func runGoroutineSampler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	goroutineCount.Set(float64(runtime.NumGoroutine()))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			goroutineCount.Set(float64(runtime.NumGoroutine()))
+		}
+	}
+}
+
+// recordHealthStatus publishes a health check result to the status file,
+// the optional signal file, the cached status and the Prometheus gauge
+func recordHealthStatus(status *HealthStatus, healthFilePath string) {
+	if err := writeHealthStatus(status, healthFilePath); err != nil {
+		healthFileWriteFailures.Inc()
+		log.Printf("Failed to write health status: %v", err)
+	}
+
+	if signalFilePath != "" {
+		if err := writeSignalFile(status, signalFilePath, time.Now()); err != nil {
+			log.Printf("Failed to write signal file: %v", err)
+		}
+	}
+
+	setLastHealthStatus(status)
+
+	// Update Prometheus metric
+	if status.Status == "success" {
+		health_check.Set(1)
+	} else {
+		health_check.Set(0)
+	}
+}
+
+// versionHandler returns the build metadata as JSON
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"version":   version,
+		"commit":    commit,
+		"buildDate": buildDate,
+	}); err != nil {
+		log.Printf("Failed to encode version: %v", err)
+	}
+}
+
+// effectiveConfig is the configuration the sidecar is running with, as
+// served by /config. Secrets must be passed through redactSecret first.
+type effectiveConfig struct {
+	DownstreamServiceURL       string  `json:"downstreamServiceURL"`
+	DownstreamMode             string  `json:"downstreamMode"`
+	SmeeChannelURL             string  `json:"smeeChannelURL"`
+	HealthCheckEnabled         bool    `json:"healthCheckEnabled"`
+	HealthCheckChannelURL      string  `json:"healthCheckChannelURL"`
+	HealthCheckIntervalSeconds int     `json:"healthCheckIntervalSeconds"`
+	HealthCheckTimeoutSeconds  int     `json:"healthCheckTimeoutSeconds"`
+	HealthzMode                string  `json:"healthzMode"`
+	ReadHeaderTimeout          string  `json:"readHeaderTimeout"`
+	ReadTimeout                string  `json:"readTimeout"`
+	WriteTimeout               string  `json:"writeTimeout"`
+	IdleTimeout                string  `json:"idleTimeout"`
+	ForwardTimeout             string  `json:"forwardTimeout"`
+	ForwardMaxTimeout          string  `json:"forwardMaxTimeout"`
+	MaxIdleConns               int     `json:"maxIdleConns"`
+	MaxIdleConnsPerHost        int     `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost            int     `json:"maxConnsPerHost"`
+	ForwardProxyURL            string  `json:"forwardProxyURL"`
+	MgmtMaxConcurrent          int     `json:"mgmtMaxConcurrent"`
+	MaxRequestBodyBytes        int64   `json:"maxRequestBodyBytes"`
+	ForwardRateLimit           float64 `json:"forwardRateLimit"`
+	ForwardRetries             int     `json:"forwardRetries"`
+	MaxRetryAfter              string  `json:"maxRetryAfter"`
+	DurableQueueDir            string  `json:"durableQueueDir"`
+	HealthCheckVerifyOrigin    bool    `json:"healthCheckVerifyOrigin"`
+	MetricsAuthToken           string  `json:"metricsAuthToken"`
+	PprofAuthToken             string  `json:"pprofAuthToken"`
+	DebugAuthToken             string  `json:"debugAuthToken"`
+	AdminToken                 string  `json:"adminToken"`
+	SinglePortMode             bool    `json:"singlePortMode"`
+	SmeeClientMode             bool    `json:"smeeClientMode"`
+	WebhookHMACSecret          string  `json:"webhookHMACSecret"`
+	HMACMode                   string  `json:"hmacMode,omitempty"`
+	// Header names with their values redacted
+	ForwardExtraHeaders map[string]string `json:"forwardExtraHeaders,omitempty"`
+}
+
+// redactSecret hides a configured secret while still showing whether it is set
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "***"
+}
+
+// Query parameters whose values are credentials, matched case-insensitively
+var secretQueryParams = []string{"token", "access_token", "api_key", "apikey", "key", "secret", "password", "sig", "signature"}
+
+func isSecretQueryParam(name string) bool {
+	return slices.ContainsFunc(secretQueryParams, func(secret string) bool {
+		return strings.EqualFold(name, secret)
+	})
+}
+
+// redactURL hides a URL's whole user info and the values of the query
+// parameters in secretQueryParams
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return redactSecret(rawURL)
+	}
+	hasUser := parsed.User != nil
+	// Cleared and masked after formatting, as url would percent-encode "***"
+	parsed.User = nil
+	redacted := hasUser
+	if parsed.RawQuery != "" {
+		// Rewritten by hand: Query().Encode() would reorder the parameters
+		// and percent-encode the mask
+		params := strings.Split(parsed.RawQuery, "&")
+		for i, param := range params {
+			key, _, _ := strings.Cut(param, "=")
+			if name, err := url.QueryUnescape(key); err == nil && isSecretQueryParam(name) {
+				params[i] = key + "=***"
+				redacted = true
+			}
+		}
+		parsed.RawQuery = strings.Join(params, "&")
+	}
+	if !redacted {
+		return rawURL
+	}
+	if hasUser {
+		return strings.Replace(parsed.String(), "//", "//***@", 1)
+	}
+	return parsed.String()
+}
+
+// newConfigHandler serves the effective configuration as JSON
+func newConfigHandler(config effectiveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(config); err != nil {
+			log.Printf("Failed to encode configuration: %v", err)
+		}
+	}
+}
+
+// newCheckHandler returns a handler that runs an on-demand health check for
+// callers presenting the admin token, records its result like a background
+// check and returns it as JSON. It answers 409 while another check is in flight.
+func newCheckHandler(token, healthFilePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, token) {
+			rejectUnauthorized(w)
+			return
+		}
+		if !healthCheckInProgress.CompareAndSwap(false, true) {
+			http.Error(w, "a health check is already in progress", http.StatusConflict)
+			return
+		}
+		defer healthCheckInProgress.Store(false)
+
+		log.Println("Running on-demand health check")
+		status := performHealthCheck(healthCheckURL, healthCheckTimeoutSeconds)
+		recordHealthStatus(status, healthFilePath)
+		log.Printf("On-demand health check completed: %s (%s)", status.Status, status.Message)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("Failed to encode health check result: %v", err)
+		}
+	}
+}
+
+// authorized reports whether the request presents token, either as a bearer
+// token or as the basic-auth password (the username is ignored). Any other
+// Authorization header, including a bare token without a scheme, is rejected.
+func authorized(r *http.Request, token string) bool {
+	scheme, presented, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		if _, presented, ok = r.BasicAuth(); !ok {
+			return false
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+func rejectUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer, Basic realm="smee-sidecar"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// requireToken guards next with authorized, passing requests through
+// unchanged when no token is configured
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			rejectUnauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitConcurrency rejects requests with 503 once limit requests are already
+// being served, passing requests through unchanged when limit is 0. Requests
+// for the exempt paths are always served and don't take a slot.
+func limitConcurrency(limit int, next http.Handler, exempt ...string) http.Handler {
+	if limit <= 0 {
+		return next
 	}
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "management server busy", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// newMetricsHandler serves Prometheus metrics, requiring token when set since
+// label values can reveal channel URLs and internal hostnames
+func newMetricsHandler(token string) http.Handler {
+	return requireToken(token, promhttp.Handler())
+}
+
+// newResetMetricsHandler zeroes the relay counters for callers presenting the
+// admin token, e.g. between load test runs
+func newResetMetricsHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, token) {
+			rejectUnauthorized(w)
+			return
+		}
 
-	if err := os.Rename(tmpPath, filePath); err != nil {
-		return fmt.Errorf("failed to rename temp file: %v", err)
+		resetMetrics()
+		log.Println("Relay metrics reset via /admin/reset-metrics")
+		w.WriteHeader(http.StatusNoContent)
 	}
+}
 
-	return nil
+// setDraining starts or stops turning away regular events
+func setDraining(on bool) {
+	draining.Store(on)
+	if on {
+		drainingGauge.Set(1)
+	} else {
+		drainingGauge.Set(0)
+	}
 }
 
-// performHealthCheck executes a single end-to-end health check
-func performHealthCheck(smeeChannelURL string, timeoutSeconds int) *HealthStatus {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
-	defer cancel()
+// newDrainHandler starts draining (or, with drain false, resumes forwarding)
+// for callers presenting the admin token, e.g. during a blue/green cutover
+func newDrainHandler(token string, drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, token) {
+			rejectUnauthorized(w)
+			return
+		}
 
-	testID := uuid.New().String()
-	status := &HealthStatus{
-		Status:  "failure",
-		Message: "Health check failed",
+		setDraining(drain)
+		if drain {
+			log.Println("Draining via /admin/drain: rejecting regular events, still processing health checks")
+		} else {
+			log.Println("Drain ended via /admin/undrain: forwarding regular events again")
+		}
+		w.WriteHeader(http.StatusNoContent)
 	}
+}
 
-	payload := HealthCheckPayload{Type: "health-check", ID: testID}
-	payloadBytes, _ := json.Marshal(payload)
+// pendingHealthCheck describes a health check still waiting on its round-trip
+type pendingHealthCheck struct {
+	ID        string `json:"id"`
+	PendingMs int64  `json:"pendingMs"`
+}
 
-	// Create a channel for this specific request and register it.
-	resultChan := make(chan bool, 1)
+// pendingHealthChecksHandler lists the registered health check IDs, oldest
+// first, to show whether probes are reaching forwardHandler
+func pendingHealthChecksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
 	mutex.Lock()
-	healthChecks[testID] = resultChan
+	pending := make([]pendingHealthCheck, 0, len(healthChecks))
+	for id := range healthChecks {
+		pending = append(pending, pendingHealthCheck{ID: id, PendingMs: now.Sub(healthCheckCreated[id]).Milliseconds()})
+	}
 	mutex.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].PendingMs > pending[j].PendingMs })
 
-	// Ensure we always clean up the map entry for this ID.
-	defer func() {
-		mutex.Lock()
-		delete(healthChecks, testID)
-		mutex.Unlock()
-	}()
-
-	// Create and send the POST request.
-	req, err := http.NewRequestWithContext(ctx, "POST", smeeChannelURL, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		status.Message = fmt.Sprintf("Failed to create request: %v", err)
-		return status
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pending); err != nil {
+		log.Printf("Failed to encode pending health checks: %v", err)
 	}
+}
 
-	// Send health check ID in header for fast detection AND JSON body for server compatibility
-	req.Header.Set("X-Health-Check-ID", testID)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Ensure connection is closed after use
-	req.Close = true
-
-	// Use the shared HTTP client
-	client := getHealthCheckClient()
-
-	resp, err := client.Do(req)
-	if err != nil {
-		status.Message = fmt.Sprintf("Failed to POST to smee server: %v", err)
-		return status
+// recentEventsHandler serves the metadata of the last forwards, oldest first
+func recentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Always close response body to prevent resource leaks
-	defer func() {
-		if resp != nil && resp.Body != nil {
-			// Drain and close the body to ensure resources are freed
-			_, _ = io.Copy(io.Discard, resp.Body)
-			resp.Body.Close()
-		}
-	}()
-
-	// Wait for the forwardHandler to receive the event, or for the timeout.
-	select {
-	case <-resultChan:
-		status.Status = "success"
-		status.Message = "Health check completed successfully"
-	case <-ctx.Done():
-		status.Message = "Health check timed out waiting for event round-trip"
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recentEvents.snapshot()); err != nil {
+		log.Printf("Failed to encode recent events: %v", err)
 	}
-
-	return status
 }
 
-// runHealthChecker runs the background health checker
-func runHealthChecker(ctx context.Context, smeeChannelURL, healthFilePath string, intervalSeconds, timeoutSeconds int) {
-	ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
-	defer ticker.Stop()
-
-	log.Printf("Starting background health checker (interval: %ds, timeout: %ds)", intervalSeconds, timeoutSeconds)
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Health checker stopped")
+// newLastBodiesHandler serves the captured request bodies to callers
+// presenting the debug bearer token
+func newLastBodiesHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
-		case <-ticker.C:
-			status := performHealthCheck(smeeChannelURL, timeoutSeconds)
-
-			if err := writeHealthStatus(status, healthFilePath); err != nil {
-				log.Printf("Failed to write health status: %v", err)
-			} else {
-				log.Printf("Health check completed: %s (%s)", status.Status, status.Message)
-			}
+		}
+		if !authorized(r, token) {
+			rejectUnauthorized(w)
+			return
+		}
 
-			// Update Prometheus metric
-			if status.Status == "success" {
-				health_check.Set(1)
-			} else {
-				health_check.Set(0)
-			}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(capturedBodies.snapshot()); err != nil {
+			log.Printf("Failed to encode captured bodies: %v", err)
 		}
 	}
 }
 
 func main() {
-	log.Println("Starting Smee instrumentation sidecar...")
+	debugLogging = "debug" == os.Getenv("LOG_LEVEL")
+	log.Printf("Starting Smee instrumentation sidecar (version: %s, commit: %s, built: %s)...", version, commit, buildDate)
 
 	// Environment variables
 	downstreamServiceURL = os.Getenv("DOWNSTREAM_SERVICE_URL")
-	if downstreamServiceURL == "" {
-		log.Fatal("FATAL: DOWNSTREAM_SERVICE_URL environment variable must be set.")
+	if mode := os.Getenv("DOWNSTREAM_MODE"); mode != "" {
+		downstreamMode = mode
+	}
+	if err := validateDownstreamConfig(downstreamMode, downstreamServiceURL); err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	if downstreamMode != downstreamModeProxy {
+		log.Printf("Downstream mode %q: events are completed locally and not forwarded", downstreamMode)
 	}
 
 	smeeChannelURL := os.Getenv("SMEE_CHANNEL_URL")
@@ -334,101 +3114,731 @@ func main() {
 		sharedPath = "/shared"
 	}
 
+	preserveExistingScripts = "true" == os.Getenv("PRESERVE_EXISTING_SCRIPTS")
+	scriptShell = os.Getenv("SCRIPT_SHELL")
+	if scriptShell != "" && !filepath.IsAbs(scriptShell) {
+		log.Fatalf("FATAL: SCRIPT_SHELL must be an absolute path, got %q", scriptShell)
+	}
+
 	healthFilePath := os.Getenv("HEALTH_FILE_PATH")
 	if healthFilePath == "" {
 		healthFilePath = filepath.Join(sharedPath, "health-status.txt")
 	}
 
+	signalFilePath = os.Getenv("SIGNAL_FILE_PATH")
+	forwardSetXFP = "true" == os.Getenv("FORWARD_SET_XFP")
+	forwardHTTP2 = "true" == os.Getenv("FORWARD_ENABLE_HTTP2")
+	forwardIdempotencyHeader = os.Getenv("FORWARD_IDEMPOTENCY_HEADER")
+	relayStripPrefix = strings.TrimSuffix(os.Getenv("RELAY_STRIP_PREFIX"), "/")
+	forwardStripPrefix = strings.TrimSuffix(os.Getenv("FORWARD_STRIP_PREFIX"), "/")
+	if prefix := strings.Trim(os.Getenv("FORWARD_PATH_PREFIX"), "/"); prefix != "" {
+		forwardPathPrefix = "/" + prefix
+	}
+	decompressRequests = "true" == os.Getenv("DECOMPRESS_REQUESTS")
+	bufferForwardBodies = "true" == os.Getenv("BUFFER_REQUEST_BODY")
+	if raw := os.Getenv("FORWARD_EXTRA_HEADERS"); raw != "" {
+		headers, err := parseExtraHeaders(raw)
+		if err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		forwardExtraHeaders = headers
+	}
+	if allowed := os.Getenv("FORWARD_ALLOWED_CONTENT_TYPES"); allowed != "" {
+		forwardAllowedContentTypes = make(map[string]bool)
+		for _, contentType := range strings.Split(allowed, ",") {
+			if contentType = strings.TrimSpace(contentType); contentType != "" {
+				forwardAllowedContentTypes[strings.ToLower(contentType)] = true
+			}
+		}
+	}
+	if deadLetterURL = os.Getenv("DEAD_LETTER_URL"); deadLetterURL != "" {
+		if parsed, err := url.Parse(deadLetterURL); err != nil || parsed.Host == "" {
+			log.Fatalf("FATAL: DEAD_LETTER_URL must be an absolute URL, got %q", deadLetterURL)
+		}
+		// The body is replayed to the dead-letter endpoint, so it has to be buffered
+		bufferForwardBodies = true
+		log.Printf("Dead-lettering failed forwards to %s", redactURL(deadLetterURL))
+	}
+	if dir := os.Getenv("DEAD_LETTER_DIR"); dir != "" {
+		maxBytes := int64(getEnvInt("DEAD_LETTER_MAX_BYTES", 100*1024*1024))
+		store, err := openDeadLetterStore(dir, maxBytes)
+		if err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		deadLetters = store
+		bufferForwardBodies = true
+		log.Printf("Storing failed forwards in %s (up to %d bytes)", dir, maxBytes)
+		maxAge, err := getEnvNonNegativeInt("DEAD_LETTER_MAX_AGE_SECONDS", 0)
+		if err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		deadLetterMaxAge = time.Duration(maxAge) * time.Second
+		deadLetterReplayConcurrency = getEnvInt("DEAD_LETTER_REPLAY_CONCURRENCY", deadLetterReplayConcurrency)
+		if value := os.Getenv("DEAD_LETTER_REPLAY_RATE"); value != "" {
+			replayRate, err := strconv.ParseFloat(value, 64)
+			if err != nil || replayRate <= 0 {
+				log.Fatalf("FATAL: Invalid DEAD_LETTER_REPLAY_RATE %q, must be a positive number of events per second", value)
+			}
+			deadLetterReplayRate = replayRate
+		}
+	}
+	logErrorResponseBodies = "true" == os.Getenv("LOG_ERROR_RESPONSE_BODY")
+	if limit, err := getEnvNonNegativeInt("ERROR_BODY_LOG_LIMIT", int(errorBodyLogLimit)); err != nil {
+		log.Fatalf("FATAL: %v", err)
+	} else {
+		errorBodyLogLimit = int64(limit)
+	}
+	if retries, err := getEnvNonNegativeInt("FORWARD_RETRIES", 0); err != nil {
+		log.Fatalf("FATAL: %v", err)
+	} else if retries > 0 {
+		forwardRetries = retries
+		maxRetryAfter = time.Duration(getEnvInt("MAX_RETRY_AFTER_SECONDS", int(maxRetryAfter.Seconds()))) * time.Second
+		// Retries replay the body, so it has to be buffered
+		bufferForwardBodies = true
+		log.Printf("Retrying failed forwards up to %d times (honoring Retry-After up to %s)", forwardRetries, maxRetryAfter)
+	}
+	if ua := os.Getenv("USER_AGENT"); ua != "" {
+		userAgent = ua
+	}
+	if proxyStr := os.Getenv("FORWARD_PROXY_URL"); proxyStr != "" {
+		parsed, err := url.Parse(proxyStr)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			log.Fatalf("FATAL: FORWARD_PROXY_URL must be an absolute URL, got %q", proxyStr)
+		}
+		forwardProxyURL = parsed
+	}
+
 	// Parse configuration
-	healthCheckInterval := 30
-	if intervalStr := os.Getenv("HEALTH_CHECK_INTERVAL_SECONDS"); intervalStr != "" {
-		if val, err := strconv.Atoi(intervalStr); err == nil && val > 0 {
-			healthCheckInterval = val
+	healthCheckInterval := getEnvInt("HEALTH_CHECK_INTERVAL_SECONDS", 30)
+	healthCheckEnabled = "false" != os.Getenv("HEALTH_CHECK_ENABLED")
+	healthCheckTimeout := getEnvInt("HEALTH_CHECK_TIMEOUT_SECONDS", 20)
+	// Only background checks can overlap; on-demand ones don't use the interval
+	if healthCheckEnabled {
+		if err := validateHealthCheckTiming(healthCheckInterval, healthCheckTimeout); err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+	}
+	if healthPath := os.Getenv("DOWNSTREAM_HEALTH_PATH"); healthPath != "" {
+		if downstreamMode != downstreamModeProxy {
+			log.Printf("WARNING: Ignoring DOWNSTREAM_HEALTH_PATH in %q mode, there is no downstream to check", downstreamMode)
+		} else {
+			downstreamHealthPath = "/" + strings.TrimPrefix(healthPath, "/")
+		}
+	}
+	healthCheckURL = smeeChannelURL
+	// Probes are recognized by header, so they can travel a separate channel and
+	// keep real event channels free of probe traffic
+	if channelURL := os.Getenv("HEALTH_CHECK_CHANNEL_URL"); channelURL != "" {
+		healthCheckURL = channelURL
+		log.Println("Health checks use HEALTH_CHECK_CHANNEL_URL instead of SMEE_CHANNEL_URL")
+	}
+	healthCheckTimeoutSeconds = healthCheckTimeout
+	if header := os.Getenv("HEALTH_CHECK_HEADER"); header != "" {
+		if strings.ContainsAny(header, " :\r\n") {
+			log.Fatalf("FATAL: Invalid HEALTH_CHECK_HEADER %q", header)
+		}
+		healthCheckHeader = http.CanonicalHeaderKey(header)
+	}
+	if payloadType := os.Getenv("HEALTH_CHECK_PAYLOAD_TYPE"); payloadType != "" {
+		healthCheckPayloadType = payloadType
+	}
+
+	healthCheckResultEvents = os.Getenv("HEALTH_CHECK_RESULT_EVENTS")
+	switch healthCheckResultEvents {
+	case "", "all", "changes":
+	default:
+		log.Fatalf("FATAL: Invalid HEALTH_CHECK_RESULT_EVENTS %q, must be \"all\" or \"changes\"", healthCheckResultEvents)
+	}
+
+	// The key never leaves the process, so only our own probes can carry a valid signature
+	if "true" == os.Getenv("HEALTH_CHECK_VERIFY_ORIGIN") {
+		healthCheckSigningKey = make([]byte, 32)
+		if _, err := rand.Read(healthCheckSigningKey); err != nil {
+			log.Fatalf("FATAL: Failed to generate health check signing key: %v", err)
 		}
 	}
 
-	healthCheckTimeout := 20
-	if timeoutStr := os.Getenv("HEALTH_CHECK_TIMEOUT_SECONDS"); timeoutStr != "" {
-		if val, err := strconv.Atoi(timeoutStr); err == nil && val > 0 {
-			healthCheckTimeout = val
+	readinessRequireFirstSuccess = "false" != os.Getenv("READINESS_REQUIRE_FIRST_SUCCESS")
+	if format := os.Getenv("PROBE_RESPONSE_FORMAT"); format != "" {
+		if format != "text" && format != "json" {
+			log.Fatalf("FATAL: PROBE_RESPONSE_FORMAT must be \"text\" or \"json\", got %q", format)
 		}
+		probeResponseFormat = format
+	}
+	if method := strings.ToUpper(os.Getenv("HEALTH_CHECK_METHOD")); method != "" {
+		if method != http.MethodPost && method != http.MethodGet {
+			log.Fatalf("FATAL: HEALTH_CHECK_METHOD must be \"POST\" or \"GET\", got %q", method)
+		}
+		healthCheckMethod = method
+	}
+	healthCheckBodyFallback = "true" == os.Getenv("HEALTH_CHECK_BODY_FALLBACK")
+	if healthCheckBodyFallback && healthCheckMethod == http.MethodGet {
+		log.Printf("WARNING: HEALTH_CHECK_BODY_FALLBACK has no effect with HEALTH_CHECK_METHOD=GET, whose probes carry no body")
+	}
+	healthCheckResponseStatus = getEnvInt("HEALTH_CHECK_RESPONSE_STATUS", healthCheckResponseStatus)
+	if healthCheckResponseStatus < 200 || healthCheckResponseStatus > 599 {
+		log.Fatalf("FATAL: HEALTH_CHECK_RESPONSE_STATUS must be an HTTP status code between 200 and 599, got %d", healthCheckResponseStatus)
+	}
+	healthCheckResponseBody = os.Getenv("HEALTH_CHECK_RESPONSE_BODY")
+	if "true" == os.Getenv("LIVEZ_CHECK_HEARTBEAT") {
+		if healthCheckEnabled {
+			livezCheckHeartbeat = true
+			livezMaxHeartbeatAge = 3 * time.Duration(healthCheckInterval) * time.Second
+		} else {
+			log.Println("WARNING: Ignoring LIVEZ_CHECK_HEARTBEAT, health checking is disabled")
+		}
+	}
+	if mode := os.Getenv("HEALTHZ_MODE"); mode != "" {
+		if mode != "live" && mode != "cached" {
+			log.Fatalf("FATAL: HEALTHZ_MODE must be \"live\" or \"cached\", got %q", mode)
+		}
+		healthzMode = mode
+	}
+	healthCheckMaxResponseBytes = int64(getEnvInt("HEALTH_CHECK_MAX_RESPONSE_BYTES", int(healthCheckMaxResponseBytes)))
+	maxRequestBodyBytes = int64(getEnvInt("MAX_REQUEST_BODY_BYTES", int(maxRequestBodyBytes)))
+
+	// Server timeouts prevent stuck connection goroutines from accumulating
+	serverTimeouts := ServerTimeouts{
+		ReadHeader: time.Duration(getEnvInt("READ_HEADER_TIMEOUT_SECONDS", 10)) * time.Second, // kills slow-loris style idle connections
+		Read:       time.Duration(getEnvInt("READ_TIMEOUT_SECONDS", 180)) * time.Second,       // 3 min - longer than any client timeout
+		Write:      time.Duration(getEnvInt("WRITE_TIMEOUT_SECONDS", 60)) * time.Second,       // 1 min - safe response timeout
+		Idle:       time.Duration(getEnvInt("IDLE_TIMEOUT_SECONDS", 600)) * time.Second,       // 10 min - generous keep-alive cleanup
+	}
+	// Forwards are exempt from the read/write timeouts above and bounded by this instead
+	forwardTimeout = time.Duration(getEnvInt("FORWARD_TIMEOUT_SECONDS", int(forwardTimeout.Seconds()))) * time.Second
+	forwardAllowTimeoutHeader = "true" == os.Getenv("FORWARD_ALLOW_TIMEOUT_HEADER")
+	forwardMaxTimeout = time.Duration(getEnvInt("FORWARD_MAX_TIMEOUT_SECONDS", int(forwardMaxTimeout.Seconds()))) * time.Second
+
+	if limitStr := os.Getenv("FORWARD_RATE_LIMIT"); limitStr != "" {
+		limit, err := strconv.ParseFloat(limitStr, 64)
+		if err != nil || limit <= 0 {
+			log.Fatalf("FATAL: Invalid FORWARD_RATE_LIMIT %q, must be a positive number of events per second", limitStr)
+		}
+		burst := getEnvInt("FORWARD_RATE_BURST", max(int(limit), 1))
+		forwardLimiter = rate.NewLimiter(rate.Limit(limit), burst)
+		log.Printf("Forward rate limit enabled (%.2f events/s, burst %d)", limit, burst)
+	}
+
+	hmacMode := os.Getenv("HMAC_MODE")
+	if hmacMode == "" {
+		hmacMode = "enforce"
+	}
+	if hmacMode != "enforce" && hmacMode != "log_only" {
+		log.Fatalf("FATAL: HMAC_MODE must be \"enforce\" or \"log_only\", got %q", hmacMode)
+	}
+	for _, secret := range strings.Split(os.Getenv("WEBHOOK_HMAC_SECRET"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			webhookHMACSecrets = append(webhookHMACSecrets, []byte(secret))
+		}
+	}
+	if len(webhookHMACSecrets) > 0 {
+		hmacLogOnly = hmacMode == "log_only"
+		log.Printf("Webhook signature verification enabled with %d secret(s) (HMAC_MODE=%s)", len(webhookHMACSecrets), hmacMode)
+	}
+
+	if labels := os.Getenv("EVENT_TYPE_LABELS"); labels != "" {
+		eventTypeLabels = make(map[string]bool)
+		for _, eventType := range strings.Split(labels, ",") {
+			if eventType = strings.TrimSpace(eventType); eventType != "" {
+				eventTypeLabels[eventType] = true
+			}
+		}
+	}
+
+	if limit := getEnvInt("FORWARD_MAX_CONCURRENCY", 0); limit > 0 {
+		overflow := os.Getenv("FORWARD_OVERFLOW")
+		if overflow == "" {
+			overflow = "reject"
+		}
+		if overflow != "queue" && overflow != "reject" {
+			log.Fatalf("FATAL: Invalid FORWARD_OVERFLOW %q, must be \"queue\" or \"reject\"", overflow)
+		}
+		queueTimeout := time.Duration(getEnvInt("FORWARD_QUEUE_TIMEOUT_SECONDS", 30)) * time.Second
+		forwardSlots = newForwardSemaphore(limit, overflow == "queue", queueTimeout)
+		log.Printf("Forward concurrency limited to %d (overflow: %s)", limit, overflow)
+	}
+
+	if ttl := getEnvInt("DEDUP_TTL_SECONDS", 0); ttl > 0 {
+		if header := os.Getenv("DEDUP_HEADER"); header != "" {
+			dedupHeader = header
+		}
+		maxEntries := getEnvInt("DEDUP_MAX_ENTRIES", 10000)
+		if maxEntries <= 0 {
+			log.Fatalf("FATAL: DEDUP_MAX_ENTRIES must be positive, got %d", maxEntries)
+		}
+		forwardDedup = newDedupCache(time.Duration(ttl)*time.Second, maxEntries)
+		log.Printf("Deduplicating deliveries by %s (window %ds, up to %d IDs)", dedupHeader, ttl, maxEntries)
+	}
+
+	if threshold := getEnvInt("CIRCUIT_BREAKER_FAILURE_THRESHOLD", 0); threshold > 0 && downstreamMode == downstreamModeProxy {
+		cooldown := time.Duration(getEnvInt("CIRCUIT_BREAKER_COOLDOWN_SECONDS", 30)) * time.Second
+		// Each replica gets its own breaker, so a dead one is skipped while the others serve
+		circuitBreakerThreshold = threshold
+		circuitBreakerCooldown = cooldown
+		log.Printf("Circuit breaker enabled per downstream replica (opens after %d consecutive failures, cooldown %s)", threshold, cooldown)
+	}
+
+	// Debug body capture is opt-in and always requires a token to read back
+	debugToken := os.Getenv("DEBUG_AUTH_TOKEN")
+	if "true" == os.Getenv("DEBUG_CAPTURE_BODIES") {
+		if debugToken == "" {
+			log.Fatalf("FATAL: DEBUG_AUTH_TOKEN must be set when DEBUG_CAPTURE_BODIES is enabled")
+		}
+		capturedBodies = newRing[capturedBody](getEnvInt("DEBUG_CAPTURE_MAX_BODIES", 20))
+		debugCaptureMaxBytes = int64(getEnvInt("DEBUG_CAPTURE_MAX_BYTES", int(debugCaptureMaxBytes)))
+		if rateStr := os.Getenv("DEBUG_CAPTURE_SAMPLE_RATE"); rateStr != "" {
+			if rate, err := strconv.ParseFloat(rateStr, 64); err == nil && rate > 0 && rate <= 1 {
+				debugCaptureSampleRate = rate
+			} else {
+				log.Printf("WARNING: Invalid DEBUG_CAPTURE_SAMPLE_RATE %q, capturing every request", rateStr)
+			}
+		}
+		debugCaptureRedactFields = make(map[string]bool)
+		for _, field := range strings.Split(os.Getenv("DEBUG_CAPTURE_REDACT_FIELDS"), ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				debugCaptureRedactFields[strings.ToLower(field)] = true
+			}
+		}
+		log.Printf("Debug body capture enabled (last %d bodies, sample rate %.2f)", len(capturedBodies.entries), debugCaptureSampleRate)
 	}
 
 	// Check if pprof endpoints should be enabled (disabled by default for security)
 	enablePprof := "true" == os.Getenv("ENABLE_PPROF")
+	if enablePprof {
+		recentEvents = newRing[recentEvent](getEnvInt("RECENT_EVENTS_SIZE", 100))
+	}
+
+	// Pool limits must be known before the first transport is created
+	for _, limit := range []struct {
+		key   string
+		value *int
+	}{
+		{"MAX_IDLE_CONNS", &maxIdleConns},
+		{"MAX_IDLE_CONNS_PER_HOST", &maxIdleConnsPerHost},
+		{"MAX_CONNS_PER_HOST", &maxConnsPerHost},
+		{"MGMT_MAX_CONCURRENT", &mgmtMaxConcurrent},
+	} {
+		val, err := getEnvNonNegativeInt(limit.key, *limit.value)
+		if err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		*limit.value = val
+	}
+	connLifetime, err := getEnvNonNegativeInt("MAX_CONN_LIFETIME_SECONDS", 0)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	maxConnLifetime = time.Duration(connLifetime) * time.Second
+	if deadLetterURL != "" {
+		deadLetterClient = &http.Client{Transport: createOptimizedTransport()}
+	}
 
 	// HTTP clients will be initialized lazily when first needed
 
+	// A read-only mount would otherwise only surface as a failed script write
+	// or, for the status file, as probes reading a stale result forever
+	for _, dir := range []string{sharedPath, filepath.Dir(healthFilePath)} {
+		if err := checkWritable(dir); err != nil {
+			log.Fatalf("FATAL: %s is not writable (%v); mount SHARED_VOLUME_PATH read-write, e.g. an emptyDir without readOnly: true", dir, err)
+		}
+	}
+
 	// Write probe scripts to shared volume
 	if err := writeScriptsToVolume(sharedPath); err != nil {
 		log.Fatalf("FATAL: Failed to write probe scripts: %v", err)
 	}
 
 	// Register metrics with Prometheus.
-	prometheus.MustRegister(forwardAttempts)
-	prometheus.MustRegister(health_check)
-
-	// Start background health checker
+	forwardAttempts = registerMetric(prometheus.DefaultRegisterer, forwardAttempts)
+	forwardDeliveries = registerMetric(prometheus.DefaultRegisterer, forwardDeliveries)
+	proxyErrors = registerMetric(prometheus.DefaultRegisterer, proxyErrors)
+	deadLetterReplays = registerMetric(prometheus.DefaultRegisterer, deadLetterReplays)
+	deadLettersExpired = registerMetric(prometheus.DefaultRegisterer, deadLettersExpired)
+	webhookSignatureFailures = registerMetric(prometheus.DefaultRegisterer, webhookSignatureFailures)
+	hmacKeyUsed = registerMetric(prometheus.DefaultRegisterer, hmacKeyUsed)
+	health_check = registerMetric(prometheus.DefaultRegisterer, health_check)
+	drainingGauge = registerMetric(prometheus.DefaultRegisterer, drainingGauge)
+	deadLettered = registerMetric(prometheus.DefaultRegisterer, deadLettered)
+	goroutineCount = registerMetric(prometheus.DefaultRegisterer, goroutineCount)
+	smeeRoundTrip = registerMetric(prometheus.DefaultRegisterer, smeeRoundTrip)
+	smeeRelayReachable = registerMetric(prometheus.DefaultRegisterer, smeeRelayReachable)
+	healthCheckPostStatus = registerMetric(prometheus.DefaultRegisterer, healthCheckPostStatus)
+	if downstreamHealthPath != "" {
+		downstreamReachable = registerMetric(prometheus.DefaultRegisterer, downstreamReachable)
+	}
+	lastEventReceived = registerMetric(prometheus.DefaultRegisterer, lastEventReceived)
+	oversizeRejections = registerMetric(prometheus.DefaultRegisterer, oversizeRejections)
+	forwardedBytes = registerMetric(prometheus.DefaultRegisterer, forwardedBytes)
+	forwardDuration = registerMetric(prometheus.DefaultRegisterer, forwardDuration)
+	inFlightRequests = registerMetric(prometheus.DefaultRegisterer, inFlightRequests)
+	buildInfo = registerMetric(prometheus.DefaultRegisterer, buildInfo)
+	pendingHealthChecks = registerMetric(prometheus.DefaultRegisterer, pendingHealthChecks)
+	contentTypeRejections = registerMetric(prometheus.DefaultRegisterer, contentTypeRejections)
+	rateLimitedEvents = registerMetric(prometheus.DefaultRegisterer, rateLimitedEvents)
+	healthFileWriteFailures = registerMetric(prometheus.DefaultRegisterer, healthFileWriteFailures)
+	dedupedEvents = registerMetric(prometheus.DefaultRegisterer, dedupedEvents)
+	forwardQueueDepth = registerMetric(prometheus.DefaultRegisterer, forwardQueueDepth)
+	eventsByType = registerMetric(prometheus.DefaultRegisterer, eventsByType)
+	relayLiveness = registerMetric(prometheus.DefaultRegisterer, relayLiveness)
+	lateHealthCheckArrivals = registerMetric(prometheus.DefaultRegisterer, lateHealthCheckArrivals)
+	orphanHealthChecks = registerMetric(prometheus.DefaultRegisterer, orphanHealthChecks)
+	healthChecksSkipped = registerMetric(prometheus.DefaultRegisterer, healthChecksSkipped)
+	healthCheckConsecutiveFailures = registerMetric(prometheus.DefaultRegisterer, healthCheckConsecutiveFailures)
+	durableQueueDepth = registerMetric(prometheus.DefaultRegisterer, durableQueueDepth)
+	durableQueueBytes = registerMetric(prometheus.DefaultRegisterer, durableQueueBytes)
+	circuitBreakerState = registerMetric(prometheus.DefaultRegisterer, circuitBreakerState)
+	buildInfo.WithLabelValues(version, commit, buildDate).Set(1)
+
+	// Stops the background goroutines on return
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go runHealthChecker(ctx, smeeChannelURL, healthFilePath, healthCheckInterval, healthCheckTimeout)
 
-	// --- Relay Server (on port 8080) ---
+	if "true" == os.Getenv("OTEL_ENABLED") {
+		shutdownTracing, err := setupTracing(ctx)
+		if err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		defer shutdownTracing(context.Background())
+		tracingEnabled = true
+		log.Println("OpenTelemetry tracing enabled for forwarded requests")
+	}
+	if !healthCheckEnabled {
+		// Distinguish "not checking" from a failing check on dashboards
+		health_check.Set(-1)
+		log.Println("WARNING: Background health checking disabled (HEALTH_CHECK_ENABLED=false): no smee round-trips are made, health_check is -1 and /healthz only reports liveness")
+	}
+	livenessURL := os.Getenv("HEALTH_CHECK_LIVENESS_URL")
+	livenessInterval := time.Duration(getEnvInt("HEALTH_CHECK_LIVENESS_INTERVAL_SECONDS", 5)) * time.Second
+	livenessTimeout := time.Duration(getEnvInt("HEALTH_CHECK_LIVENESS_TIMEOUT_SECONDS", 2)) * time.Second
+
+	// Persist events before acknowledging them, delivering from the queue
+	// once the servers are up
+	var startQueueConsumer func()
+	if queueDir := os.Getenv("DURABLE_QUEUE_DIR"); queueDir != "" && downstreamMode == downstreamModeProxy {
+		maxBytes := int64(getEnvInt("DURABLE_QUEUE_MAX_BYTES", 1<<30))
+		segmentBytes := int64(getEnvInt("DURABLE_QUEUE_SEGMENT_BYTES", 64<<20))
+		queue, err := openDurableQueue(queueDir, maxBytes, segmentBytes)
+		if err != nil {
+			log.Fatalf("FATAL: Failed to open durable queue: %v", err)
+		}
+		type queueReplica struct {
+			client     *http.Client
+			downstream *url.URL
+			target     string
+		}
+		var replicas []queueReplica
+		for _, rawURL := range splitDownstreamURLs(downstreamServiceURL) {
+			downstream, socketPath, err := parseDownstreamURL(rawURL)
+			if err != nil {
+				log.Fatalf("FATAL: Invalid DOWNSTREAM_SERVICE_URL: %v", err)
+			}
+			transport := limitConnLifetime(newDownstreamTransport(socketPath), maxConnLifetime)
+			replicas = append(replicas, queueReplica{
+				client:     &http.Client{Transport: transport, Timeout: forwardTimeout},
+				downstream: downstream,
+				target:     downstreamLabel(downstream, socketPath),
+			})
+		}
+		eventQueue = queue
+		compactInterval := time.Duration(getEnvInt("DURABLE_QUEUE_COMPACT_INTERVAL_SECONDS", 60)) * time.Second
+		startQueueConsumer = func() {
+			// The consumer delivers one event at a time, so rotating needs no locking;
+			// a failed delivery is retried on the next replica
+			next := 0
+			go runDurableQueueConsumer(ctx, queue, func(ctx context.Context, event *queuedEvent) error {
+				replica := replicas[next%len(replicas)]
+				next++
+				return deliverQueuedEvent(ctx, replica.client, replica.downstream, replica.target, event)
+			})
+			go runDurableQueueCompactor(ctx, queue, compactInterval)
+		}
+		log.Printf("Durable queue enabled in %s (%d events pending)", queueDir, queue.depth())
+	}
+
+	startupDelay, err := getEnvNonNegativeInt("STARTUP_DELAY_SECONDS", 0)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	preShutdownSeconds, err := getEnvNonNegativeInt("PRESHUTDOWN_SECONDS", 0)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	preShutdown := time.Duration(preShutdownSeconds) * time.Second
+	if startupDelay > 0 {
+		// Nothing is listening yet, so a shutdown during the delay just exits
+		delayCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		err := waitStartupDelay(delayCtx, time.Duration(startupDelay)*time.Second)
+		stop()
+		if err != nil {
+			log.Printf("Shutting down: %v", err)
+			return
+		}
+	}
+
+	// Hold off serving webhooks until the downstream container is up
+	if "true" == os.Getenv("WAIT_FOR_DOWNSTREAM") && downstreamMode == downstreamModeProxy {
+		waitTimeout := time.Duration(getEnvInt("DOWNSTREAM_WAIT_TIMEOUT_SECONDS", 60)) * time.Second
+		for _, rawURL := range splitDownstreamURLs(downstreamServiceURL) {
+			if err := waitForDownstream(ctx, rawURL, waitTimeout, 2*time.Second); err != nil {
+				if "true" != os.Getenv("DOWNSTREAM_WAIT_PROCEED_ON_TIMEOUT") {
+					log.Fatalf("FATAL: %v", err)
+				}
+				log.Printf("WARNING: %v, starting relay server anyway", err)
+			}
+		}
+	}
+
+	// Unlike the TCP wait above, warmup waits for the downstream to actually
+	// serve requests, and never stops the sidecar from starting
+	warmupTimeout, err := getEnvNonNegativeInt("WARMUP_TIMEOUT_SECONDS", 0)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	if warmupTimeout > 0 {
+		if downstreamHealthPath == "" {
+			log.Println("WARNING: Ignoring WARMUP_TIMEOUT_SECONDS, it requires DOWNSTREAM_HEALTH_PATH")
+		} else if err := warmUpDownstream(ctx, time.Duration(warmupTimeout)*time.Second, 2*time.Second); err != nil {
+			log.Printf("WARNING: %v, starting relay server anyway", err)
+		}
+	}
+
+	// --- Relay Server (on port 8080 unless RELAY_LISTEN_ADDR says otherwise) ---
+	relayListenAddr := os.Getenv("RELAY_LISTEN_ADDR")
+	if relayListenAddr == "" {
+		relayListenAddr = ":8080"
+	}
 	relayMux := http.NewServeMux()
 	relayMux.HandleFunc("/", forwardHandler)
+	// Shut down together once a SIGTERM's pre-shutdown period is over
+	var servers []*http.Server
+
+	// With a single exposed port the management endpoints share the relay server
+	singlePortMode := "true" == os.Getenv("SINGLE_PORT_MODE")
+	if !singlePortMode {
+		// Configure relay server with timeouts to prevent goroutine leaks
+		// while maintaining transparency (timeouts longer than any realistic client)
+		relayServer := newServer(relayListenAddr, relayMux, serverTimeouts)
+		relayListener, err := listen(relayServer.Addr)
+		if err != nil {
+			log.Fatalf("FATAL: Relay server failed to listen: %v", err)
+		}
+		servers = append(servers, relayServer)
+
+		go func() {
+			log.Printf("Relay server listening on %s with timeouts (read header: %.0fs, read: %.0fs, write: %.0fs, idle: %.0fs, forward: %.0fs)",
+				relayServer.Addr,
+				relayServer.ReadHeaderTimeout.Seconds(),
+				relayServer.ReadTimeout.Seconds(),
+				relayServer.WriteTimeout.Seconds(),
+				relayServer.IdleTimeout.Seconds(),
+				forwardTimeout.Seconds())
+			if err := relayServer.Serve(relayListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("FATAL: Relay server failed: %v", err)
+			}
+		}()
+	}
 
-	// Configure relay server with timeouts to prevent goroutine leaks
-	// while maintaining transparency (timeouts longer than any realistic client)
-	relayServer := &http.Server{
-		Addr:         ":8080",
-		Handler:      relayMux,
-		ReadTimeout:  180 * time.Second, // 3 min - longer than any client timeout
-		WriteTimeout: 60 * time.Second,  // 1 min - safe response timeout
-		IdleTimeout:  600 * time.Second, // 10 min - generous keep-alive cleanup
-	}
-
-	go func() {
-		log.Printf("Relay server listening on %s with timeouts (read: %.0fs, write: %.0fs, idle: %.0fs)",
-			relayServer.Addr,
-			relayServer.ReadTimeout.Seconds(),
-			relayServer.WriteTimeout.Seconds(),
-			relayServer.IdleTimeout.Seconds())
-		if err := relayServer.ListenAndServe(); err != nil {
-			log.Fatalf("FATAL: Relay server failed: %v", err)
+	// Subscribe to the channel ourselves instead of relying on a smee-client container
+	smeeClientMode := "true" == os.Getenv("SMEE_CLIENT_MODE")
+	if smeeClientMode {
+		backoffBase := time.Duration(getEnvInt("SMEE_SSE_BACKOFF_BASE_SECONDS", 1)) * time.Second
+		backoffMax := time.Duration(getEnvInt("SMEE_SSE_BACKOFF_MAX_SECONDS", 60)) * time.Second
+		if backoffBase <= 0 || backoffMax < backoffBase {
+			log.Fatalf("FATAL: SMEE_SSE_BACKOFF_BASE_SECONDS must be positive and at most SMEE_SSE_BACKOFF_MAX_SECONDS")
 		}
-	}()
+		smeeSSEConnected = registerMetric(prometheus.DefaultRegisterer, smeeSSEConnected)
+		smeeSSEReconnects = registerMetric(prometheus.DefaultRegisterer, smeeSSEReconnects)
+		log.Printf("Smee client mode: forwarding events streamed from %s", redactURL(smeeChannelURL))
+		go runSmeeClient(ctx, smeeChannelURL, http.HandlerFunc(forwardHandler), backoffBase, backoffMax)
+	}
+
+	// --- Management Server (on port 9100 unless MGMT_LISTEN_ADDR says otherwise) ---
+	mgmtListenAddr := os.Getenv("MGMT_LISTEN_ADDR")
+	if mgmtListenAddr == "" {
+		mgmtListenAddr = ":9100"
+	}
+	metricsToken := os.Getenv("METRICS_AUTH_TOKEN")
+	pprofToken := os.Getenv("PPROF_AUTH_TOKEN")
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	// The endpoints only the pod network reaches otherwise share the relay port
+	// here, which the webhook senders reach too: everything but the probes
+	// requires a token, the admin one unless an endpoint has its own
+	var singlePortToken string
+	if singlePortMode {
+		if adminToken == "" {
+			log.Fatalf("FATAL: SINGLE_PORT_MODE requires ADMIN_TOKEN, the management endpoints would be reachable unauthenticated on the relay port")
+		}
+		singlePortToken = adminToken
+		for _, token := range []*string{&metricsToken, &pprofToken} {
+			if *token == "" {
+				*token = adminToken
+			}
+		}
+	}
+	var redactedDownstreams []string
+	for _, rawURL := range splitDownstreamURLs(downstreamServiceURL) {
+		redactedDownstreams = append(redactedDownstreams, redactURL(rawURL))
+	}
+	config := effectiveConfig{
+		DownstreamServiceURL:       strings.Join(redactedDownstreams, ","),
+		DownstreamMode:             downstreamMode,
+		SmeeChannelURL:             redactURL(smeeChannelURL),
+		HealthCheckEnabled:         healthCheckEnabled,
+		HealthCheckChannelURL:      redactURL(healthCheckURL),
+		HealthCheckIntervalSeconds: healthCheckInterval,
+		HealthCheckTimeoutSeconds:  healthCheckTimeout,
+		HealthzMode:                healthzMode,
+		ReadHeaderTimeout:          serverTimeouts.ReadHeader.String(),
+		ReadTimeout:                serverTimeouts.Read.String(),
+		WriteTimeout:               serverTimeouts.Write.String(),
+		IdleTimeout:                serverTimeouts.Idle.String(),
+		ForwardTimeout:             forwardTimeout.String(),
+		ForwardMaxTimeout:          forwardMaxTimeout.String(),
+		MaxIdleConns:               maxIdleConns,
+		MaxIdleConnsPerHost:        maxIdleConnsPerHost,
+		MaxConnsPerHost:            maxConnsPerHost,
+		MgmtMaxConcurrent:          mgmtMaxConcurrent,
+		MaxRequestBodyBytes:        maxRequestBodyBytes,
+		ForwardRetries:             forwardRetries,
+		MaxRetryAfter:              maxRetryAfter.String(),
+		HealthCheckVerifyOrigin:    healthCheckSigningKey != nil,
+		MetricsAuthToken:           redactSecret(metricsToken),
+		PprofAuthToken:             redactSecret(pprofToken),
+		DebugAuthToken:             redactSecret(debugToken),
+		AdminToken:                 redactSecret(adminToken),
+		SinglePortMode:             singlePortMode,
+		SmeeClientMode:             smeeClientMode,
+		WebhookHMACSecret:          redactSecret(os.Getenv("WEBHOOK_HMAC_SECRET")),
+	}
+	if len(webhookHMACSecrets) > 0 {
+		config.HMACMode = hmacMode
+	}
+	if len(forwardExtraHeaders) > 0 {
+		config.ForwardExtraHeaders = make(map[string]string, len(forwardExtraHeaders))
+		for name, value := range forwardExtraHeaders {
+			config.ForwardExtraHeaders[name] = redactSecret(value)
+		}
+	}
+	if forwardProxyURL != nil {
+		config.ForwardProxyURL = redactURL(forwardProxyURL.String())
+	}
+	if forwardLimiter != nil {
+		config.ForwardRateLimit = float64(forwardLimiter.Limit())
+	}
+	if eventQueue != nil {
+		config.DurableQueueDir = eventQueue.dir
+	}
 
-	// --- Management Server (on port 9100) ---
 	mgmtMux := http.NewServeMux()
-	mgmtMux.Handle("/metrics", promhttp.Handler())
+	mgmtMux.Handle("/metrics", newMetricsHandler(metricsToken))
+	mgmtMux.HandleFunc("/healthz", healthzHandler)
+	mgmtMux.HandleFunc("/readyz", readyzHandler)
+	mgmtMux.HandleFunc("/livez", livezHandler)
+	mgmtMux.Handle("/version", requireToken(singlePortToken, http.HandlerFunc(versionHandler)))
+	mgmtMux.Handle("/config", requireToken(singlePortToken, newConfigHandler(config)))
 
 	// Add pprof endpoints for memory profiling
 	if enablePprof {
 		log.Println("Enabling pprof endpoints for debugging")
-		mgmtMux.HandleFunc("/debug/pprof/", pprof.Index)
-		mgmtMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		mgmtMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mgmtMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		mgmtMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-		mgmtMux.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-		mgmtMux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-		mgmtMux.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
-		mgmtMux.Handle("/debug/pprof/block", pprof.Handler("block"))
-		mgmtMux.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
+		// Profiles expose heap contents and stacks, so guard them when a token is set
+		handlePprof := func(pattern string, handler http.Handler) {
+			mgmtMux.Handle(pattern, requireToken(pprofToken, handler))
+		}
+		handlePprof("/debug/pprof/", http.HandlerFunc(pprof.Index))
+		handlePprof("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+		handlePprof("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+		handlePprof("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+		handlePprof("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+		handlePprof("/debug/pprof/goroutine", pprof.Handler("goroutine"))
+		handlePprof("/debug/pprof/heap", pprof.Handler("heap"))
+		handlePprof("/debug/pprof/allocs", pprof.Handler("allocs"))
+		handlePprof("/debug/pprof/block", pprof.Handler("block"))
+		handlePprof("/debug/pprof/mutex", pprof.Handler("mutex"))
+		handlePprof("/debug/healthchecks", http.HandlerFunc(pendingHealthChecksHandler))
+		handlePprof("/debug/recent-events", http.HandlerFunc(recentEventsHandler))
+		if pprofToken == "" {
+			log.Println("WARNING: pprof endpoints are unauthenticated (set PPROF_AUTH_TOKEN to protect them)")
+		}
 	} else {
 		log.Println("pprof endpoints disabled (set ENABLE_PPROF=true to enable)")
 	}
 
-	go func() {
-		if enablePprof {
-			log.Println("Management server (metrics & pprof) listening on :9100")
-		} else {
-			log.Println("Management server (metrics) listening on :9100")
+	if capturedBodies != nil {
+		mgmtMux.Handle("/debug/last-bodies", newLastBodiesHandler(debugToken))
+	}
+
+	// Admin endpoints are never exposed unauthenticated
+	if adminToken != "" {
+		mgmtMux.HandleFunc("/check", newCheckHandler(adminToken, healthFilePath))
+		mgmtMux.HandleFunc("/admin/reset-metrics", newResetMetricsHandler(adminToken))
+		mgmtMux.HandleFunc("/admin/drain", newDrainHandler(adminToken, true))
+		mgmtMux.HandleFunc("/admin/undrain", newDrainHandler(adminToken, false))
+		if deadLetters != nil {
+			mgmtMux.HandleFunc("/admin/replay", newReplayHandler(ctx, adminToken))
+		}
+	}
+
+	// Bound concurrent management requests so a burst of scrapes or profiles
+	// during an incident can't add to the memory pressure being diagnosed.
+	// Probes stay exempt: a 503 there would get the pod restarted or pulled
+	// from the endpoints for being busy.
+	mgmtHandler := limitConcurrency(mgmtMaxConcurrent, mgmtMux, "/healthz", "/readyz", "/livez")
+	if singlePortMode {
+		server := newServer(relayListenAddr, newSinglePortHandler(relayMux, mgmtHandler), serverTimeouts)
+		listener, err := listen(server.Addr)
+		if err != nil {
+			log.Fatalf("FATAL: Server failed to listen: %v", err)
 		}
-		if err := http.ListenAndServe(":9100", mgmtMux); err != nil {
-			log.Fatalf("FATAL: Management server failed: %v", err)
+		servers = append(servers, server)
+		go func() {
+			log.Printf("Single port mode: relay and management (under %s/) listening on %s", singlePortMgmtPrefix, server.Addr)
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("FATAL: Server failed: %v", err)
+			}
+		}()
+	} else {
+		mgmtServer := newServer(mgmtListenAddr, mgmtHandler, serverTimeouts)
+		mgmtListener, err := listen(mgmtServer.Addr)
+		if err != nil {
+			log.Fatalf("FATAL: Management server failed to listen: %v", err)
 		}
-	}()
+		servers = append(servers, mgmtServer)
+
+		go func() {
+			if enablePprof {
+				log.Printf("Management server (metrics & pprof) listening on %s", mgmtServer.Addr)
+			} else {
+				log.Printf("Management server (metrics) listening on %s", mgmtServer.Addr)
+			}
+			if err := mgmtServer.Serve(mgmtListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("FATAL: Management server failed: %v", err)
+			}
+		}()
+	}
+
+	// --- Background work, started once the startup waits are over and the
+	// servers are listening, so health checks can reach the relay and queued
+	// events aren't delivered to a downstream still starting up ---
+	if healthCheckEnabled {
+		go runHealthChecker(ctx, healthCheckURL, healthFilePath, healthCheckInterval, healthCheckTimeout)
+	}
+	// Entries outlive their check only if its cleanup never ran; reclaim them after 2x the timeout
+	sweepMaxAge := 2 * time.Duration(healthCheckTimeout) * time.Second
+	go runHealthCheckSweeper(ctx, sweepMaxAge, sweepMaxAge)
+	go runGoroutineSampler(ctx, 15*time.Second)
+	if deadLetters != nil && deadLetterMaxAge > 0 {
+		// Often enough that nothing outlives the limit by more than a minute
+		go runDeadLetterJanitor(ctx, deadLetters, min(deadLetterMaxAge, time.Minute), deadLetterMaxAge)
+	}
+	if livenessURL != "" {
+		go runRelayLivenessChecker(ctx, livenessURL, livenessInterval, livenessTimeout)
+	}
+	if startQueueConsumer != nil {
+		startQueueConsumer()
+	}
 
-	select {}
+	signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	<-signalCtx.Done()
+	stop()
+	lameDuckShutdown(servers, preShutdown, time.Sleep)
 }
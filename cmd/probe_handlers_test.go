@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Probe Handlers", func() {
+	var (
+		recorder     *httptest.ResponseRecorder
+		mockRelay    *httptest.Server
+		relayPosts   atomic.Int32
+		loopBackIDs  bool
+		originalMode string
+	)
+
+	BeforeEach(func() {
+		recorder = httptest.NewRecorder()
+		relayPosts.Store(0)
+		loopBackIDs = true
+		originalMode = healthzMode
+
+		// Mock relay that loops health check events straight back to the sidecar
+		mockRelay = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			relayPosts.Add(1)
+			if loopBackIDs {
+				mutex.Lock()
+				if ch, ok := healthChecks[r.Header.Get("X-Health-Check-ID")]; ok {
+					ch <- true
+				}
+				mutex.Unlock()
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		healthCheckURL = mockRelay.URL
+		healthCheckTimeoutSeconds = 1
+
+		mutex.Lock()
+		healthChecks = make(map[string]chan bool)
+		mutex.Unlock()
+		setLastHealthStatus(nil)
+	})
+
+	AfterEach(func() {
+		healthzMode = originalMode
+		setLastHealthStatus(nil)
+		mockRelay.Close()
+	})
+
+	Describe("healthzHandler", func() {
+		Context("in live mode", func() {
+			BeforeEach(func() {
+				healthzMode = "live"
+			})
+
+			It("should run a round-trip and report OK", func() {
+				healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				Expect(recorder.Body.String()).To(ContainSubstring("OK"))
+				Expect(relayPosts.Load()).To(Equal(int32(1)))
+			})
+
+			It("should report 503 when the round-trip times out", func() {
+				loopBackIDs = false
+
+				healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+				Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(recorder.Body.String()).To(ContainSubstring("timed out"))
+			})
+		})
+
+		Context("in cached mode", func() {
+			BeforeEach(func() {
+				healthzMode = "cached"
+			})
+
+			It("should report the last background result without probing", func() {
+				setLastHealthStatus(&HealthStatus{Status: "success", Message: "Health check completed successfully"})
+
+				healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				Expect(recorder.Body.String()).To(ContainSubstring("OK"))
+				Expect(relayPosts.Load()).To(BeZero())
+			})
+
+			It("should report a cached failure as 503", func() {
+				setLastHealthStatus(&HealthStatus{Status: "failure", Message: "Health check timed out waiting for event round-trip"})
+
+				healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+				Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(recorder.Body.String()).To(ContainSubstring("timed out"))
+				Expect(relayPosts.Load()).To(BeZero())
+			})
+
+			It("should report 503 before any background check has completed", func() {
+				healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+				Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(recorder.Body.String()).To(ContainSubstring("no health check has completed yet"))
+				Expect(relayPosts.Load()).To(BeZero())
+			})
+
+			It("should tell a cold start apart from a failure once the first check completes", func() {
+				healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+				Expect(recorder.Body.String()).To(ContainSubstring("no health check has completed yet"))
+
+				setLastHealthStatus(&HealthStatus{Status: "failure", Message: "Failed to POST to smee server: connection refused"})
+				recorder = httptest.NewRecorder()
+				healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+				Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(recorder.Body.String()).To(ContainSubstring("connection refused"))
+				Expect(recorder.Body.String()).NotTo(ContainSubstring("no health check has completed yet"))
+			})
+		})
+
+		Context("with health checking disabled", func() {
+			BeforeEach(func() {
+				healthCheckEnabled = false
+			})
+
+			AfterEach(func() {
+				healthCheckEnabled = true
+			})
+
+			DescribeTable("should report liveness without a round-trip",
+				func(mode string) {
+					healthzMode = mode
+					healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+					Expect(recorder.Code).To(Equal(http.StatusOK))
+					Expect(recorder.Body.String()).To(ContainSubstring("health checking disabled"))
+					Expect(relayPosts.Load()).To(BeZero())
+				},
+				Entry("live mode", "live"),
+				Entry("cached mode", "cached"),
+			)
+		})
+	})
+
+	Describe("JSON probe responses", func() {
+		BeforeEach(func() {
+			probeResponseFormat = "json"
+			healthzMode = "cached"
+		})
+
+		AfterEach(func() {
+			probeResponseFormat = "text"
+		})
+
+		decode := func() probeResponse {
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+			var response probeResponse
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+			return response
+		}
+
+		It("should report success as ok", func() {
+			setLastHealthStatus(&HealthStatus{Status: "success", Message: "Health check completed successfully"})
+
+			healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(decode()).To(Equal(probeResponse{Status: "ok"}))
+		})
+
+		It("should report a timeout as unavailable with its message", func() {
+			setLastHealthStatus(&HealthStatus{Status: "failure", Message: "Health check timed out waiting for event round-trip"})
+
+			healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(decode()).To(Equal(probeResponse{Status: "unavailable", Message: "Health check timed out waiting for event round-trip"}))
+		})
+
+		It("should apply to /readyz too", func() {
+			healthCheckEverSucceeded.Store(false)
+
+			readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(decode().Status).To(Equal("unavailable"))
+		})
+	})
+
+	Describe("readyzHandler", func() {
+		BeforeEach(func() {
+			healthCheckEverSucceeded.Store(false)
+		})
+
+		AfterEach(func() {
+			healthCheckEverSucceeded.Store(false)
+			readinessRequireFirstSuccess = true
+		})
+
+		It("should report 503 until the first health check succeeds", func() {
+			readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(recorder.Body.String()).To(ContainSubstring("first successful health check"))
+
+			healthCheckEverSucceeded.Store(true)
+			recorder = httptest.NewRecorder()
+			readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(relayPosts.Load()).To(BeZero())
+		})
+
+		It("should report ready immediately when the gate is disabled", func() {
+			readinessRequireFirstSuccess = false
+
+			readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should report ready when health checking is disabled", func() {
+			healthCheckEnabled = false
+			defer func() { healthCheckEnabled = true }()
+
+			readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("livezHandler", func() {
+		AfterEach(func() {
+			livezCheckHeartbeat = false
+			healthCheckerHeartbeat.Store(0)
+		})
+
+		It("should always report alive by default", func() {
+			healthCheckerHeartbeat.Store(time.Now().Add(-time.Hour).UnixNano())
+
+			livezHandler(recorder, httptest.NewRequest("GET", "/livez", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal("alive"))
+		})
+
+		It("should report alive as JSON with PROBE_RESPONSE_FORMAT=json", func() {
+			probeResponseFormat = "json"
+			defer func() { probeResponseFormat = "text" }()
+
+			livezHandler(recorder, httptest.NewRequest("GET", "/livez", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(MatchJSON(`{"status":"alive"}`))
+		})
+
+		It("should fail once the health checker heartbeat is stale", func() {
+			livezCheckHeartbeat = true
+			livezMaxHeartbeatAge = 90 * time.Second
+
+			healthCheckerHeartbeat.Store(time.Now().Add(-time.Minute).UnixNano())
+			livezHandler(recorder, httptest.NewRequest("GET", "/livez", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+
+			healthCheckerHeartbeat.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+			recorder = httptest.NewRecorder()
+			livezHandler(recorder, httptest.NewRequest("GET", "/livez", nil))
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(recorder.Body.String()).To(ContainSubstring("health checker last ticked 2m0s ago"))
+		})
+
+		It("should report alive before the health checker has started", func() {
+			livezCheckHeartbeat = true
+
+			livezHandler(recorder, httptest.NewRequest("GET", "/livez", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("on-demand check handler", func() {
+		var (
+			tempDir        string
+			healthFilePath string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = os.MkdirTemp("", "smee-check-*")
+			Expect(err).NotTo(HaveOccurred())
+			healthFilePath = filepath.Join(tempDir, "health-status.txt")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		It("should run a check, record it and return the result as JSON", func() {
+			health_check.Set(0)
+
+			request := httptest.NewRequest("POST", "/check", nil)
+			request.Header.Set("Authorization", "Bearer admin")
+			newCheckHandler("admin", healthFilePath)(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			var status HealthStatus
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(Succeed())
+			Expect(status.Status).To(Equal("success"))
+
+			content, err := os.ReadFile(healthFilePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(ContainSubstring("status=success"))
+			Expect(string(content)).To(ContainSubstring("timestamp=" + status.Timestamp.UTC().Format(time.RFC3339)))
+			Expect(testutil.ToFloat64(health_check)).To(Equal(1.0))
+			recorded := getLastHealthStatus()
+			Expect(recorded.Status).To(Equal(status.Status))
+			Expect(recorded.Timestamp).To(BeTemporally("==", status.Timestamp))
+		})
+
+		It("should reject GET requests with 405", func() {
+			newCheckHandler("admin", healthFilePath)(recorder, httptest.NewRequest("GET", "/check", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+			Expect(recorder.Header().Get("Allow")).To(Equal("POST"))
+			Expect(relayPosts.Load()).To(BeZero())
+		})
+
+		It("should require the admin token", func() {
+			newCheckHandler("admin", healthFilePath)(recorder, httptest.NewRequest("POST", "/check", nil))
+
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(relayPosts.Load()).To(BeZero())
+		})
+
+		It("should refuse to overlap a check already in progress", func() {
+			healthCheckInProgress.Store(true)
+			defer healthCheckInProgress.Store(false)
+
+			request := httptest.NewRequest("POST", "/check", nil)
+			request.Header.Set("Authorization", "Bearer admin")
+			newCheckHandler("admin", healthFilePath)(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusConflict))
+			Expect(relayPosts.Load()).To(BeZero())
+		})
+	})
+})
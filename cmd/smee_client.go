@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// smeeEvent is a single Server-Sent Event read from the smee channel
+type smeeEvent struct {
+	name string
+	data string
+}
+
+// runSmeeClient subscribes to the smee channel's event stream (SMEE_CLIENT_MODE)
+// and replays every webhook it delivers through handler, standing in for a
+// separate smee-client container. Whenever the stream ends it reconnects,
+// backing off exponentially from backoffBase to backoffMax while connecting
+// keeps failing, and it returns once ctx is canceled.
+func runSmeeClient(ctx context.Context, channelURL string, handler http.Handler, backoffBase, backoffMax time.Duration) {
+	client := &http.Client{Transport: createOptimizedTransport()}
+	backoff := backoffBase
+	for {
+		connected, err := streamSmeeEvents(ctx, client, channelURL, func(event smeeEvent) {
+			if event.name != "message" {
+				debugf("Ignoring smee %q event", event.name)
+				return
+			}
+			// Like smee-client, deliver concurrently so a slow downstream
+			// doesn't hold up the rest of the stream
+			go replaySmeeEvent(ctx, handler, event.data)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		// A stream that was up only needs the base delay; repeated failures to
+		// connect back off so an outage doesn't hammer the relay
+		if connected {
+			backoff = backoffBase
+		}
+		log.Printf("Smee channel stream ended (%v), reconnecting in %s", err, backoff)
+		if sleepContext(ctx, backoff) != nil {
+			return
+		}
+		backoff = min(backoff*2, backoffMax)
+		smeeSSEReconnects.Inc()
+	}
+}
+
+// streamSmeeEvents connects to the smee channel and calls onEvent for each
+// event until the stream ends, reporting whether the connection was established
+func streamSmeeEvents(ctx context.Context, client *http.Client, channelURL string, onEvent func(smeeEvent)) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, channelURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("smee channel returned status %d", resp.StatusCode)
+	}
+
+	log.Printf("Connected to smee channel %s", redactURL(channelURL))
+	smeeSSEConnected.Set(1)
+	defer smeeSSEConnected.Set(0)
+	return true, readSmeeEvents(resp.Body, onEvent)
+}
+
+// readSmeeEvents parses a text/event-stream body, calling onEvent for each
+// dispatched event. Events without an event field are named "message".
+func readSmeeEvents(body io.Reader, onEvent func(smeeEvent)) error {
+	scanner := bufio.NewScanner(body)
+	// A data line carries a whole webhook payload
+	scanner.Buffer(make([]byte, 0, 64*1024), int(maxRequestBodyBytes)+64*1024)
+
+	var name string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				if name == "" {
+					name = "message"
+				}
+				onEvent(smeeEvent{name: name, data: strings.Join(data, "\n")})
+			}
+			name, data = "", nil
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			name = value
+		case "data":
+			data = append(data, value)
+		}
+		// Comments (empty field), id and retry are not needed
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// replaySmeeEvent rebuilds the original webhook request from a smee message,
+// whose JSON carries the body under "body", the query string under "query"
+// and every original header as a top-level key, and serves it with handler
+func replaySmeeEvent(ctx context.Context, handler http.Handler, data string) {
+	req, err := smeeEventRequest(ctx, data)
+	if err != nil {
+		log.Printf("ERROR: Dropping malformed smee event: %v", err)
+		return
+	}
+	w := &smeeResponseWriter{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(w, req)
+	debugf("Replayed smee event %s, got status %d", req.Header.Get("X-GitHub-Delivery"), w.status)
+}
+
+func smeeEventRequest(ctx context.Context, data string) (*http.Request, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		return nil, err
+	}
+
+	target := "/"
+	if query, ok := fields["query"]; ok {
+		var values map[string]string
+		if err := json.Unmarshal(query, &values); err == nil && len(values) > 0 {
+			params := url.Values{}
+			for key, value := range values {
+				params.Set(key, value)
+			}
+			target += "?" + params.Encode()
+		}
+	}
+
+	var body []byte
+	if raw, ok := fields["body"]; ok && string(raw) != "null" {
+		body = raw
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = "smee-client"
+
+	for key, raw := range fields {
+		switch strings.ToLower(key) {
+		// Not headers, or describing the smee connection rather than the webhook
+		case "body", "query", "timestamp", "host", "content-length", "connection":
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			value = string(raw)
+		}
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// smeeResponseWriter records the status of a replayed smee event and discards
+// the body, since the event's sender never sees the response
+type smeeResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *smeeResponseWriter) Header() http.Header         { return w.header }
+func (w *smeeResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *smeeResponseWriter) WriteHeader(code int)        { w.status = code }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Smee Client", func() {
+	const message = `{"x-github-event": "push", "content-type": "application/json", "host": "smee.io", "timestamp": 1718000000000, "query": {"source": "app"}, "body": {"ref": "refs/heads/main"}}`
+
+	Describe("readSmeeEvents", func() {
+		It("should dispatch named and unnamed events, joining multi-line data", func() {
+			stream := ": keep-alive\n\nevent: ready\ndata: {}\n\ndata: {\"a\":\ndata: 1}\n\nid: 7\nevent: ping\ndata: {}\n\n"
+			var events []smeeEvent
+
+			Expect(readSmeeEvents(strings.NewReader(stream), func(event smeeEvent) {
+				events = append(events, event)
+			})).To(MatchError(io.EOF))
+
+			Expect(events).To(Equal([]smeeEvent{
+				{name: "ready", data: "{}"},
+				{name: "message", data: "{\"a\":\n1}"},
+				{name: "ping", data: "{}"},
+			}))
+		})
+	})
+
+	Describe("smeeEventRequest", func() {
+		It("should rebuild the webhook's headers, query and body", func() {
+			req, err := smeeEventRequest(context.Background(), message)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(req.Method).To(Equal(http.MethodPost))
+			Expect(req.URL.RequestURI()).To(Equal("/?source=app"))
+			Expect(req.Header.Get("X-GitHub-Event")).To(Equal("push"))
+			Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+			Expect(req.Header).NotTo(HaveKey("Host"))
+			Expect(req.Header).NotTo(HaveKey("Timestamp"))
+			body, _ := io.ReadAll(req.Body)
+			Expect(string(body)).To(Equal(`{"ref": "refs/heads/main"}`))
+		})
+
+		It("should reject data that isn't a JSON object", func() {
+			_, err := smeeEventRequest(context.Background(), "not json")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("runSmeeClient", func() {
+		var (
+			channel     *httptest.Server
+			connections chan string
+			received    chan *http.Request
+			bodies      chan string
+		)
+
+		BeforeEach(func() {
+			connections = make(chan string, 10)
+			received = make(chan *http.Request, 10)
+			bodies = make(chan string, 10)
+			channel = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				connections <- r.Header.Get("Accept")
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprintf(w, "event: ready\ndata: {}\n\ndata: %s\n\n", message)
+				w.(http.Flusher).Flush()
+				// Hold the stream open like smee.io does
+				<-r.Context().Done()
+			}))
+		})
+
+		AfterEach(func() {
+			channel.CloseClientConnections()
+			channel.Close()
+		})
+
+		It("should replay streamed messages through the handler until shut down", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				runSmeeClient(ctx, channel.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ := io.ReadAll(r.Body)
+					received <- r
+					bodies <- string(body)
+				}), time.Second, time.Second)
+			}()
+
+			var r *http.Request
+			Eventually(received).Should(Receive(&r))
+			Expect(r.Header.Get("X-GitHub-Event")).To(Equal("push"))
+			Expect(<-bodies).To(Equal(`{"ref": "refs/heads/main"}`))
+			Consistently(received, "100ms").ShouldNot(Receive())
+			Expect(connections).To(HaveLen(1))
+			Expect(<-connections).To(Equal("text/event-stream"))
+			Expect(testutil.ToFloat64(smeeSSEConnected)).To(Equal(1.0))
+
+			cancel()
+			Eventually(done).Should(BeClosed())
+			Expect(testutil.ToFloat64(smeeSSEConnected)).To(BeZero())
+		})
+
+		It("should reconnect with backoff when the stream drops", func() {
+			channel.Close()
+			attempts := make(chan time.Time, 10)
+			channel = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts <- time.Now()
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			before := testutil.ToFloat64(smeeSSEReconnects)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				runSmeeClient(ctx, channel.URL, http.NotFoundHandler(), 20*time.Millisecond, 80*time.Millisecond)
+			}()
+
+			var times []time.Time
+			for i := 0; i < 4; i++ {
+				var at time.Time
+				Eventually(attempts).Should(Receive(&at))
+				times = append(times, at)
+			}
+			cancel()
+			Eventually(done).Should(BeClosed())
+
+			// 20ms, 40ms, then capped at 80ms
+			Expect(times[1].Sub(times[0])).To(BeNumerically(">=", 20*time.Millisecond))
+			Expect(times[2].Sub(times[1])).To(BeNumerically(">=", 40*time.Millisecond))
+			Expect(times[3].Sub(times[2])).To(BeNumerically(">=", 80*time.Millisecond))
+			Expect(testutil.ToFloat64(smeeSSEReconnects)).To(BeNumerically(">=", before+3))
+		})
+	})
+})
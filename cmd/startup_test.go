@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("Startup", func() {
+	Describe("validateDownstreamConfig", func() {
+		It("should start in echo mode with no downstream URL set", func() {
+			Expect(validateDownstreamConfig("echo", "")).To(Succeed())
+		})
+
+		It("should start in discard mode with no downstream URL set", func() {
+			Expect(validateDownstreamConfig("discard", "")).To(Succeed())
+		})
+
+		It("should still require a downstream URL in proxy mode", func() {
+			err := validateDownstreamConfig("proxy", "")
+			Expect(err).To(MatchError(ContainSubstring("DOWNSTREAM_SERVICE_URL")))
+			Expect(validateDownstreamConfig("proxy", "http://localhost:3000")).To(Succeed())
+		})
+
+		It("should reject a downstream URL without a host", func() {
+			Expect(validateDownstreamConfig("proxy", "localhost:3000")).To(MatchError(ContainSubstring("absolute URL")))
+			Expect(validateDownstreamConfig("proxy", "://invalid-url")).To(MatchError(ContainSubstring("absolute URL")))
+		})
+
+		It("should validate every replica in a comma-separated list", func() {
+			Expect(validateDownstreamConfig("proxy", "http://replica-a:8080,http://replica-b:8080")).To(Succeed())
+			Expect(validateDownstreamConfig("proxy", "http://replica-a:8080, replica-b:8080")).To(MatchError(ContainSubstring(`"replica-b:8080"`)))
+			Expect(validateDownstreamConfig("proxy", " , ")).To(MatchError(ContainSubstring("must be set")))
+		})
+
+		It("should accept a unix socket downstream", func() {
+			Expect(validateDownstreamConfig("proxy", "unix:///var/run/app.sock")).To(Succeed())
+			Expect(validateDownstreamConfig("proxy", "unix://")).To(MatchError(ContainSubstring("socket path")))
+		})
+
+		It("should reject unknown modes", func() {
+			Expect(validateDownstreamConfig("mirror", "http://localhost:3000")).To(MatchError(ContainSubstring("DOWNSTREAM_MODE")))
+		})
+	})
+
+	Describe("validateHealthCheckTiming", func() {
+		It("should accept a timeout shorter than the interval", func() {
+			Expect(validateHealthCheckTiming(30, 20)).To(Succeed())
+			Expect(validateHealthCheckTiming(30, 29)).To(Succeed())
+		})
+
+		It("should reject a timeout equal to or longer than the interval", func() {
+			Expect(validateHealthCheckTiming(30, 30)).To(MatchError(ContainSubstring("HEALTH_CHECK_TIMEOUT_SECONDS (30)")))
+			Expect(validateHealthCheckTiming(30, 45)).To(MatchError(ContainSubstring("HEALTH_CHECK_INTERVAL_SECONDS (30)")))
+		})
+	})
+
+	Describe("outbound proxy", func() {
+		AfterEach(func() {
+			forwardProxyURL = nil
+		})
+
+		It("should fall back to the proxy environment variables", func() {
+			Expect(createOptimizedTransport().Proxy).NotTo(BeNil())
+		})
+
+		It("should send outgoing requests through FORWARD_PROXY_URL", func() {
+			var proxiedHost string
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Proxies receive the absolute target URL rather than a bare path
+				proxiedHost = r.URL.Host
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer proxy.Close()
+			forwardProxyURL, _ = url.Parse(proxy.URL)
+
+			client := &http.Client{Transport: createOptimizedTransport()}
+			resp, err := client.Get("http://downstream.invalid:8080/webhook")
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(proxiedHost).To(Equal("downstream.invalid:8080"))
+		})
+	})
+
+	Describe("connection pool limits", func() {
+		AfterEach(func() {
+			os.Unsetenv("MAX_CONNS_PER_HOST")
+			maxConnsPerHost = 10
+		})
+
+		It("should fall back to the default when unset", func() {
+			Expect(getEnvNonNegativeInt("MAX_CONNS_PER_HOST", 10)).To(Equal(10))
+		})
+
+		It("should accept 0 to mean unlimited", func() {
+			os.Setenv("MAX_CONNS_PER_HOST", "0")
+			Expect(getEnvNonNegativeInt("MAX_CONNS_PER_HOST", 10)).To(Equal(0))
+		})
+
+		It("should reject negative and malformed values", func() {
+			os.Setenv("MAX_CONNS_PER_HOST", "-1")
+			_, err := getEnvNonNegativeInt("MAX_CONNS_PER_HOST", 10)
+			Expect(err).To(MatchError(ContainSubstring("MAX_CONNS_PER_HOST")))
+
+			os.Setenv("MAX_CONNS_PER_HOST", "lots")
+			_, err = getEnvNonNegativeInt("MAX_CONNS_PER_HOST", 10)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should apply the configured limits to new transports", func() {
+			maxConnsPerHost = 64
+			Expect(createOptimizedTransport().MaxConnsPerHost).To(Equal(64))
+		})
+	})
+
+	Describe("registerMetric", func() {
+		newCounter := func(help string) prometheus.Counter {
+			return prometheus.NewCounter(prometheus.CounterOpts{Name: "smee_test_total", Help: help})
+		}
+
+		It("should reuse the existing collector for a duplicate registration", func() {
+			registry := prometheus.NewRegistry()
+			first := registerMetric(registry, newCounter("Test counter."))
+
+			var second prometheus.Counter
+			Expect(func() {
+				second = registerMetric(registry, newCounter("Test counter."))
+			}).NotTo(Panic())
+			Expect(second).To(BeIdenticalTo(first))
+		})
+
+		It("should skip a conflicting metric without panicking", func() {
+			registry := prometheus.NewRegistry()
+			registerMetric(registry, newCounter("Test counter."))
+
+			conflicting := newCounter("A different description.")
+			Expect(func() {
+				Expect(registerMetric(registry, conflicting)).To(BeIdenticalTo(conflicting))
+			}).NotTo(Panic())
+
+			families, err := registry.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(families).To(HaveLen(1))
+			Expect(families[0].GetHelp()).To(Equal("Test counter."))
+		})
+	})
+
+	Describe("waitForDownstream", func() {
+		It("should wait for a downstream that becomes available after a delay", func() {
+			// Reserve a free port, then release it so the downstream can claim it later
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			address := listener.Addr().String()
+			listener.Close()
+
+			server := &http.Server{Handler: http.NotFoundHandler()}
+			defer server.Close()
+			go func() {
+				time.Sleep(500 * time.Millisecond)
+				delayed, err := net.Listen("tcp", address)
+				if err != nil {
+					return
+				}
+				server.Serve(delayed)
+			}()
+
+			start := time.Now()
+			err = waitForDownstream(context.Background(), fmt.Sprintf("http://%s", address), 5*time.Second, 100*time.Millisecond)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+		})
+
+		It("should give up once the timeout elapses", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			address := listener.Addr().String()
+			listener.Close()
+
+			err = waitForDownstream(context.Background(), fmt.Sprintf("http://%s", address), 500*time.Millisecond, 100*time.Millisecond)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not reachable"))
+		})
+
+		It("should reject an unparseable downstream URL", func() {
+			err := waitForDownstream(context.Background(), "://invalid-url", time.Second, 100*time.Millisecond)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("limitConnLifetime", func() {
+		var (
+			server      *httptest.Server
+			connections atomic.Int32
+		)
+
+		BeforeEach(func() {
+			connections.Store(0)
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					connections.Add(1)
+				}
+			}
+			server.Start()
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		get := func(client *http.Client, path string) {
+			resp, err := client.Get(server.URL + path)
+			Expect(err).NotTo(HaveOccurred())
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		It("should reuse pooled connections without a lifetime", func() {
+			transport := createOptimizedTransport()
+			client := &http.Client{Transport: limitConnLifetime(transport, 0)}
+
+			get(client, "/")
+			time.Sleep(100 * time.Millisecond)
+			get(client, "/")
+
+			Expect(client.Transport).To(BeIdenticalTo(transport))
+			Expect(connections.Load()).To(BeEquivalentTo(1))
+		})
+
+		It("should keep reusing connections within the lifetime", func() {
+			client := &http.Client{Transport: limitConnLifetime(createOptimizedTransport(), time.Minute)}
+
+			get(client, "/")
+			get(client, "/")
+
+			Expect(connections.Load()).To(BeEquivalentTo(1))
+		})
+
+		It("should close a connection that expires while idle", func() {
+			client := &http.Client{Transport: limitConnLifetime(createOptimizedTransport(), 50*time.Millisecond)}
+
+			get(client, "/")
+			time.Sleep(150 * time.Millisecond)
+			get(client, "/")
+
+			Expect(connections.Load()).To(BeEquivalentTo(2))
+		})
+
+		// startSlow holds a first connection busy until the returned release is called
+		startSlow := func(client *http.Client, remoteAddrs chan string) (release func()) {
+			slow := make(chan struct{})
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remoteAddrs <- r.RemoteAddr
+				if r.URL.Path == "/slow" {
+					<-slow
+				}
+			})
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				get(client, "/slow")
+			}()
+			return func() {
+				close(slow)
+				<-done
+			}
+		}
+
+		It("should retire a connection that expires while busy once its response completes", func() {
+			remoteAddrs := make(chan string, 3)
+			client := &http.Client{Transport: limitConnLifetime(createOptimizedTransport(), 200*time.Millisecond)}
+			release := startSlow(client, remoteAddrs)
+			first := <-remoteAddrs
+
+			// Past the first connection's lifetime, a second one is dialed
+			time.Sleep(300 * time.Millisecond)
+			get(client, "/")
+			second := <-remoteAddrs
+			Expect(second).NotTo(Equal(first))
+
+			release()
+			get(client, "/")
+
+			// The expired connection was closed, the younger one reused
+			Expect(<-remoteAddrs).To(Equal(second))
+			Expect(connections.Load()).To(BeEquivalentTo(2))
+		})
+
+		It("should only close the expired connection, reusing a younger one", func() {
+			remoteAddrs := make(chan string, 3)
+			client := &http.Client{Transport: limitConnLifetime(createOptimizedTransport(), 300*time.Millisecond)}
+			release := startSlow(client, remoteAddrs)
+			first := <-remoteAddrs
+
+			// A second connection, 150ms younger than the first
+			time.Sleep(150 * time.Millisecond)
+			get(client, "/")
+			second := <-remoteAddrs
+			Expect(second).NotTo(Equal(first))
+			release()
+
+			// Only the first connection has expired by now
+			time.Sleep(200 * time.Millisecond)
+			get(client, "/")
+
+			Expect(<-remoteAddrs).To(Equal(second))
+			Expect(connections.Load()).To(BeEquivalentTo(2))
+		})
+	})
+
+	Describe("warmUpDownstream", func() {
+		var (
+			downstream *httptest.Server
+			checks     atomic.Int32
+		)
+
+		BeforeEach(func() {
+			checks.Store(0)
+			// Not ready for the first two checks
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/healthz" || checks.Add(1) <= 2 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			downstreamServiceURL = downstream.URL
+			downstreamHealthPath = "/healthz"
+			healthCheckClient = nil
+			healthCheckOnce = sync.Once{}
+		})
+
+		AfterEach(func() {
+			downstreamHealthPath = ""
+			downstream.Close()
+		})
+
+		It("should wait until the downstream health path answers 2xx", func() {
+			Expect(warmUpDownstream(context.Background(), 5*time.Second, 50*time.Millisecond)).To(Succeed())
+			Expect(checks.Load()).To(BeEquivalentTo(3))
+		})
+
+		It("should give up once the timeout elapses", func() {
+			err := warmUpDownstream(context.Background(), 60*time.Millisecond, 50*time.Millisecond)
+			Expect(err).To(MatchError(ContainSubstring("did not answer /healthz")))
+		})
+	})
+
+	Describe("parseExtraHeaders", func() {
+		It("should parse a JSON object", func() {
+			headers, err := parseExtraHeaders(`{"authorization": "Bearer s3cret", "X-Internal-Token": "abc"}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(headers).To(Equal(map[string]string{"Authorization": "Bearer s3cret", "X-Internal-Token": "abc"}))
+		})
+
+		It("should parse a name=value list, keeping = in values", func() {
+			headers, err := parseExtraHeaders("x-internal-token=abc==, X-Env = prod")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(headers).To(Equal(map[string]string{"X-Internal-Token": "abc==", "X-Env": "prod"}))
+		})
+
+		It("should reject malformed entries", func() {
+			for _, raw := range []string{"X-Token", `{"X-Token": 1}`, "=value", "Bad Name=value", `{"X-Token": "a\r\nInjected: b"}`} {
+				_, err := parseExtraHeaders(raw)
+				Expect(err).To(HaveOccurred(), raw)
+			}
+		})
+	})
+
+	Describe("waitStartupDelay", func() {
+		It("should return once the delay elapses", func() {
+			start := time.Now()
+			Expect(waitStartupDelay(context.Background(), 50*time.Millisecond)).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		})
+
+		It("should stop waiting on shutdown", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			start := time.Now()
+			Expect(waitStartupDelay(ctx, time.Minute)).To(MatchError(context.Canceled))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	Describe("lameDuckShutdown", func() {
+		BeforeEach(func() {
+			readinessRequireFirstSuccess = false
+		})
+
+		AfterEach(func() {
+			readinessRequireFirstSuccess = true
+			shuttingDown.Store(false)
+		})
+
+		It("should fail readiness but keep serving until the pre-shutdown period ends", func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/readyz", readyzHandler)
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("relayed"))
+			})
+			server := newServer("127.0.0.1:0", mux, ServerTimeouts{})
+			listener, err := net.Listen("tcp", server.Addr)
+			Expect(err).NotTo(HaveOccurred())
+			served := make(chan error, 1)
+			go func() { served <- server.Serve(listener) }()
+			baseURL := "http://" + listener.Addr().String()
+
+			// A connection dialed but never used would hold Shutdown up for 5s
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			status := func(path string) int {
+				resp, err := client.Get(baseURL + path)
+				if err != nil {
+					return 0
+				}
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			Expect(status("/readyz")).To(Equal(http.StatusOK))
+
+			// The pre-shutdown period lasts until the test ends it
+			endPreShutdown := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				lameDuckShutdown([]*http.Server{server}, time.Minute, func(time.Duration) { <-endPreShutdown })
+			}()
+
+			Eventually(func() int { return status("/readyz") }).Should(Equal(http.StatusServiceUnavailable))
+			Expect(status("/github")).To(Equal(http.StatusOK))
+			Consistently(done, "100ms").ShouldNot(BeClosed())
+
+			close(endPreShutdown)
+			Eventually(done).Should(BeClosed())
+			Expect(<-served).To(MatchError(http.ErrServerClosed))
+			Expect(status("/github")).To(BeZero())
+		})
+	})
+
+	Describe("listen addresses", func() {
+		DescribeTable("parseListenAddr",
+			func(addr, network, address string) {
+				gotNetwork, gotAddress, err := parseListenAddr(addr)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(gotNetwork).To(Equal(network))
+				Expect(gotAddress).To(Equal(address))
+			},
+			Entry("bare port", ":8080", "tcp", ":8080"),
+			Entry("tcp scheme", "tcp://0.0.0.0:8080", "tcp", "0.0.0.0:8080"),
+			Entry("IPv6 host", "tcp://[::1]:8080", "tcp", "[::1]:8080"),
+			Entry("IPv6 only", "tcp6://[::]:9100", "tcp6", "[::]:9100"),
+			Entry("unix socket", "unix:///var/run/relay.sock", "unix", "/var/run/relay.sock"),
+		)
+
+		It("should reject malformed addresses", func() {
+			for _, addr := range []string{"8080", "unix://", "udp://:8080", "tcp://localhost"} {
+				_, _, err := parseListenAddr(addr)
+				Expect(err).To(MatchError(ContainSubstring("invalid listen address")), addr)
+			}
+		})
+
+		Describe("on a unix socket", func() {
+			var socketPath string
+
+			BeforeEach(func() {
+				dir, err := os.MkdirTemp("", "smee-sock-*")
+				Expect(err).NotTo(HaveOccurred())
+				DeferCleanup(os.RemoveAll, dir)
+				socketPath = filepath.Join(dir, "relay.sock")
+			})
+
+			get := func() (*http.Response, error) {
+				client := &http.Client{Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+					},
+				}}
+				return client.Get("http://relay/webhook")
+			}
+
+			It("should serve requests", func() {
+				listener, err := listen("unix://" + socketPath)
+				Expect(err).NotTo(HaveOccurred())
+				server := newServer("unix://"+socketPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, "relayed %s", r.URL.Path)
+				}), ServerTimeouts{})
+				go server.Serve(listener)
+				defer server.Close()
+
+				resp, err := get()
+				Expect(err).NotTo(HaveOccurred())
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("relayed /webhook"))
+			})
+
+			It("should replace a socket left behind by a previous run", func() {
+				stale, err := net.Listen("unix", socketPath)
+				Expect(err).NotTo(HaveOccurred())
+				// Keep the file around as an unclean shutdown would
+				stale.(*net.UnixListener).SetUnlinkOnClose(false)
+				stale.Close()
+
+				listener, err := listen("unix://" + socketPath)
+				Expect(err).NotTo(HaveOccurred())
+				listener.Close()
+			})
+
+			It("should not remove a regular file in the way", func() {
+				Expect(os.WriteFile(socketPath, []byte("data"), 0600)).To(Succeed())
+
+				_, err := listen("unix://" + socketPath)
+				Expect(err).To(HaveOccurred())
+				Expect(socketPath).To(BeARegularFile())
+			})
+		})
+	})
+})
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Header carrying GitHub's HMAC-SHA256 of the webhook body
+const webhookSignatureHeader = "X-Hub-Signature-256"
+
+// matchWebhookSignature returns the index of the secret under which header,
+// "sha256=" followed by a hex HMAC-SHA256, signs body, or -1 when none does.
+// Several secrets are valid at once while a webhook secret is being rotated.
+func matchWebhookSignature(header string, body []byte, secrets [][]byte) int {
+	signature, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return -1
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return -1
+	}
+	for i, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if hmac.Equal(got, mac.Sum(nil)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// verifyWebhookSignature buffers the request body and checks its signature
+// against webhookHMACSecrets. It answers the request itself and returns false
+// when the event must not be forwarded; with HMAC_MODE=log_only a bad
+// signature is only logged and counted.
+func verifyWebhookSignature(w http.ResponseWriter, r *http.Request) bool {
+	if r.ContentLength > maxRequestBodyBytes {
+		rejectOversizeRequest(w)
+		return false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			rejectOversizeRequest(w)
+			return false
+		}
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return false
+	}
+	replaceBody(r, body)
+
+	if key := matchWebhookSignature(r.Header.Get(webhookSignatureHeader), body, webhookHMACSecrets); key >= 0 {
+		hmacKeyUsed.WithLabelValues(strconv.Itoa(key)).Inc()
+		return true
+	}
+	webhookSignatureFailures.Inc()
+	delivery := r.Header.Get("X-GitHub-Delivery")
+	if hmacLogOnly {
+		log.Printf("WARNING: Event %s has an invalid webhook signature, forwarding it anyway (HMAC_MODE=log_only)", delivery)
+		return true
+	}
+	log.Printf("Rejecting event %s with an invalid webhook signature", delivery)
+	http.Error(w, "invalid webhook signature", http.StatusUnauthorized)
+	return false
+}
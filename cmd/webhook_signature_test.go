@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Webhook Signature Verification", func() {
+	const payload = `{"action": "opened"}`
+
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	It("should accept only the signature of the body under a secret", func() {
+		secrets := [][]byte{[]byte("s3cret")}
+		Expect(matchWebhookSignature(sign("s3cret", payload), []byte(payload), secrets)).To(Equal(0))
+		Expect(matchWebhookSignature(sign("other", payload), []byte(payload), secrets)).To(Equal(-1))
+		Expect(matchWebhookSignature(sign("s3cret", payload+" "), []byte(payload), secrets)).To(Equal(-1))
+		Expect(matchWebhookSignature(strings.TrimPrefix(sign("s3cret", payload), "sha256="), []byte(payload), secrets)).To(Equal(-1))
+		Expect(matchWebhookSignature("sha256=not-hex", []byte(payload), secrets)).To(Equal(-1))
+		Expect(matchWebhookSignature("", []byte(payload), secrets)).To(Equal(-1))
+	})
+
+	It("should report which of several secrets matched", func() {
+		secrets := [][]byte{[]byte("old"), []byte("new")}
+		Expect(matchWebhookSignature(sign("old", payload), []byte(payload), secrets)).To(Equal(0))
+		Expect(matchWebhookSignature(sign("new", payload), []byte(payload), secrets)).To(Equal(1))
+	})
+
+	Describe("in forwardHandler", func() {
+		var (
+			downstream *httptest.Server
+			received   chan string
+		)
+
+		BeforeEach(func() {
+			received = make(chan string, 1)
+			downstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				received <- string(body)
+			}))
+			downstreamServiceURL = downstream.URL
+			proxyReplicas = nil
+			proxyOnce = sync.Once{}
+			proxyError = nil
+			webhookHMACSecrets = [][]byte{[]byte("s3cret")}
+		})
+
+		AfterEach(func() {
+			webhookHMACSecrets = nil
+			hmacLogOnly = false
+			downstream.Close()
+		})
+
+		forward := func(signature string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/", strings.NewReader(payload))
+			if signature != "" {
+				request.Header.Set(webhookSignatureHeader, signature)
+			}
+			forwardHandler(recorder, request)
+			return recorder
+		}
+
+		It("should forward correctly signed events intact", func() {
+			before := testutil.ToFloat64(webhookSignatureFailures)
+
+			Expect(forward(sign("s3cret", payload)).Code).To(Equal(http.StatusOK))
+			Expect(received).To(Receive(Equal(payload)))
+			Expect(testutil.ToFloat64(webhookSignatureFailures)).To(Equal(before))
+		})
+
+		It("should accept the new secret during a rotation and count which key matched", func() {
+			webhookHMACSecrets = [][]byte{[]byte("s3cret"), []byte("rotated")}
+			before := testutil.ToFloat64(hmacKeyUsed.WithLabelValues("1"))
+
+			Expect(forward(sign("rotated", payload)).Code).To(Equal(http.StatusOK))
+			Expect(received).To(Receive(Equal(payload)))
+			Expect(testutil.ToFloat64(hmacKeyUsed.WithLabelValues("1"))).To(Equal(before + 1))
+		})
+
+		It("should reject bad or missing signatures when enforcing", func() {
+			before := testutil.ToFloat64(webhookSignatureFailures)
+
+			Expect(forward(sign("wrong", payload)).Code).To(Equal(http.StatusUnauthorized))
+			Expect(forward("").Code).To(Equal(http.StatusUnauthorized))
+			Expect(received).NotTo(Receive())
+			Expect(testutil.ToFloat64(webhookSignatureFailures)).To(Equal(before + 2))
+		})
+
+		It("should count but still forward bad signatures in log_only mode", func() {
+			hmacLogOnly = true
+			before := testutil.ToFloat64(webhookSignatureFailures)
+
+			Expect(forward(sign("wrong", payload)).Code).To(Equal(http.StatusOK))
+			Expect(received).To(Receive(Equal(payload)))
+			Expect(testutil.ToFloat64(webhookSignatureFailures)).To(Equal(before + 1))
+		})
+
+		It("should not verify health checks", func() {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/", strings.NewReader(`{"type": "health-check"}`))
+			request.Header.Set("X-Health-Check-ID", "unsigned-probe")
+			forwardHandler(recorder, request)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+	})
+})